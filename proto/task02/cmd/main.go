@@ -4,20 +4,59 @@ import (
 	"context"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"time"
 
 	"proto/common/pkg/tcpserver"
 	"proto/task02/pkg/price"
+	"proto/task02/pkg/price/store"
 )
 
 const tcpPort = 8080
 
 // Task02 - Means to an End - https://protohackers.com/problem/2
+//
+// Optional environment variables for the shared instruments store:
+//
+//	STORE_PATH       - append-only log location (in-memory store if empty)
+//	RETENTION        - max number of points per instrument (unlimited if empty)
+//	COMPACT_INTERVAL - log compaction interval (eg. 5m, default 1m)
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	err := tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
-		(&price.Handler{}).Handle(ctx, conn)
+	opts := store.Options{
+		Path:            os.Getenv("STORE_PATH"),
+		CompactInterval: time.Minute,
+	}
+
+	if v := os.Getenv("RETENTION"); v != "" {
+		retention, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalln("Error: invalid RETENTION:", err.Error())
+		}
+		opts.Retention = retention
+	}
+
+	if v := os.Getenv("COMPACT_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalln("Error: invalid COMPACT_INTERVAL:", err.Error())
+		}
+		opts.CompactInterval = interval
+	}
+
+	st, err := store.Open(ctx, opts)
+	if err != nil {
+		log.Fatalln("Error: [Store]:", err.Error())
+	}
+	defer func() {
+		_ = st.Close()
+	}()
+
+	err = tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
+		price.New(st).Handle(ctx, conn)
 	})
 	if err != nil {
 		log.Println("Error: [Listen]:", err.Error())
@@ -11,7 +11,29 @@ const (
 	TypeInsert = byte('I')
 	TypeQuery  = byte('Q')
 
+	// Extended aggregate queries. All of them carry the same [min-max] time range as TypeQuery.
+	// The responses are int32 except for TypeSum and TypeOHLC.
+	TypeMin        = byte('m')
+	TypeMax        = byte('x')
+	TypeCount      = byte('c')
+	TypeSum        = byte('s') // responds with int64 (8 bytes) - the sum of int32 prices overflows int32
+	TypeMedian     = byte('d')
+	TypePercentile = byte('p') // followed by int32 percentile (0-100)
+	TypeOHLC       = byte('o') // followed by int32 bucket width
+
+	// TypeSelect selects a named instrument shared by all connections. It is followed by a uint8
+	// length prefixed instrument name instead of the payload.
+	TypeSelect = byte('T')
+
+	// Streaming subscriptions. Once a connection has subscribed, every server message is tagged
+	// with either TypeResponse (followed by the usual response) or TypeUpdate (followed by Update).
+	TypeSubscribe   = byte('+') // followed by Subscribe
+	TypeUnsubscribe = byte('-') // followed by uint32 subscription ID
+	TypeResponse    = byte('R')
+	TypeUpdate      = byte('U')
+
 	MsgLength = 9
+	ArgLength = 4
 )
 
 // Payload stores the Payload data.
@@ -43,3 +65,158 @@ func (m *Msg) ReadFrom(in io.Reader) (int64, error) {
 func (m *Msg) Len() int64 {
 	return MsgLength
 }
+
+// Request is a message followed by an optional argument (only for the types that require one).
+// TypeSelect request carries the instrument Name instead of the payload.
+// TypeSubscribe and TypeUnsubscribe requests carry Sub instead of the payload (only Sub.ID is set
+// for the latter).
+type Request struct {
+	Msg
+	Arg  int32
+	Name string
+	Sub  Subscribe
+}
+
+// Subscribe is the TypeSubscribe message payload.
+type Subscribe struct {
+	ID      uint32
+	Stat    byte  // one of the single value query types (TypeQuery, TypeMin, ... TypePercentile)
+	Rolling bool  // rolling window covers the last From time units up to the latest point.
+	From    int32 // fixed window start or rolling window width
+	To      int32 // fixed window end - ignored for rolling windows
+	Arg     int32 // percentile for TypePercentile
+}
+
+// Update is pushed to the subscribers whenever the subscribed value changes.
+type Update struct {
+	ID    uint32
+	Value int64
+}
+
+// ReadFrom reads a request from the provided io.Reader
+func (r *Request) ReadFrom(in io.Reader) (int64, error) {
+	if err := binary.Read(in, binary.BigEndian, &r.Type); err != nil {
+		return 0, err // EOF - only if no data was read as per binary.Read docs.
+	}
+
+	if r.Type == TypeSelect {
+		name, err := readString(in)
+		if err != nil {
+			return 0, errors.New("Corrupted data")
+		}
+
+		r.Name = name
+		return r.Len(), nil
+	}
+
+	switch r.Type {
+	case TypeSubscribe:
+		if err := binary.Read(in, binary.BigEndian, &r.Sub); err != nil {
+			return 0, errors.New("Corrupted data")
+		}
+		return r.Len(), nil
+
+	case TypeUnsubscribe:
+		if err := binary.Read(in, binary.BigEndian, &r.Sub.ID); err != nil {
+			return 0, errors.New("Corrupted data")
+		}
+		return r.Len(), nil
+	}
+
+	if err := binary.Read(in, binary.BigEndian, &r.Payload); err != nil {
+		return 0, errors.New("Corrupted data")
+	}
+
+	if HasArg(r.Type) {
+		if err := binary.Read(in, binary.BigEndian, &r.Arg); err != nil {
+			return 0, errors.New("Corrupted data")
+		}
+	}
+
+	return r.Len(), nil
+}
+
+// Len return the length of the request
+func (r *Request) Len() int64 {
+	switch {
+	case r.Type == TypeSelect:
+		return 1 + 1 + int64(len(r.Name))
+
+	case r.Type == TypeSubscribe:
+		return 1 + int64(binary.Size(r.Sub))
+
+	case r.Type == TypeUnsubscribe:
+		return 1 + 4
+
+	case HasArg(r.Type):
+		return MsgLength + ArgLength
+	}
+
+	return MsgLength
+}
+
+// WriteSelect writes an instrument selection request into the io.Writer.
+func WriteSelect(w io.Writer, name string) error {
+	if len(name) > 255 {
+		return errors.New("instrument name is too long")
+	}
+
+	_, err := w.Write(append([]byte{TypeSelect, byte(len(name))}, name...))
+	return err
+}
+
+// WriteSubscribe writes a subscription request into the io.Writer.
+func WriteSubscribe(w io.Writer, sub Subscribe) error {
+	if _, err := w.Write([]byte{TypeSubscribe}); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, sub)
+}
+
+// WriteUnsubscribe writes an unsubscribe request into the io.Writer.
+func WriteUnsubscribe(w io.Writer, id uint32) error {
+	if _, err := w.Write([]byte{TypeUnsubscribe}); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, id)
+}
+
+func readString(r io.Reader) (string, error) {
+	var sz uint8
+	if err := binary.Read(r, binary.BigEndian, &sz); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, sz)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// HasArg returns true if the message type is followed by an argument.
+func HasArg(kind byte) bool {
+	return kind == TypePercentile || kind == TypeOHLC
+}
+
+// OHLC represents a single open/high/low/close bucket starting at Start.
+type OHLC struct {
+	Start int32
+	Open  int32
+	High  int32
+	Low   int32
+	Close int32
+}
+
+// WriteOHLC writes the buckets in a length-prefixed format: uint32 number of buckets followed by
+// the buckets themselves.
+func WriteOHLC(w io.Writer, buckets []OHLC) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(buckets))); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, buckets)
+}
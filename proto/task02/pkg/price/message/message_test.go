@@ -50,3 +50,82 @@ func TestMessage_ReadFrom(t *testing.T) {
 		})
 	}
 }
+
+func TestRequest_ReadFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      io.Reader
+		wantReq message.Request
+		wantN   int64
+		wantErr bool
+	}{
+		{
+			name: "should read a request without an argument",
+			in: bytes.NewReader([]byte{
+				0x51,
+				0x00, 0x00, 0x03, 0xe8,
+				0x00, 0x01, 0x86, 0xa0}),
+			wantReq: message.Request{
+				Msg: message.Msg{Type: 'Q', Payload: message.Payload{Time: 1000, Data: 100000}},
+			},
+			wantN: message.MsgLength,
+		},
+		{
+			name: "should read a request with an argument",
+			in: bytes.NewReader([]byte{
+				0x70,
+				0x00, 0x00, 0x03, 0xe8,
+				0x00, 0x01, 0x86, 0xa0,
+				0x00, 0x00, 0x00, 0x5a}),
+			wantReq: message.Request{
+				Msg: message.Msg{Type: 'p', Payload: message.Payload{Time: 1000, Data: 100000}},
+				Arg: 90,
+			},
+			wantN: message.MsgLength + message.ArgLength,
+		},
+		{
+			name: "should fail if the argument is truncated",
+			in: bytes.NewReader([]byte{
+				0x6f,
+				0x00, 0x00, 0x03, 0xe8,
+				0x00, 0x01, 0x86, 0xa0,
+				0x00, 0x00}),
+			wantReq: message.Request{
+				Msg: message.Msg{Type: 'o', Payload: message.Payload{Time: 1000, Data: 100000}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			var req message.Request
+			gotN, err := req.ReadFrom(tt.in)
+			if tt.wantErr {
+				is.True(err != nil)
+			} else {
+				is.NoErr(err)
+				is.Equal(gotN, tt.wantN)
+				is.Equal(gotN, req.Len())
+			}
+
+			is.Equal(req, tt.wantReq)
+		})
+	}
+}
+
+func TestRequest_ReadFrom_Select(t *testing.T) {
+	is := is.New(t)
+
+	var buf bytes.Buffer
+	is.NoErr(message.WriteSelect(&buf, "AAPL"))
+
+	var req message.Request
+	n, err := req.ReadFrom(&buf)
+	is.NoErr(err)
+	is.Equal(n, int64(6))
+	is.Equal(req.Type, message.TypeSelect)
+	is.Equal(req.Name, "AAPL")
+}
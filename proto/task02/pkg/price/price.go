@@ -6,17 +6,37 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sync"
 
 	"proto/task02/pkg/price/message"
+	"proto/task02/pkg/price/store"
 )
 
 // Handler handles price server
 type Handler struct {
-	payloads []message.Payload
+	payloads   []message.Payload
+	store      *store.Store
+	instrument string // selected shared instrument - private payloads are used if empty.
+
+	mu       sync.Mutex // guards writes to w and the subscriptions
+	w        io.Writer
+	tagged   bool // once subscribed, the responses are tagged to tell them apart from updates.
+	subs     map[uint32]*subscription
+	watching string // instrument the subscriptions are currently bound to
+	unwatch  func()
+}
+
+// New creates a new Handler instance. The store may be nil, in which case clients cannot select
+// shared instruments and only the private per-connection payloads are used.
+func New(st *store.Store) *Handler {
+	return &Handler{store: st}
 }
 
 // Handle handles a single connection
 func (m *Handler) Handle(ctx context.Context, rw io.ReadWriter) {
+	m.w = rw
+	defer m.stopWatching()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -26,31 +46,95 @@ func (m *Handler) Handle(ctx context.Context, rw io.ReadWriter) {
 		default:
 		}
 
-		msg := &message.Msg{}
-		if _, err := msg.ReadFrom(rw); err != nil {
+		req := &message.Request{}
+		if _, err := req.ReadFrom(rw); err != nil {
 			if !errors.Is(err, io.EOF) {
 				log.Println("Error readfrom:", err.Error())
 			}
 			return
 		}
 
-		switch msg.Type {
-		case message.TypeInsert:
-			log.Printf(">>> INS %d %d", msg.Payload.Time, msg.Payload.Data)
-			m.payloads = append(m.payloads, msg.Payload)
+		if err := m.handleRequest(ctx, req); err != nil {
+			log.Println("Error handleRequest:", err.Error())
+			return
+		}
+	}
+}
 
-		case message.TypeQuery:
-			log.Printf(">>> QRY %d %d", msg.Payload.Time, msg.Payload.Data)
-			mean := m.handleQuery(ctx, msg)
-			if err := sendResponse(mean, rw); err != nil {
-				log.Println("Error sendResponse:", err.Error())
-				return
-			}
+func (m *Handler) handleRequest(ctx context.Context, req *message.Request) error {
+	msg := &req.Msg
 
-		default:
-			log.Printf("Corrupt message: %#v", msg)
+	switch msg.Type {
+	case message.TypeSelect:
+		log.Printf(">>> SEL %s", req.Name)
+		if m.store == nil {
+			return errors.New("shared instruments are not supported")
 		}
+
+		if req.Name == "" {
+			return errors.New("empty instrument name")
+		}
+
+		m.instrument = req.Name
+		m.rebindSubscriptions()
+
+		return m.refresh(m.instrument, m.data())
+
+	case message.TypeInsert:
+		log.Printf(">>> INS %d %d", msg.Payload.Time, msg.Payload.Data)
+		if m.instrument == "" {
+			m.payloads = append(m.payloads, msg.Payload)
+			return m.refresh("", m.payloads)
+		}
+
+		// subscriptions of the shared instruments are refreshed by the store watcher.
+		return m.store.Insert(m.instrument, msg.Payload)
+
+	case message.TypeSubscribe:
+		log.Printf(">>> SUB %d %c", req.Sub.ID, req.Sub.Stat)
+		return m.subscribe(req.Sub)
+
+	case message.TypeUnsubscribe:
+		log.Printf(">>> UNS %d", req.Sub.ID)
+		return m.unsubscribe(req.Sub.ID)
+
+	case message.TypeQuery:
+		log.Printf(">>> QRY %d %d", msg.Payload.Time, msg.Payload.Data)
+		return m.respond(m.handleQuery(ctx, msg))
+
+	case message.TypeMin:
+		log.Printf(">>> MIN %d %d", msg.Payload.Time, msg.Payload.Data)
+		return m.respond(minimum(m.window(msg)))
+
+	case message.TypeMax:
+		log.Printf(">>> MAX %d %d", msg.Payload.Time, msg.Payload.Data)
+		return m.respond(maximum(m.window(msg)))
+
+	case message.TypeCount:
+		log.Printf(">>> CNT %d %d", msg.Payload.Time, msg.Payload.Data)
+		return m.respond(int32(len(m.window(msg))))
+
+	case message.TypeSum:
+		log.Printf(">>> SUM %d %d", msg.Payload.Time, msg.Payload.Data)
+		return m.respond(sum(m.window(msg)))
+
+	case message.TypeMedian:
+		log.Printf(">>> MED %d %d", msg.Payload.Time, msg.Payload.Data)
+		return m.respond(median(m.window(msg)))
+
+	case message.TypePercentile:
+		log.Printf(">>> PCT %d %d %d", msg.Payload.Time, msg.Payload.Data, req.Arg)
+		return m.respond(percentile(m.window(msg), req.Arg))
+
+	case message.TypeOHLC:
+		log.Printf(">>> OHL %d %d %d", msg.Payload.Time, msg.Payload.Data, req.Arg)
+		return m.respond(ohlc(m.window(msg), msg.Payload.Time, req.Arg))
+
+	default:
+		log.Printf("Corrupt message: %#v", msg)
 	}
+
+	return nil
 }
 
 func (m *Handler) handleQuery(ctx context.Context, msg *message.Msg) int32 {
@@ -59,14 +143,21 @@ func (m *Handler) handleQuery(ctx context.Context, msg *message.Msg) int32 {
 		return 0
 	}
 
-	prices := make([]float64, 0, len(m.payloads))
-	for _, pl := range m.payloads {
-		if pl.Time >= msg.Payload.Time && pl.Time <= msg.Payload.Data {
-			prices = append(prices, float64(pl.Data))
-		}
+	return mean(window(m.data(), msg.Payload.Time, msg.Payload.Data))
+}
+
+// window returns the payloads within the [min-max] time range of the message sorted by time.
+func (m *Handler) window(msg *message.Msg) []message.Payload {
+	return window(m.data(), msg.Payload.Time, msg.Payload.Data)
+}
+
+// data returns either the selected shared instrument payloads or the private ones.
+func (m *Handler) data() []message.Payload {
+	if m.instrument == "" {
+		return m.payloads
 	}
 
-	return int32(average(prices))
+	return m.store.Payloads(m.instrument)
 }
 
 func average(data []float64) float64 {
@@ -82,7 +173,22 @@ func average(data []float64) float64 {
 	return avg
 }
 
-func sendResponse(data int32, rw io.ReadWriter) error {
+// respond writes the response (prefixed with the tag once the connection has subscribed).
+func (m *Handler) respond(data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tagged {
+		if _, err := m.w.Write([]byte{message.TypeResponse}); err != nil {
+			return err
+		}
+	}
+
+	if buckets, ok := data.([]message.OHLC); ok {
+		log.Printf("<<< RES %d buckets", len(buckets))
+		return message.WriteOHLC(m.w, buckets)
+	}
+
 	log.Printf("<<< RES %d", data)
-	return binary.Write(rw, binary.BigEndian, data)
+	return binary.Write(m.w, binary.BigEndian, data)
 }
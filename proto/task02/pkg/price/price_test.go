@@ -14,6 +14,7 @@ import (
 	"proto/common/pkg/tcpserver"
 	"proto/task02/pkg/price"
 	"proto/task02/pkg/price/message"
+	"proto/task02/pkg/price/store"
 )
 
 func TestHandle_Handle(t *testing.T) {
@@ -131,3 +132,196 @@ func TestHandle_Handle(t *testing.T) {
 		})
 	}
 }
+
+func TestHandle_Aggregates(t *testing.T) {
+	inserts := []message.Msg{
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 10, Data: 100}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 30, Data: 300}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 20, Data: 50}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 40, Data: 200}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 1000, Data: 1}},
+	}
+
+	tests := []struct {
+		name    string
+		query   message.Request
+		wantOut any
+	}{
+		{
+			name:    "should return min price within the range",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeMin, Payload: message.Payload{Time: 0, Data: 100}}},
+			wantOut: int32(50),
+		},
+		{
+			name:    "should return max price within the range",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeMax, Payload: message.Payload{Time: 0, Data: 100}}},
+			wantOut: int32(300),
+		},
+		{
+			name:    "should return number of prices within the range",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeCount, Payload: message.Payload{Time: 0, Data: 100}}},
+			wantOut: int32(4),
+		},
+		{
+			name:    "should return int64 sum of prices within the range",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeSum, Payload: message.Payload{Time: 0, Data: 2000}}},
+			wantOut: int64(651),
+		},
+		{
+			name:    "should return median of even number of prices",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeMedian, Payload: message.Payload{Time: 0, Data: 100}}},
+			wantOut: int32(150),
+		},
+		{
+			name:    "should return median of odd number of prices",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeMedian, Payload: message.Payload{Time: 0, Data: 2000}}},
+			wantOut: int32(100),
+		},
+		{
+			name: "should return nearest-rank percentile",
+			query: message.Request{
+				Msg: message.Msg{Type: message.TypePercentile, Payload: message.Payload{Time: 0, Data: 100}},
+				Arg: 75,
+			},
+			wantOut: int32(200),
+		},
+		{
+			name: "should return 0 for invalid percentile",
+			query: message.Request{
+				Msg: message.Msg{Type: message.TypePercentile, Payload: message.Payload{Time: 0, Data: 100}},
+				Arg: 101,
+			},
+			wantOut: int32(0),
+		},
+		{
+			name:    "should return 0 for empty range",
+			query:   message.Request{Msg: message.Msg{Type: message.TypeMin, Payload: message.Payload{Time: 100, Data: 0}}},
+			wantOut: int32(0),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+			for _, msg := range inserts {
+				is.NoErr(binary.Write(rec.In, binary.BigEndian, msg))
+			}
+
+			is.NoErr(binary.Write(rec.In, binary.BigEndian, tt.query.Msg))
+			if message.HasArg(tt.query.Type) {
+				is.NoErr(binary.Write(rec.In, binary.BigEndian, tt.query.Arg))
+			}
+
+			(&price.Handler{}).Handle(context.Background(), rec)
+
+			switch want := tt.wantOut.(type) {
+			case int32:
+				var res int32
+				is.NoErr(binary.Read(&rec.Out, binary.BigEndian, &res))
+				is.Equal(want, res)
+
+			case int64:
+				var res int64
+				is.NoErr(binary.Read(&rec.Out, binary.BigEndian, &res))
+				is.Equal(want, res)
+			}
+
+			is.Equal(rec.Out.Len(), 0) // no trailing data
+		})
+	}
+}
+
+func TestHandle_OHLC(t *testing.T) {
+	is := is.New(t)
+
+	rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+	for _, msg := range []message.Msg{
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 15, Data: 12}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 10, Data: 10}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 12, Data: 20}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 13, Data: 5}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 35, Data: 7}},
+		{Type: message.TypeOHLC, Payload: message.Payload{Time: 10, Data: 40}},
+	} {
+		is.NoErr(binary.Write(rec.In, binary.BigEndian, msg))
+	}
+	is.NoErr(binary.Write(rec.In, binary.BigEndian, int32(10))) // bucket width
+
+	(&price.Handler{}).Handle(context.Background(), rec)
+
+	var n uint32
+	is.NoErr(binary.Read(&rec.Out, binary.BigEndian, &n))
+	is.Equal(n, uint32(2))
+
+	buckets := make([]message.OHLC, n)
+	is.NoErr(binary.Read(&rec.Out, binary.BigEndian, buckets))
+	is.Equal(buckets, []message.OHLC{
+		{Start: 10, Open: 10, High: 20, Low: 5, Close: 12},
+		{Start: 30, Open: 7, High: 7, Low: 7, Close: 7},
+	})
+}
+
+func TestHandle_SumWire(t *testing.T) {
+	is := is.New(t)
+
+	rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+	for _, msg := range []message.Msg{
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 1, Data: math.MaxInt32}},
+		{Type: message.TypeInsert, Payload: message.Payload{Time: 2, Data: 42}},
+		{Type: message.TypeSum, Payload: message.Payload{Time: 0, Data: 10}},
+		{Type: message.TypeCount, Payload: message.Payload{Time: 0, Data: 10}},
+	} {
+		is.NoErr(binary.Write(rec.In, binary.BigEndian, msg))
+	}
+
+	(&price.Handler{}).Handle(context.Background(), rec)
+
+	// 8 byte sum followed by the 4 byte count
+	is.Equal(rec.Out.Bytes(), []byte{
+		0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x29,
+		0x00, 0x00, 0x00, 0x02,
+	})
+}
+
+func TestHandle_SharedInstrument(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	st, err := store.Open(ctx, store.Options{})
+	is.NoErr(err)
+
+	// the first connection inserts into the shared instrument
+	rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+	is.NoErr(message.WriteSelect(rec.In, "FOO"))
+	is.NoErr(binary.Write(rec.In, binary.BigEndian, message.Msg{
+		Type: message.TypeInsert, Payload: message.Payload{Time: 1, Data: 100},
+	}))
+	is.NoErr(binary.Write(rec.In, binary.BigEndian, message.Msg{
+		Type: message.TypeInsert, Payload: message.Payload{Time: 2, Data: 200},
+	}))
+	price.New(st).Handle(ctx, rec)
+
+	// the second connection queries it
+	rec = &tcpserver.Recorder{In: &bytes.Buffer{}}
+	is.NoErr(message.WriteSelect(rec.In, "FOO"))
+	is.NoErr(binary.Write(rec.In, binary.BigEndian, message.Msg{
+		Type: message.TypeQuery, Payload: message.Payload{Time: 0, Data: 10},
+	}))
+	price.New(st).Handle(ctx, rec)
+
+	var res int32
+	is.NoErr(binary.Read(&rec.Out, binary.BigEndian, &res))
+	is.Equal(res, int32(150))
+
+	// a connection without selection keeps private payloads
+	rec = &tcpserver.Recorder{In: &bytes.Buffer{}}
+	is.NoErr(binary.Write(rec.In, binary.BigEndian, message.Msg{
+		Type: message.TypeQuery, Payload: message.Payload{Time: 0, Data: 10},
+	}))
+	price.New(st).Handle(ctx, rec)
+
+	is.NoErr(binary.Read(&rec.Out, binary.BigEndian, &res))
+	is.Equal(res, int32(0))
+}
@@ -0,0 +1,190 @@
+package price
+
+import (
+	"log"
+	"math"
+	"sort"
+
+	"proto/task02/pkg/price/message"
+)
+
+// window returns a copy of the payloads within the [from-to] time range sorted by time.
+func window(payloads []message.Payload, from, to int32) []message.Payload {
+	if from > to {
+		log.Printf("Invalid time range [%d-%d]", from, to)
+		return nil
+	}
+
+	res := make([]message.Payload, 0, len(payloads))
+	for _, pl := range payloads {
+		if pl.Time >= from && pl.Time <= to {
+			res = append(res, pl)
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Time < res[j].Time
+	})
+
+	return res
+}
+
+// aggregate calculates a single value statistic of the given query type.
+// Returns false if the type is not a single value query.
+func aggregate(kind byte, data []message.Payload, arg int32) (int64, bool) {
+	switch kind {
+	case message.TypeQuery:
+		return int64(mean(data)), true
+
+	case message.TypeMin:
+		return int64(minimum(data)), true
+
+	case message.TypeMax:
+		return int64(maximum(data)), true
+
+	case message.TypeCount:
+		return int64(len(data)), true
+
+	case message.TypeSum:
+		return sum(data), true
+
+	case message.TypeMedian:
+		return int64(median(data)), true
+
+	case message.TypePercentile:
+		return int64(percentile(data, arg)), true
+	}
+
+	return 0, false
+}
+
+func mean(data []message.Payload) int32 {
+	prices := make([]float64, len(data))
+	for i, pl := range data {
+		prices[i] = float64(pl.Data)
+	}
+
+	return int32(average(prices))
+}
+
+func minimum(data []message.Payload) int32 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	res := data[0].Data
+	for _, pl := range data[1:] {
+		if pl.Data < res {
+			res = pl.Data
+		}
+	}
+
+	return res
+}
+
+func maximum(data []message.Payload) int32 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	res := data[0].Data
+	for _, pl := range data[1:] {
+		if pl.Data > res {
+			res = pl.Data
+		}
+	}
+
+	return res
+}
+
+// sum is returned as int64 since the sum of int32 prices easily overflows int32.
+func sum(data []message.Payload) int64 {
+	var res int64
+	for _, pl := range data {
+		res += int64(pl.Data)
+	}
+
+	return res
+}
+
+func sortedPrices(data []message.Payload) []int32 {
+	prices := make([]int32, len(data))
+	for i, pl := range data {
+		prices[i] = pl.Data
+	}
+
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i] < prices[j]
+	})
+
+	return prices
+}
+
+// median returns the middle price or the mean of the two middle prices for even number of prices.
+func median(data []message.Payload) int32 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	prices := sortedPrices(data)
+	mid := len(prices) / 2
+	if len(prices)%2 == 1 {
+		return prices[mid]
+	}
+
+	return int32((int64(prices[mid-1]) + int64(prices[mid])) / 2)
+}
+
+// percentile returns the p-th percentile of prices using the nearest-rank method.
+// Percentile outside of [0-100] range yields 0.
+func percentile(data []message.Payload, p int32) int32 {
+	if len(data) == 0 || p < 0 || p > 100 {
+		return 0
+	}
+
+	prices := sortedPrices(data)
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(prices))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return prices[rank-1]
+}
+
+// ohlc splits the time sorted data into buckets of the given width starting from the given time.
+// Only non-empty buckets are returned.
+func ohlc(data []message.Payload, from, width int32) []message.OHLC {
+	if width <= 0 {
+		log.Printf("Invalid bucket width %d", width)
+		return nil
+	}
+
+	var buckets []message.OHLC
+	for _, pl := range data {
+		start := from + int32((int64(pl.Time)-int64(from))/int64(width)*int64(width))
+
+		if len(buckets) == 0 || buckets[len(buckets)-1].Start != start {
+			buckets = append(buckets, message.OHLC{
+				Start: start,
+				Open:  pl.Data,
+				High:  pl.Data,
+				Low:   pl.Data,
+				Close: pl.Data,
+			})
+			continue
+		}
+
+		bucket := &buckets[len(buckets)-1]
+		if pl.Data > bucket.High {
+			bucket.High = pl.Data
+		}
+
+		if pl.Data < bucket.Low {
+			bucket.Low = pl.Data
+		}
+
+		bucket.Close = pl.Data
+	}
+
+	return buckets
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"proto/task02/pkg/price/message"
+)
+
+// Options configures the Store.
+type Options struct {
+	Path            string        // append-only log location. Empty path means in-memory store.
+	Retention       int           // max number of points per instrument. 0 means unlimited.
+	CompactInterval time.Duration // how often the log is compacted. 0 disables periodic compaction.
+}
+
+// Store is a process-wide store of named instruments shared by all the connections.
+type Store struct {
+	mu          sync.Mutex
+	opts        Options
+	instruments map[string][]message.Payload // sorted by time
+	log         *os.File
+
+	watchMu  sync.Mutex
+	watchID  int
+	watchers map[string]map[int]chan struct{}
+}
+
+// Open creates a new Store and restores its content from the log (if a path is provided).
+func Open(ctx context.Context, opts Options) (*Store, error) {
+	s := &Store{
+		opts:        opts,
+		instruments: make(map[string][]message.Payload),
+		watchers:    make(map[string]map[int]chan struct{}),
+	}
+
+	if opts.Path == "" {
+		return s, nil
+	}
+
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+
+	// rewrite the log straight away to get rid of evicted points and partially written records.
+	if err := s.Compact(); err != nil {
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		go s.compactLoop(ctx)
+	}
+
+	return s, nil
+}
+
+// Insert adds the payload to the named instrument and appends it to the log.
+// The instrument watchers are notified once the payload is stored.
+func (s *Store) Insert(name string, pl message.Payload) error {
+	s.mu.Lock()
+
+	if s.log != nil {
+		if err := writeRecord(s.log, name, pl); err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("failed to append to log: %w", err)
+		}
+	}
+
+	s.insert(name, pl)
+	s.mu.Unlock()
+
+	s.notify(name)
+
+	return nil
+}
+
+// Watch returns a channel signalled after inserts into the named instrument. The inserting
+// goroutine never waits for the watcher: the channel holds a single pending signal, so several
+// inserts may be coalesced into one. The returned function removes the watcher and closes the
+// channel.
+func (s *Store) Watch(name string) (<-chan struct{}, func()) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+
+	s.watchID++
+	id := s.watchID
+
+	watchers, ok := s.watchers[name]
+	if !ok {
+		watchers = make(map[int]chan struct{})
+		s.watchers[name] = watchers
+	}
+
+	ch := make(chan struct{}, 1)
+	watchers[id] = ch
+
+	return ch, func() {
+		s.watchMu.Lock()
+		defer s.watchMu.Unlock()
+
+		if _, ok := s.watchers[name][id]; !ok {
+			return // already removed
+		}
+
+		delete(s.watchers[name], id)
+		if len(s.watchers[name]) == 0 {
+			delete(s.watchers, name)
+		}
+
+		close(ch)
+	}
+}
+
+func (s *Store) notify(name string) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+
+	for _, ch := range s.watchers[name] {
+		select {
+		case ch <- struct{}{}:
+		default: // a signal is already pending
+		}
+	}
+}
+
+// Payloads returns a copy of the points of the named instrument sorted by time.
+func (s *Store) Payloads(name string) []message.Payload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]message.Payload(nil), s.instruments[name]...)
+}
+
+// Compact rewrites the log with the current content of the store. A failed compaction leaves the
+// log as it was.
+func (s *Store) Compact() error {
+	if s.opts.Path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.opts.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted log: %w", err)
+	}
+
+	discard := func() {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+	}
+
+	w := bufio.NewWriter(f)
+	for name, payloads := range s.instruments {
+		for _, pl := range payloads {
+			if err := writeRecord(w, name, pl); err != nil {
+				discard()
+				return fmt.Errorf("failed to write compacted log: %w", err)
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		discard()
+		return fmt.Errorf("failed to write compacted log: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		discard()
+		return fmt.Errorf("failed to sync compacted log: %w", err)
+	}
+
+	if err := os.Rename(tmp, s.opts.Path); err != nil {
+		discard()
+		return fmt.Errorf("failed to replace log: %w", err)
+	}
+
+	if s.log != nil {
+		_ = s.log.Close()
+	}
+
+	// the renamed file is still open and positioned at its end - keep appending to it.
+	s.log = f
+
+	return syncDir(filepath.Dir(s.opts.Path))
+}
+
+// syncDir makes the rename within the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir) // #nosec G304 -- the directory of the configured log
+	if err != nil {
+		return fmt.Errorf("failed to open log directory: %w", err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log directory: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the log.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+
+	err := s.log.Close()
+	s.log = nil
+
+	return err
+}
+
+func (s *Store) compactLoop(ctx context.Context) {
+	tick := time.NewTicker(s.opts.CompactInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			if err := s.Compact(); err != nil {
+				log.Println("Error compact:", err.Error())
+			}
+		}
+	}
+}
+
+func (s *Store) restore() error {
+	f, err := os.Open(s.opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	r := bufio.NewReader(f)
+	count := 0
+	for {
+		name, pl, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			// most likely a partially written record at the tail of the log.
+			log.Printf("Discarding the rest of the log after %d records: %s", count, err.Error())
+			break
+		}
+
+		s.insert(name, pl)
+		count++
+	}
+
+	log.Printf("Restored %d records for %d instruments", count, len(s.instruments))
+
+	return nil
+}
+
+// insert keeps payloads sorted by time and evicts the oldest points above the retention limit.
+// The caller must hold the lock.
+func (s *Store) insert(name string, pl message.Payload) {
+	payloads := s.instruments[name]
+
+	idx := sort.Search(len(payloads), func(i int) bool {
+		return payloads[i].Time > pl.Time
+	})
+
+	payloads = append(payloads, message.Payload{})
+	copy(payloads[idx+1:], payloads[idx:])
+	payloads[idx] = pl
+
+	if s.opts.Retention > 0 && len(payloads) > s.opts.Retention {
+		payloads = append(payloads[:0], payloads[len(payloads)-s.opts.Retention:]...)
+	}
+
+	s.instruments[name] = payloads
+}
+
+// record format: uint8 name length, name, int32 time, int32 price
+func writeRecord(w io.Writer, name string, pl message.Payload) error {
+	if len(name) > 255 {
+		return errors.New("instrument name is too long")
+	}
+
+	buf := make([]byte, 0, 1+len(name)+8)
+	buf = append(buf, byte(len(name)))
+	buf = append(buf, name...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(pl.Time))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(pl.Data))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRecord(r io.Reader) (string, message.Payload, error) {
+	var pl message.Payload
+
+	var sz [1]byte
+	if _, err := io.ReadFull(r, sz[:]); err != nil {
+		return "", pl, err
+	}
+
+	name := make([]byte, sz[0])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", pl, fmt.Errorf("truncated record: %w", err)
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &pl); err != nil {
+		return "", pl, fmt.Errorf("truncated record: %w", err)
+	}
+
+	return string(name), pl, nil
+}
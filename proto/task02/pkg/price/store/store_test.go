@@ -0,0 +1,133 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"proto/task02/pkg/price/message"
+	"proto/task02/pkg/price/store"
+)
+
+func TestStore_Insert(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention int
+		inserts   []message.Payload
+		want      []message.Payload
+	}{
+		{
+			name: "should keep points sorted by time",
+			inserts: []message.Payload{
+				{Time: 30, Data: 3},
+				{Time: 10, Data: 1},
+				{Time: 20, Data: 2},
+			},
+			want: []message.Payload{
+				{Time: 10, Data: 1},
+				{Time: 20, Data: 2},
+				{Time: 30, Data: 3},
+			},
+		},
+		{
+			name:      "should evict the oldest points above the retention limit",
+			retention: 2,
+			inserts: []message.Payload{
+				{Time: 30, Data: 3},
+				{Time: 10, Data: 1},
+				{Time: 40, Data: 4},
+				{Time: 20, Data: 2},
+			},
+			want: []message.Payload{
+				{Time: 30, Data: 3},
+				{Time: 40, Data: 4},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			st, err := store.Open(context.Background(), store.Options{Retention: tt.retention})
+			is.NoErr(err)
+
+			for _, pl := range tt.inserts {
+				is.NoErr(st.Insert("FOO", pl))
+			}
+
+			is.Equal(st.Payloads("FOO"), tt.want)
+			is.Equal(len(st.Payloads("BAR")), 0)
+		})
+	}
+}
+
+func TestStore_Restore(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "prices.log")
+
+	st, err := store.Open(ctx, store.Options{Path: path, Retention: 3})
+	is.NoErr(err)
+
+	for i := int32(1); i <= 5; i++ {
+		is.NoErr(st.Insert("FOO", message.Payload{Time: i, Data: i * 10}))
+	}
+	is.NoErr(st.Insert("BAR", message.Payload{Time: 1, Data: 42}))
+	is.NoErr(st.Close())
+
+	// simulate a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	is.NoErr(err)
+	_, err = f.Write([]byte{0x03, 'B', 'A'})
+	is.NoErr(err)
+	is.NoErr(f.Close())
+
+	st, err = store.Open(ctx, store.Options{Path: path, Retention: 3})
+	is.NoErr(err)
+
+	is.Equal(st.Payloads("FOO"), []message.Payload{
+		{Time: 3, Data: 30},
+		{Time: 4, Data: 40},
+		{Time: 5, Data: 50},
+	})
+	is.Equal(st.Payloads("BAR"), []message.Payload{{Time: 1, Data: 42}})
+
+	// compaction on open drops evicted points and the broken tail: 4 records of 1+3+8 bytes.
+	info, err := os.Stat(path)
+	is.NoErr(err)
+	is.Equal(info.Size(), int64(4*12))
+
+	// the compacted log is still appendable
+	is.NoErr(st.Insert("BAR", message.Payload{Time: 2, Data: 43}))
+	is.NoErr(st.Close())
+
+	st, err = store.Open(ctx, store.Options{Path: path})
+	is.NoErr(err)
+	is.Equal(len(st.Payloads("BAR")), 2)
+	is.NoErr(st.Close())
+}
+
+func TestStore_CompactFailure(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "prices.log")
+	st, err := store.Open(context.Background(), store.Options{Path: path})
+	is.NoErr(err)
+	defer func() {
+		_ = st.Close()
+	}()
+	is.NoErr(st.Insert("FOO", message.Payload{Time: 1, Data: 100}))
+
+	// the log can't be replaced by a file anymore
+	is.NoErr(os.Remove(path))
+	is.NoErr(os.MkdirAll(filepath.Join(path, "dir"), 0o750))
+
+	is.True(st.Compact() != nil)
+
+	_, err = os.Stat(path + ".tmp")
+	is.True(os.IsNotExist(err)) // no half-written compaction left behind
+}
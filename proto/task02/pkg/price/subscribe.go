@@ -0,0 +1,200 @@
+package price
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+
+	"proto/task02/pkg/price/message"
+)
+
+// MaxSubscriptions is the maximum number of active subscriptions per connection.
+var MaxSubscriptions = 16
+
+// subscribe/unsubscribe response statuses
+const (
+	statusOK       int32 = 0
+	statusRejected int32 = -1
+)
+
+type subscription struct {
+	message.Subscribe
+	last   int64
+	pushed bool
+}
+
+// window returns the subscribed window of the data.
+func (s *subscription) window(data []message.Payload) []message.Payload {
+	if !s.Rolling {
+		return window(data, s.From, s.To)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	latest := data[0].Time
+	for _, pl := range data[1:] {
+		if pl.Time > latest {
+			latest = pl.Time
+		}
+	}
+
+	from := int64(latest) - int64(s.From) + 1
+	if from < math.MinInt32 {
+		from = math.MinInt32
+	}
+
+	return window(data, int32(from), latest)
+}
+
+func (m *Handler) subscribe(sub message.Subscribe) error {
+	if err := m.validateSubscription(sub); err != nil {
+		log.Printf("Rejecting subscription %d: %s", sub.ID, err.Error())
+		return m.respond(statusRejected)
+	}
+
+	m.mu.Lock()
+	m.tagged = true
+	if m.subs == nil {
+		m.subs = make(map[uint32]*subscription)
+	}
+	m.subs[sub.ID] = &subscription{Subscribe: sub}
+	m.mu.Unlock()
+
+	if err := m.respond(statusOK); err != nil {
+		return err
+	}
+
+	m.rebindSubscriptions()
+
+	// push the initial value
+	return m.refresh(m.instrument, m.data())
+}
+
+func (m *Handler) validateSubscription(sub message.Subscribe) error {
+	if _, ok := aggregate(sub.Stat, nil, sub.Arg); !ok {
+		return errors.New("unsupported statistic")
+	}
+
+	if sub.Rolling && sub.From <= 0 {
+		return errors.New("invalid rolling window width")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.subs[sub.ID]; ok {
+		return errors.New("duplicate subscription id")
+	}
+
+	if len(m.subs) >= MaxSubscriptions {
+		return errors.New("too many subscriptions")
+	}
+
+	return nil
+}
+
+func (m *Handler) unsubscribe(id uint32) error {
+	m.mu.Lock()
+	_, ok := m.subs[id]
+	delete(m.subs, id)
+	empty := len(m.subs) == 0
+	m.mu.Unlock()
+
+	if !ok {
+		return m.respond(statusRejected)
+	}
+
+	if empty {
+		m.stopWatching()
+	}
+
+	return m.respond(statusOK)
+}
+
+// rebindSubscriptions makes sure the subscriptions follow the currently selected instrument.
+func (m *Handler) rebindSubscriptions() {
+	m.mu.Lock()
+	name, active := m.watching, len(m.subs) > 0
+	m.mu.Unlock()
+
+	if !active || (name == m.instrument && (name == "" || m.unwatch != nil)) {
+		return
+	}
+
+	m.stopWatching()
+
+	m.mu.Lock()
+	m.watching = m.instrument
+	for _, sub := range m.subs {
+		sub.pushed = false
+	}
+	m.mu.Unlock()
+
+	if m.instrument == "" {
+		return
+	}
+
+	name = m.instrument
+	changed, unwatch := m.store.Watch(name)
+	done := make(chan struct{})
+
+	// the updates are computed and written here, so a slow connection doesn't hold the inserts
+	go func() {
+		defer close(done)
+
+		for range changed {
+			if err := m.refresh(name, m.store.Payloads(name)); err != nil {
+				log.Println("Error refresh:", err.Error())
+				return
+			}
+		}
+	}()
+
+	m.unwatch = func() {
+		unwatch()
+		<-done
+	}
+}
+
+// stopWatching stops the watcher and waits for the pending refresh.
+func (m *Handler) stopWatching() {
+	if m.unwatch != nil {
+		m.unwatch()
+		m.unwatch = nil
+	}
+}
+
+// refresh recalculates the subscriptions bound to the named instrument ("" for the private
+// payloads) and pushes the values that have changed.
+func (m *Handler) refresh(name string, data []message.Payload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if name != m.watching {
+		return nil // stale notification after the instrument has been switched
+	}
+
+	for _, sub := range m.subs {
+		value, _ := aggregate(sub.Stat, sub.window(data), sub.Arg)
+		if sub.pushed && value == sub.last {
+			continue
+		}
+
+		sub.last, sub.pushed = value, true
+
+		log.Printf("<<< UPD %d %d", sub.ID, value)
+		if _, err := m.w.Write([]byte{message.TypeUpdate}); err != nil {
+			return err
+		}
+
+		update := message.Update{ID: sub.ID, Value: value}
+		if err := binary.Write(m.w, binary.BigEndian, update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
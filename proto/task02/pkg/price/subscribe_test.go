@@ -0,0 +1,228 @@
+package price_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/common/pkg/tcpserver"
+	"proto/task02/pkg/price"
+	"proto/task02/pkg/price/message"
+	"proto/task02/pkg/price/store"
+)
+
+func readResponse(is *is.I, r io.Reader) int32 {
+	var tag [1]byte
+	_, err := io.ReadFull(r, tag[:])
+	is.NoErr(err)
+	is.Equal(tag[0], message.TypeResponse)
+
+	var res int32
+	is.NoErr(binary.Read(r, binary.BigEndian, &res))
+
+	return res
+}
+
+func readUpdate(is *is.I, r io.Reader) message.Update {
+	var tag [1]byte
+	_, err := io.ReadFull(r, tag[:])
+	is.NoErr(err)
+	is.Equal(tag[0], message.TypeUpdate)
+
+	var upd message.Update
+	is.NoErr(binary.Read(r, binary.BigEndian, &upd))
+
+	return upd
+}
+
+func insert(is *is.I, w io.Writer, tm, data int32) {
+	is.NoErr(binary.Write(w, binary.BigEndian, message.Msg{
+		Type:    message.TypeInsert,
+		Payload: message.Payload{Time: tm, Data: data},
+	}))
+}
+
+func TestHandle_Subscribe(t *testing.T) {
+	is := is.New(t)
+
+	rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+	is.NoErr(message.WriteSubscribe(rec.In, message.Subscribe{
+		ID: 1, Stat: message.TypeCount, From: 0, To: 100,
+	}))
+	is.NoErr(message.WriteSubscribe(rec.In, message.Subscribe{
+		ID: 2, Stat: message.TypeMax, Rolling: true, From: 10,
+	}))
+	is.NoErr(message.WriteSubscribe(rec.In, message.Subscribe{
+		ID: 2, Stat: message.TypeMin, From: 0, To: 100,
+	}))
+	insert(is, rec.In, 10, 100)
+	insert(is, rec.In, 200, 50) // outside the fixed window and drops the first point from the rolling one
+	is.NoErr(message.WriteUnsubscribe(rec.In, 1))
+	insert(is, rec.In, 50, 10)
+	is.NoErr(binary.Write(rec.In, binary.BigEndian, message.Msg{
+		Type:    message.TypeQuery,
+		Payload: message.Payload{Time: 0, Data: 100},
+	}))
+	is.NoErr(message.WriteUnsubscribe(rec.In, 42))
+
+	(&price.Handler{}).Handle(context.Background(), rec)
+
+	// subscription 1
+	is.Equal(readResponse(is, &rec.Out), int32(0))
+	is.Equal(readUpdate(is, &rec.Out), message.Update{ID: 1, Value: 0})
+
+	// subscription 2
+	is.Equal(readResponse(is, &rec.Out), int32(0))
+	is.Equal(readUpdate(is, &rec.Out), message.Update{ID: 2, Value: 0})
+
+	// duplicate subscription ID
+	is.Equal(readResponse(is, &rec.Out), int32(-1))
+
+	// insert 10 100
+	upd1, upd2 := readUpdate(is, &rec.Out), readUpdate(is, &rec.Out)
+	if upd1.ID == 2 {
+		upd1, upd2 = upd2, upd1
+	}
+	is.Equal(upd1, message.Update{ID: 1, Value: 1})
+	is.Equal(upd2, message.Update{ID: 2, Value: 100})
+
+	// insert 200 50 - only the rolling window changes
+	is.Equal(readUpdate(is, &rec.Out), message.Update{ID: 2, Value: 50})
+
+	// unsubscribe 1
+	is.Equal(readResponse(is, &rec.Out), int32(0))
+
+	// insert 50 10 does not change anything - query and unsubscribe of unknown ID follow
+	is.Equal(readResponse(is, &rec.Out), int32(55))
+	is.Equal(readResponse(is, &rec.Out), int32(-1))
+	is.Equal(rec.Out.Len(), 0)
+}
+
+func TestHandle_SubscribeLimit(t *testing.T) {
+	is := is.New(t)
+
+	limit := price.MaxSubscriptions
+	price.MaxSubscriptions = 1
+	defer func() {
+		price.MaxSubscriptions = limit
+	}()
+
+	rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+	is.NoErr(message.WriteSubscribe(rec.In, message.Subscribe{ID: 1, Stat: message.TypeQuery}))
+	is.NoErr(message.WriteSubscribe(rec.In, message.Subscribe{ID: 2, Stat: message.TypeQuery}))
+	is.NoErr(message.WriteSubscribe(rec.In, message.Subscribe{ID: 3, Stat: message.TypeOHLC}))
+
+	(&price.Handler{}).Handle(context.Background(), rec)
+
+	is.Equal(readResponse(is, &rec.Out), int32(0))
+	is.Equal(readUpdate(is, &rec.Out), message.Update{ID: 1, Value: 0})
+	is.Equal(readResponse(is, &rec.Out), int32(-1))
+	is.Equal(readResponse(is, &rec.Out), int32(-1))
+}
+
+func TestHandle_SubscribeShared(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	st, err := store.Open(ctx, store.Options{})
+	is.NoErr(err)
+
+	server, client := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		price.New(st).Handle(ctx, server)
+	}()
+
+	is.NoErr(message.WriteSelect(client, "FOO"))
+	is.NoErr(message.WriteSubscribe(client, message.Subscribe{
+		ID: 7, Stat: message.TypeSum, From: 0, To: 100,
+	}))
+	is.Equal(readResponse(is, client), int32(0))
+	is.Equal(readUpdate(is, client), message.Update{ID: 7, Value: 0})
+
+	// another connection inserts into the shared instrument
+	go func() {
+		rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+		_ = message.WriteSelect(rec.In, "FOO")
+		_ = binary.Write(rec.In, binary.BigEndian, message.Msg{
+			Type:    message.TypeInsert,
+			Payload: message.Payload{Time: 1, Data: 1 << 30},
+		})
+		_ = binary.Write(rec.In, binary.BigEndian, message.Msg{
+			Type:    message.TypeInsert,
+			Payload: message.Payload{Time: 2, Data: 1 << 30},
+		})
+		price.New(st).Handle(ctx, rec)
+	}()
+
+	// the inserts may be coalesced into a single update
+	upd := readUpdate(is, client)
+	if upd.Value == 1<<30 {
+		upd = readUpdate(is, client)
+	}
+	is.Equal(upd, message.Update{ID: 7, Value: 1 << 31})
+
+	_ = client.Close()
+	<-done
+}
+
+func TestHandle_SubscribeStalled(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	st, err := store.Open(ctx, store.Options{})
+	is.NoErr(err)
+
+	server, client := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+
+	go price.New(st).Handle(ctx, server)
+
+	is.NoErr(message.WriteSelect(client, "FOO"))
+	is.NoErr(message.WriteSubscribe(client, message.Subscribe{
+		ID: 7, Stat: message.TypeCount, From: 0, To: 1000,
+	}))
+	is.Equal(readResponse(is, client), int32(0))
+	is.Equal(readUpdate(is, client), message.Update{ID: 7, Value: 0})
+
+	// the subscriber stops reading, the inserts go on
+	inserted := make(chan struct{})
+	go func() {
+		defer close(inserted)
+
+		rec := &tcpserver.Recorder{In: &bytes.Buffer{}}
+		_ = message.WriteSelect(rec.In, "FOO")
+		for i := int32(0); i < 100; i++ {
+			_ = binary.Write(rec.In, binary.BigEndian, message.Msg{
+				Type:    message.TypeInsert,
+				Payload: message.Payload{Time: i, Data: i},
+			})
+		}
+		price.New(st).Handle(ctx, rec)
+	}()
+
+	select {
+	case <-inserted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("inserts blocked by the stalled subscriber")
+	}
+
+	// the subscriber catches up with the latest value
+	upd := readUpdate(is, client)
+	for upd.Value != 100 {
+		upd = readUpdate(is, client)
+	}
+}
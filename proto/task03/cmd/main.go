@@ -2,26 +2,191 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"proto/common/pkg/tcpserver"
 	"proto/task03/pkg/chat"
 	"proto/task03/pkg/chat/broker"
+	"proto/task03/pkg/chat/irc"
+	"proto/task03/pkg/chat/transcript"
+	"proto/task03/pkg/chat/web"
 )
 
 const tcpPort = 8080
 
 // Task03 - Budget Chat - https://protohackers.com/problem/3
+//
+// Optional environment variables:
+//
+//	QUEUE_SIZE           - outbound queue length per client (default 64)
+//	SLOW_POLICY          - what to do with the slow clients: drop (default) or disconnect
+//	HISTORY_SIZE         - recent messages replayed on join (disabled by default)
+//	TRANSCRIPT_PATH      - transcript file location (disabled if empty)
+//	TRANSCRIPT_MAX_SIZE  - transcript rotation size in bytes (default 10MiB)
+//	TRANSCRIPT_MAX_FILES - number of rotated transcript files to keep (default 5)
+//	OPERATORS            - comma separated name@ip or name@cidr with the operator role in every room
+//	BANS_PATH            - persistent ban list location (in-memory if empty)
+//	BANNED_WORDS         - comma separated words to filter out of the messages
+//	FILTER_MODE          - what to do with the banned words: reject (default) or mask
+//	FLOOD_MESSAGES       - max messages per FLOOD_INTERVAL per user (disabled by default)
+//	FLOOD_INTERVAL       - flood protection interval (default 10s)
+//	IDLE_TIMEOUT         - disconnect users inactive for longer, eg. 30m (disabled by default)
+//	AUTO_AWAY            - mark users inactive for longer as away, eg. 5m (disabled by default)
+//	IRC_PORT             - port of the IRC front-end sharing the rooms (disabled if empty)
+//	WEB_PORT             - port of the browser front-end (disabled if empty)
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	broker := broker.New()
+	opts := options()
+	if opts.Transcript != nil {
+		defer func() {
+			_ = opts.Transcript.Close()
+		}()
+	}
+
+	broker := broker.New(opts)
+
+	if port := envInt("IRC_PORT"); port > 0 {
+		go func() {
+			err := tcpserver.Listen(ctx, port, func(ctx context.Context, conn net.Conn) {
+				irc.NewSession(broker, conn.RemoteAddr()).Handle(ctx, conn)
+			})
+			if err != nil {
+				log.Println("Error: [Listen IRC]:", err.Error())
+			}
+		}()
+	}
+
+	if port := envInt("WEB_PORT"); port > 0 {
+		go func() {
+			log.Printf("Listening on: %d (web)\n", port)
+			srv := &http.Server{
+				Addr:              fmt.Sprintf(":%d", port),
+				Handler:           web.NewHandler(ctx, broker),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			err := srv.ListenAndServe()
+			if err != nil {
+				log.Println("Error: [Listen web]:", err.Error())
+			}
+		}()
+	}
+
 	err := tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
-		chat.NewSession(broker).Handle(ctx, conn)
+		chat.NewSession(broker, conn.RemoteAddr()).Handle(ctx, conn)
 	})
 	if err != nil {
 		log.Println("Error: [Listen]:", err.Error())
 	}
 }
+
+func options() broker.Options {
+	opts := broker.Options{
+		QueueSize:     envInt("QUEUE_SIZE"),
+		HistorySize:   envInt("HISTORY_SIZE"),
+		BannedWords:   envList("BANNED_WORDS"),
+		FloodMessages: envInt("FLOOD_MESSAGES"),
+		FloodInterval: 10 * time.Second,
+		IdleTimeout:   envDuration("IDLE_TIMEOUT"),
+		AutoAway:      envDuration("AUTO_AWAY"),
+	}
+
+	for _, v := range envList("OPERATORS") {
+		op, err := broker.ParseOperator(v)
+		if err != nil {
+			log.Fatalln("Error: invalid OPERATORS:", err.Error())
+		}
+		opts.Operators = append(opts.Operators, op)
+	}
+
+	if v := os.Getenv("FILTER_MODE"); v != "" {
+		mode, err := broker.ParseFilterMode(v)
+		if err != nil {
+			log.Fatalln("Error: invalid FILTER_MODE:", err.Error())
+		}
+		opts.Filter = mode
+	}
+
+	if v := os.Getenv("FLOOD_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalln("Error: invalid FLOOD_INTERVAL:", err.Error())
+		}
+		opts.FloodInterval = interval
+	}
+
+	bans, err := broker.LoadBans(os.Getenv("BANS_PATH"))
+	if err != nil {
+		log.Fatalln("Error: [Bans]:", err.Error())
+	}
+	opts.Bans = bans
+
+	if v := os.Getenv("SLOW_POLICY"); v != "" {
+		policy, err := broker.ParsePolicy(v)
+		if err != nil {
+			log.Fatalln("Error: invalid SLOW_POLICY:", err.Error())
+		}
+		opts.Policy = policy
+	}
+
+	if path := os.Getenv("TRANSCRIPT_PATH"); path != "" {
+		tr, err := transcript.Open(path, transcript.Options{
+			MaxSize:  int64(envInt("TRANSCRIPT_MAX_SIZE")),
+			MaxFiles: envInt("TRANSCRIPT_MAX_FILES"),
+		})
+		if err != nil {
+			log.Fatalln("Error: [Transcript]:", err.Error())
+		}
+		opts.Transcript = tr
+	}
+
+	return opts
+}
+
+// envList returns the comma separated values of the environment variable.
+func envList(name string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+
+	return strings.Split(v, ",")
+}
+
+// envDuration returns the duration value of the environment variable or 0 if it is not set.
+func envDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Error: invalid %s: %s", name, err.Error())
+	}
+
+	return d
+}
+
+// envInt returns the integer value of the environment variable or 0 if it is not set.
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Error: invalid %s: %s", name, err.Error())
+	}
+
+	return n
+}
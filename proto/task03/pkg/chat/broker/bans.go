@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Bans is a persistent list of banned names and IP addresses.
+// The file contains one ban per line: "name <name>" or "ip <address>".
+type Bans struct {
+	mu    sync.Mutex
+	path  string
+	names map[string]struct{}
+	ips   map[string]struct{}
+}
+
+// LoadBans loads the ban list from the file. The file is created on the first ban.
+// Empty path means in-memory only ban list.
+func LoadBans(path string) (*Bans, error) {
+	bans := &Bans{
+		path:  path,
+		names: make(map[string]struct{}),
+		ips:   make(map[string]struct{}),
+	}
+
+	if path == "" {
+		return bans, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bans, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open bans: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kind, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		switch kind {
+		case "name":
+			bans.names[value] = struct{}{}
+
+		case "ip":
+			bans.ips[value] = struct{}{}
+		}
+	}
+
+	return bans, scanner.Err()
+}
+
+// IsBanned returns true if either the name or the IP address is banned.
+func (b *Bans) IsBanned(name, ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, byName := b.names[name]
+	_, byIP := b.ips[ip]
+
+	return byName || (ip != "" && byIP)
+}
+
+// Add bans the name or IP address (detected automatically) and persists the list.
+func (b *Bans) Add(target string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if net.ParseIP(target) != nil {
+		b.ips[target] = struct{}{}
+	} else {
+		b.names[target] = struct{}{}
+	}
+
+	return b.save()
+}
+
+// Remove lifts the ban of the name or IP address and persists the list.
+func (b *Bans) Remove(target string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, byName := b.names[target]
+	_, byIP := b.ips[target]
+	if !byName && !byIP {
+		return errors.New("not banned")
+	}
+
+	delete(b.names, target)
+	delete(b.ips, target)
+
+	return b.save()
+}
+
+// save atomically rewrites the ban list file. The caller must hold the lock.
+func (b *Bans) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	lines := make([]string, 0, len(b.names)+len(b.ips))
+	for name := range b.names {
+		lines = append(lines, "name "+name)
+	}
+
+	for ip := range b.ips {
+		lines = append(lines, "ip "+ip)
+	}
+	sort.Strings(lines)
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to save bans: %w", err)
+	}
+
+	if err := os.Rename(tmp, b.path); err != nil {
+		return fmt.Errorf("failed to save bans: %w", err)
+	}
+
+	return nil
+}
@@ -5,66 +5,651 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"strings"
+	"net"
+	"regexp"
+	"sort"
 	"sync"
+	"time"
+
+	"proto/task03/pkg/chat/transcript"
+)
+
+// DefaultRoom is the room every client joins on registration.
+const DefaultRoom = "#general"
+
+// DefaultQueueSize is the default length of the client's outbound queue.
+const DefaultQueueSize = 64
+
+// noticeTimeout limits how long the slow client disconnection notice may take to write.
+const noticeTimeout = time.Second
+
+// Policy defines what happens when the client's outbound queue is full.
+type Policy int
+
+// Full queue policies
+const (
+	PolicyDrop       Policy = iota // drop the message for the slow client
+	PolicyDisconnect               // disconnect the slow client with a notice
 )
 
+// ParsePolicy parses the policy name (drop or disconnect).
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "drop":
+		return PolicyDrop, nil
+
+	case "disconnect":
+		return PolicyDisconnect, nil
+	}
+
+	return PolicyDrop, fmt.Errorf("unknown policy: %s", name)
+}
+
+// Options configures the Broker.
+type Options struct {
+	QueueSize   int    // outbound queue length per client - DefaultQueueSize if 0.
+	Policy      Policy // full queue policy
+	HistorySize int    // recent messages kept per room and replayed on join - disabled if 0.
+
+	// Transcript records all the room events if set.
+	Transcript *transcript.Transcript
+
+	// Moderation
+	Operators     []Operator    // operator role in every room for the name from its network
+	Bans          *Bans         // persistent ban list - in-memory if nil
+	BannedWords   []string      // words rejected or masked in the messages
+	Filter        FilterMode    // what to do with the messages containing banned words
+	FloodMessages int           // max messages per FloodInterval per client - disabled if 0
+	FloodInterval time.Duration // flood protection interval
+
+	// Presence (enforced by the sessions)
+	IdleTimeout time.Duration // disconnect the clients inactive for longer - disabled if 0
+	AutoAway    time.Duration // mark the clients inactive for longer as away - disabled if 0
+}
+
+// Errors
+var (
+	ErrNotRegistered = errors.New("client is not registered")
+	ErrNotInRoom     = errors.New("you are not in the room")
+	ErrNoRoom        = errors.New("you are not in any room")
+	ErrDefaultRoom   = errors.New("you cannot leave the default room")
+	ErrNoTranscript  = errors.New("transcript is not enabled")
+	ErrNoSuchUser    = errors.New("no such user")
+	ErrNameTaken     = errors.New("the name is already taken")
+	ErrNotOperator   = errors.New("you are not an operator")
+	ErrMuted         = errors.New("you are muted")
+	ErrFlood         = errors.New("you are sending messages too fast")
+	ErrFiltered      = errors.New("the message contains banned words")
+	ErrBanned        = errors.New("you are banned")
+	ErrReserved      = errors.New("the name is reserved")
+)
+
+// RoomInfo is a short room summary.
+type RoomInfo struct {
+	Name    string
+	Members int
+}
+
+type delivery struct {
+	c *client
+	e Event
+}
+
 // Broker is a message broker for the chat
 type Broker struct {
 	sync.Mutex
-	clients map[string]io.Writer
+	opts    Options
+	clients map[string]*client
+	rooms   map[string]*roomState
+	history map[string]*history
+	filter  *regexp.Regexp // nil if there are no banned words
 }
 
 // New creates a new Broker instance.
-func New() *Broker {
-	return &Broker{clients: make(map[string]io.Writer)}
+func New(opts Options) *Broker {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+
+	if opts.Bans == nil {
+		opts.Bans, _ = LoadBans("") // in-memory list never fails
+	}
+
+	return &Broker{
+		opts:    opts,
+		clients: make(map[string]*client),
+		rooms:   make(map[string]*roomState),
+		history: make(map[string]*history),
+		filter:  newWordFilter(opts.BannedWords),
+	}
+}
+
+// Options returns the broker options.
+func (b *Broker) Options() Options {
+	return b.opts
 }
 
-// Register a new connection to the broker.
+// Register a new connection to the broker and join it to the default room.
+// From now on the broker is the only writer to w until the client is unregistered.
 func (b *Broker) Register(id string, w io.Writer) error {
+	return b.RegisterFrom(id, "", w)
+}
+
+// RegisterFrom registers a new connection from the remote address (host:port or just host)
+// rejecting the banned names and IP addresses.
+func (b *Broker) RegisterFrom(id, addr string, w io.Writer) error {
+	return b.RegisterWith(id, addr, w, FormatText)
+}
+
+// RegisterWith registers a new connection rendering the events with the formatter. It is used by
+// the front-ends speaking other protocols than the budgetchat one.
+func (b *Broker) RegisterWith(id, addr string, w io.Writer, format Formatter) error {
+	ip := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = host
+	}
+
+	if b.opts.Bans.IsBanned(id, ip) {
+		return ErrBanned
+	}
+
+	if b.reserved(id, ip) {
+		return ErrReserved
+	}
+
+	b.Lock()
 	if _, ok := b.clients[id]; ok {
-		return errors.New("client with the same name is already registered")
+		b.Unlock()
+		return ErrNameTaken
+	}
+
+	c := newClient(id, ip, w, format, b.opts)
+	b.clients[id] = c
+	b.Unlock()
+
+	go c.run()
+
+	return b.Join(id, DefaultRoom)
+}
+
+// Join adds the client to the room and makes it the current one.
+func (b *Broker) Join(id, room string) error {
+	b.Lock()
+	c, ok := b.clients[id]
+	if !ok {
+		b.Unlock()
+		return ErrNotRegistered
+	}
+
+	r, ok := b.rooms[room]
+	if !ok {
+		r = newRoomState()
+		b.rooms[room] = r
+	}
+
+	if _, ok := r.members[id]; ok {
+		c.current = room
+		b.Unlock()
+		b.Notify(id, fmt.Sprintf("* you are now talking in %s", room))
+		return nil
+	}
+
+	if len(r.members) == 0 {
+		r.ops[c] = struct{}{} // the first one in the room is the operator
+	}
+
+	r.members[id] = c
+	c.rooms = append(c.rooms, room)
+	c.current = room
+
+	e := Event{Kind: EventJoin, Room: room, From: id}
+	out := b.prepare(room, "", e)
+	out = append(out, delivery{
+		c: c,
+		e: Event{Kind: EventNames, Room: room, Names: b.names(room, id)},
+	})
+
+	if h, ok := b.history[room]; ok {
+		for _, entry := range h.last(b.opts.HistorySize) {
+			out = append(out, delivery{c: c, e: Event{Kind: EventNotice, Text: FormatEntry(entry, false)}})
+		}
 	}
 
+	deliver(out)
+	b.Unlock()
+
+	b.transcribe(room, e.String())
+
+	return nil
+}
+
+// Part removes the client from the room (the current one if room is empty). The most recently
+// joined of the remaining rooms becomes the current one.
+func (b *Broker) Part(id, room string) error {
 	b.Lock()
-	b.clients[id] = w
+	c, ok := b.clients[id]
+	if !ok {
+		b.Unlock()
+		return ErrNotRegistered
+	}
+
+	if room == "" {
+		room = c.current
+	}
+
+	if room == DefaultRoom {
+		b.Unlock()
+		return ErrDefaultRoom
+	}
+
+	if !b.inRoom(id, room) {
+		b.Unlock()
+		return ErrNotInRoom
+	}
+
+	out, part := b.leave(c, room, "")
+	deliver(out)
 	b.Unlock()
 
-	b.broadcast(id, fmt.Sprintf("* %s has entered the room\n", id))
-	fmt.Fprintf(w, "* the room contains: %s\n", strings.Join(b.getNames(id), ", "))
+	b.transcribe(room, part.String())
+
+	return nil
+}
+
+// Sends broadcasts the message to all the connections in the client's current room.
+func (b *Broker) Send(id string, message string) error {
+	return b.broadcast(id, "", message, EventMessage)
+}
+
+// SendTo broadcasts the message to the room the client is in without changing the current room.
+func (b *Broker) SendTo(id, room, message string) error {
+	return b.broadcast(id, room, message, EventMessage)
+}
+
+// Action broadcasts the emote (eg. "* alice waves") to the client's current room.
+func (b *Broker) Action(id string, action string) error {
+	return b.broadcast(id, "", action, EventAction)
+}
+
+// ActionTo broadcasts the emote to the room the client is in without changing the current room.
+func (b *Broker) ActionTo(id, room, action string) error {
+	return b.broadcast(id, room, action, EventAction)
+}
+
+// Private sends a direct message to the recipient only.
+func (b *Broker) Private(from, to, message string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	sender, ok := b.clients[from]
+	if !ok {
+		return ErrNotRegistered
+	}
+
+	c, ok := b.clients[to]
+	if !ok {
+		return ErrNoSuchUser
+	}
+
+	message, err := b.moderate(sender, "", message)
+	if err != nil {
+		return err
+	}
+
+	c.send(Event{Kind: EventPrivate, From: from, To: to, Text: message})
 
 	return nil
 }
 
-// Sends broadcasts the message to all attached connections.
-func (b *Broker) Send(id string, message string) {
-	b.broadcast(id, fmt.Sprintf("[%s] %s\n", id, message))
+// Rename atomically renames the client and notifies all the rooms the client is in. The banned
+// names and the names reserved for the operators connecting from elsewhere are refused.
+func (b *Broker) Rename(id, newID string) error {
+	b.Lock()
+	c, ok := b.clients[id]
+	if !ok {
+		b.Unlock()
+		return ErrNotRegistered
+	}
+
+	if _, ok := b.clients[newID]; ok {
+		b.Unlock()
+		return ErrNameTaken
+	}
+
+	// a banned client can't come back under another name and take the banned one
+	if b.opts.Bans.IsBanned(newID, c.ip) {
+		b.Unlock()
+		return ErrBanned
+	}
+
+	if b.reserved(newID, c.ip) {
+		b.Unlock()
+		return ErrReserved
+	}
+
+	delete(b.clients, id)
+	b.clients[newID] = c
+	c.rename(newID)
+
+	e := Event{Kind: EventNick, From: id, To: newID}
+
+	var out []delivery
+	for _, room := range c.rooms {
+		delete(b.rooms[room].members, id)
+		b.rooms[room].members[newID] = c
+
+		e.Room = room
+		out = append(out, b.prepare(room, "", e)...)
+	}
+
+	for i := range out {
+		out[i].e.Self = out[i].c == c
+	}
+
+	deliver(out)
+	rooms := append([]string(nil), c.rooms...)
+	b.Unlock()
+
+	for _, room := range rooms {
+		b.transcribe(room, e.String())
+	}
+
+	return nil
+}
+
+// broadcast sends the message event of the client to the room (the current one if room is empty)
+// recording it in the history.
+func (b *Broker) broadcast(id, room, message string, kind EventKind) error {
+	b.Lock()
+	c, ok := b.clients[id]
+	if !ok {
+		b.Unlock()
+		return ErrNotRegistered
+	}
+
+	if room == "" {
+		room = c.current
+	}
+
+	if room == "" {
+		b.Unlock()
+		return ErrNoRoom
+	}
+
+	if !b.inRoom(id, room) {
+		b.Unlock()
+		return ErrNotInRoom
+	}
+
+	message, err := b.moderate(c, room, message)
+	if err != nil {
+		b.Unlock()
+		return err
+	}
+
+	e := Event{Kind: kind, Room: room, From: id, Text: message}
+	out := b.prepare(room, id, e)
+	deliver(out)
+	b.remember(room, e.String())
+	b.Unlock()
+
+	b.transcribe(room, e.String())
+
+	return nil
+}
+
+// History returns up to n recent messages of the room - from the transcript if enabled.
+func (b *Broker) History(room string, n int) ([]transcript.Entry, error) {
+	if b.opts.Transcript != nil {
+		return b.opts.Transcript.Last(room, n)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	h, ok := b.history[room]
+	if !ok {
+		return nil, nil
+	}
+
+	return h.last(n), nil
+}
+
+// Search searches the room transcript for the term.
+func (b *Broker) Search(room, term string, limit int) ([]transcript.Entry, error) {
+	if b.opts.Transcript == nil {
+		return nil, ErrNoTranscript
+	}
+
+	return b.opts.Transcript.Search(room, term, limit)
+}
+
+// FormatEntry formats a history entry as a notice line with the time (and date if needed).
+func FormatEntry(e transcript.Entry, withDate bool) string {
+	layout := "15:04:05"
+	if withDate {
+		layout = "2006-01-02 15:04:05"
+	}
+
+	return fmt.Sprintf("* %s %s", e.Time.Local().Format(layout), e.Text)
+}
+
+// remember adds the message to the room history. The caller must hold the lock.
+func (b *Broker) remember(room, text string) {
+	if b.opts.HistorySize <= 0 {
+		return
+	}
+
+	h, ok := b.history[room]
+	if !ok {
+		h = newHistory(b.opts.HistorySize)
+		b.history[room] = h
+	}
+
+	h.add(transcript.Entry{Time: time.Now(), Room: room, Text: text})
+}
+
+// transcribe appends the room event to the transcript (if enabled).
+func (b *Broker) transcribe(room, text string) {
+	if b.opts.Transcript == nil {
+		return
+	}
+
+	e := transcript.Entry{Time: time.Now(), Room: room, Text: text}
+	if err := b.opts.Transcript.Append(e); err != nil {
+		log.Println("Error transcript:", err.Error())
+	}
+}
+
+// transcribeAll appends the room events to the transcript (if enabled).
+func (b *Broker) transcribeAll(events []Event) {
+	for _, e := range events {
+		b.transcribe(e.Room, e.String())
+	}
+}
+
+// Notify sends a notice to the client only.
+func (b *Broker) Notify(id string, text string) {
+	b.notify(id, Event{Kind: EventNotice, Text: text})
+}
+
+// Reply sends a front-end specific reply to the client only. Unlike the notices, the text is
+// written as is (eg. IRC numeric replies including the line terminator).
+func (b *Broker) Reply(id string, text string) {
+	b.notify(id, Event{Kind: EventReply, Text: text})
+}
+
+func (b *Broker) notify(id string, e Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	if c, ok := b.clients[id]; ok {
+		c.send(e)
+	}
 }
 
 // Unregister the connection from the broker.
 func (b *Broker) Unregister(id string) {
+	b.Quit(id, "")
+}
+
+// Quit unregisters the connection notifying the rooms with the optional reason.
+func (b *Broker) Quit(id, reason string) {
 	b.Lock()
-	delete(b.clients, id)
+	c, ok := b.clients[id]
+	if !ok {
+		b.Unlock()
+		return
+	}
+
+	out, parts := b.remove(c, reason)
+	deliver(out)
 	b.Unlock()
 
-	b.broadcast(id, fmt.Sprintf("* %s has left the room\n", id))
+	b.transcribeAll(parts)
+	c.stop()
 }
 
-func (b *Broker) broadcast(id string, message string) {
-	for k, w := range b.clients {
-		if k == id {
-			continue
+// Disconnect unregisters the client notifying the rooms with the reason. The notice is written to
+// the client before its connection is closed, which terminates the session's read loop.
+func (b *Broker) Disconnect(id, reason, notice string) {
+	b.Lock()
+	c, ok := b.clients[id]
+	if !ok {
+		b.Unlock()
+		return
+	}
+
+	out, parts := b.remove(c, reason)
+	deliver(out)
+	c.close(notice)
+	b.Unlock()
+
+	b.transcribeAll(parts)
+}
+
+// remove removes the client from all the rooms and the broker. It returns the notifications and
+// the part events to transcribe once the lock is released. The caller must hold the lock.
+func (b *Broker) remove(c *client, reason string) ([]delivery, []Event) {
+	var out []delivery
+	var parts []Event
+	for len(c.rooms) > 0 {
+		d, part := b.leave(c, c.rooms[len(c.rooms)-1], reason)
+		out = append(out, d...)
+		parts = append(parts, part)
+	}
+
+	delete(b.clients, c.id)
+
+	return out, parts
+}
+
+// Current returns the client's current room.
+func (b *Broker) Current(id string) string {
+	b.Lock()
+	defer b.Unlock()
+
+	if c, ok := b.clients[id]; ok {
+		return c.current
+	}
+
+	return ""
+}
+
+// Rooms returns the list of all rooms sorted by name.
+func (b *Broker) Rooms() []RoomInfo {
+	b.Lock()
+	defer b.Unlock()
+
+	rooms := make([]RoomInfo, 0, len(b.rooms))
+	for name, r := range b.rooms {
+		rooms = append(rooms, RoomInfo{Name: name, Members: len(r.members)})
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+
+	return rooms
+}
+
+// Members returns the sorted names of the room members.
+func (b *Broker) Members(room string) []string {
+	b.Lock()
+	defer b.Unlock()
+
+	names := b.names(room, "")
+	sort.Strings(names)
+
+	return names
+}
+
+// leave removes the client from the room and returns the notifications and the part event to
+// transcribe once the lock is released. The caller must hold the lock.
+func (b *Broker) leave(c *client, room, reason string) ([]delivery, Event) {
+	r := b.rooms[room]
+	delete(r.members, c.id)
+	delete(r.ops, c)
+	if len(r.members) == 0 && room != DefaultRoom {
+		delete(b.rooms, room)
+		delete(b.history, room)
+	}
+
+	for i, r := range c.rooms {
+		if r == room {
+			c.rooms = append(c.rooms[:i], c.rooms[i+1:]...)
+			break
+		}
+	}
+
+	if c.current == room {
+		c.current = ""
+		if len(c.rooms) > 0 {
+			c.current = c.rooms[len(c.rooms)-1]
 		}
+	}
+
+	e := Event{Kind: EventPart, Room: room, From: c.id, Text: reason}
+
+	self := e
+	self.Self, self.Other = true, c.current != room
 
-		if _, err := fmt.Fprint(w, message); err != nil {
-			log.Printf("Could not notify %s session", k)
+	return append(b.prepare(room, c.id, e), delivery{c: c, e: self}), e
+}
+
+// prepare builds the deliveries of the event to all the room members except the given one.
+// The caller must hold the lock.
+func (b *Broker) prepare(room, exclude string, e Event) []delivery {
+	r, ok := b.rooms[room]
+	if !ok {
+		return nil
+	}
+
+	out := make([]delivery, 0, len(r.members))
+	for k, c := range r.members {
+		if k == exclude {
+			continue
 		}
+
+		d := delivery{c: c, e: e}
+		d.e.Self = k == e.From
+		d.e.Other = c.current != room
+
+		out = append(out, d)
 	}
+
+	return out
 }
 
-func (b *Broker) getNames(exclude string) []string {
+// names returns the room members except the given one. The caller must hold the lock.
+func (b *Broker) names(room, exclude string) []string {
+	r, ok := b.rooms[room]
+	if !ok {
+		return nil
+	}
+
 	var names []string
-	for k := range b.clients {
+	for k := range r.members {
 		if k == exclude {
 			continue
 		}
@@ -74,3 +659,11 @@ func (b *Broker) getNames(exclude string) []string {
 
 	return names
 }
+
+// deliver enqueues the events to the clients' outbound queues. It never blocks, so it is called
+// with the lock held to keep the order of the messages consistent across the clients.
+func deliver(out []delivery) {
+	for _, d := range out {
+		d.c.send(d.e)
+	}
+}
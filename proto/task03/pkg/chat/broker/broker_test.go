@@ -0,0 +1,296 @@
+package broker_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat/broker"
+)
+
+// sink is a thread-safe client connection mock.
+type sink struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+	block  chan struct{} // if not nil, writes block until it's closed or the sink is closed
+	closeC chan struct{}
+}
+
+func newSink() *sink {
+	return &sink{closeC: make(chan struct{})}
+}
+
+func (s *sink) Write(p []byte) (int, error) {
+	if s.block != nil {
+		select {
+		case <-s.block:
+		case <-s.closeC:
+			return 0, errors.New("closed")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errors.New("closed")
+	}
+
+	return s.buf.Write(p)
+}
+
+func (s *sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.closeC)
+	}
+
+	return nil
+}
+
+func (s *sink) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// next waits for n lines and consumes them.
+func (s *sink) next(t *testing.T, n int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		if strings.Count(s.buf.String(), "\n") >= n {
+			out := make([]string, n)
+			for i := range out {
+				line, _ := s.buf.ReadString('\n')
+				out[i] = strings.TrimSuffix(line, "\n")
+			}
+			s.mu.Unlock()
+			return out
+		}
+		got := s.buf.String()
+		s.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d lines, got: %q", n, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// nothing asserts that the client has not received anything so far.
+func (s *sink) nothing(t *testing.T, b *broker.Broker, id string) {
+	t.Helper()
+
+	b.Notify(id, "--mark--")
+	if got := s.next(t, 1); got[0] != "--mark--" {
+		t.Fatalf("unexpected line: %q", got[0])
+	}
+}
+
+func TestBroker_Rooms(t *testing.T) {
+	is := is.New(t)
+
+	alice, bob := newSink(), newSink()
+	b := broker.New(broker.Options{})
+
+	is.NoErr(b.Register("alice", alice))
+	is.Equal(alice.next(t, 1), []string{"* the room contains: "})
+	is.NoErr(b.Register("bob", bob))
+	is.True(b.Register("bob", bob) != nil) // duplicate name
+
+	is.Equal(alice.next(t, 1), []string{"* bob has entered the room"})
+	is.Equal(bob.next(t, 1), []string{"* the room contains: alice"})
+
+	// bob joins #dev and talks there
+	is.NoErr(b.Join("bob", "#dev"))
+	is.NoErr(b.Send("bob", "hello dev"))
+	alice.nothing(t, b, "alice")
+	is.Equal(bob.next(t, 1), []string{"* the room contains: "})
+
+	// alice joins #dev - bob sees it in his current room
+	is.NoErr(b.Join("alice", "#dev"))
+	is.Equal(bob.next(t, 1), []string{"* alice has entered the room"})
+	is.Equal(alice.next(t, 1), []string{"* the room contains: bob"})
+
+	is.Equal(b.Members("#dev"), []string{"alice", "bob"})
+	is.Equal(b.Rooms(), []broker.RoomInfo{{Name: "#dev", Members: 2}, {Name: "#general", Members: 2}})
+
+	// alice parts #dev and returns to #general; bob is notified about #dev
+	is.NoErr(b.Part("alice", ""))
+	is.Equal(b.Current("alice"), broker.DefaultRoom)
+	is.Equal(bob.next(t, 1), []string{"* alice has left the room"})
+
+	// messages in #general reach bob prefixed with the room name since he's talking in #dev
+	is.NoErr(b.Send("alice", "hi all"))
+	is.Equal(bob.next(t, 1), []string{"#general [alice] hi all"})
+
+	is.Equal(b.Part("alice", ""), broker.ErrDefaultRoom)
+	is.Equal(b.Part("alice", "#dev"), broker.ErrNotInRoom)
+
+	// bob leaves - alice only hears about the rooms she is in
+	b.Unregister("bob")
+	is.Equal(alice.next(t, 1), []string{"* bob has left the room"})
+	is.Equal(b.Rooms(), []broker.RoomInfo{{Name: "#general", Members: 1}})
+	alice.nothing(t, b, "alice")
+}
+
+func TestBroker_ConcurrentClients(t *testing.T) {
+	const (
+		nClients  = 20
+		nMessages = 50
+	)
+
+	b := broker.New(broker.Options{QueueSize: 4 * nClients * nMessages})
+
+	sinks := make([]*sink, nClients)
+	for i := range sinks {
+		sinks[i] = newSink()
+		if err := b.Register(fmt.Sprintf("user%d", i), sinks[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// everybody registered - wait until all entries are delivered
+	for i, s := range sinks {
+		s.next(t, nClients-i) // the room contains + (nClients - i - 1) entries
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < nClients; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for j := 0; j < nMessages; j++ {
+				_ = b.Send(id, fmt.Sprintf("message %d", j))
+				_ = b.Members(broker.DefaultRoom)
+				_ = b.Rooms()
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+
+	// registry churn in parallel with the broadcasts
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < nMessages; j++ {
+			_ = b.Register("churn", newSink())
+			b.Unregister("churn")
+		}
+	}()
+
+	wg.Wait()
+
+	for i, s := range sinks {
+		got := s.next(t, (nClients-1)*nMessages+2*nMessages) // messages + churn entries/leaves
+		count := 0
+		for _, line := range got {
+			if strings.Contains(line, "] message ") {
+				count++
+			}
+		}
+
+		if count != (nClients-1)*nMessages {
+			t.Fatalf("user%d: got %d messages", i, count)
+		}
+	}
+}
+
+func TestBroker_SlowClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     broker.Policy
+		wantClosed bool
+	}{
+		{
+			name:   "should drop messages for the slow client",
+			policy: broker.PolicyDrop,
+		},
+		{
+			name:       "should disconnect the slow client",
+			policy:     broker.PolicyDisconnect,
+			wantClosed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			b := broker.New(broker.Options{QueueSize: 2, Policy: tt.policy})
+
+			fast, slow := newSink(), newSink()
+			slow.block = make(chan struct{})
+			defer close(slow.block)
+
+			is.NoErr(b.Register("slow", slow))
+			is.NoErr(b.Register("fast", fast))
+			fast.next(t, 1)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					is.NoErr(b.Send("fast", fmt.Sprintf("message %d", i)))
+				}
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the sender got stuck on the slow client")
+			}
+
+			if tt.wantClosed {
+				deadline := time.Now().Add(2 * time.Second)
+				for !slow.isClosed() && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+
+			is.Equal(slow.isClosed(), tt.wantClosed)
+		})
+	}
+}
+
+func TestBroker_HistoryReplay(t *testing.T) {
+	is := is.New(t)
+
+	b := broker.New(broker.Options{HistorySize: 2})
+
+	alice := newSink()
+	is.NoErr(b.Register("alice", alice))
+	alice.next(t, 1)
+
+	for i := 0; i < 3; i++ {
+		is.NoErr(b.Send("alice", fmt.Sprintf("message %d", i)))
+	}
+
+	bob := newSink()
+	is.NoErr(b.Register("bob", bob))
+
+	got := bob.next(t, 3)
+	is.Equal(got[0], "* the room contains: alice")
+	is.True(strings.HasSuffix(got[1], " [alice] message 1"))
+	is.True(strings.HasSuffix(got[2], " [alice] message 2"))
+
+	entries, err := b.History(broker.DefaultRoom, 10)
+	is.NoErr(err)
+	is.Equal(len(entries), 2)
+
+	_, err = b.Search(broker.DefaultRoom, "message", 10)
+	is.Equal(err, broker.ErrNoTranscript)
+}
@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// client is a registered connection with a bounded outbound queue drained by its own writer
+// goroutine, so that a slow connection never stalls the senders.
+type client struct {
+	id      string
+	ip      string // remote IP address (if known)
+	w       io.Writer
+	format  Formatter
+	rooms   []string // joined rooms in the join order (guarded by the broker lock)
+	current string   // the room messages are sent to (guarded by the broker lock)
+
+	away        bool // presence (guarded by the broker lock)
+	awayMessage string
+
+	floodStart time.Time // flood protection window (guarded by the broker lock)
+	floodCount int
+	closing    bool // close the connection once the queue is flushed - set before stop
+
+	policy   Policy
+	queue    chan Event
+	done     chan struct{} // closed on unregister
+	kicked   chan struct{} // closed when disconnected for being too slow
+	doneOnce sync.Once
+	kickOnce sync.Once
+	dropped  int
+	mu       sync.Mutex // guards dropped and id changes (id is also guarded by the broker lock)
+}
+
+func newClient(id, ip string, w io.Writer, format Formatter, opts Options) *client {
+	return &client{
+		id:     id,
+		ip:     ip,
+		w:      w,
+		format: format,
+		policy: opts.Policy,
+		queue:  make(chan Event, opts.QueueSize),
+		done:   make(chan struct{}),
+		kicked: make(chan struct{}),
+	}
+}
+
+// name returns the client id safe to use outside of the broker lock.
+func (c *client) name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.id
+}
+
+// rename changes the client id. The caller must hold the broker lock.
+func (c *client) rename(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id = id
+}
+
+// send enqueues the event applying the full queue policy if needed. It never blocks.
+func (c *client) send(e Event) {
+	select {
+	case <-c.done:
+		return
+
+	case c.queue <- e:
+		return
+
+	default:
+	}
+
+	switch c.policy {
+	case PolicyDisconnect:
+		c.kick()
+
+	default:
+		c.mu.Lock()
+		c.dropped++
+		id, dropped := c.id, c.dropped
+		c.mu.Unlock()
+
+		if dropped == 1 || dropped%100 == 0 {
+			log.Printf("%s is too slow - dropped %d messages so far", id, dropped)
+		}
+	}
+}
+
+// stop stops the writer goroutine once the already queued events are written.
+func (c *client) stop() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// close sends the notice and closes the connection once the queue is flushed.
+func (c *client) close(notice string) {
+	c.send(Event{Kind: EventNotice, Text: notice})
+
+	c.doneOnce.Do(func() {
+		c.closing = true
+		close(c.done)
+	})
+}
+
+// kick disconnects the slow client. If the connection supports write deadlines, the pending write
+// (if any) and the notice are given noticeTimeout to complete. Otherwise the connection is closed
+// straight away to unblock the writer.
+func (c *client) kick() {
+	c.kickOnce.Do(func() {
+		log.Printf("%s is too slow - disconnecting", c.name())
+
+		if dw, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			_ = dw.SetWriteDeadline(time.Now().Add(noticeTimeout))
+		} else if closer, ok := c.w.(io.Closer); ok {
+			_ = closer.Close()
+		}
+
+		close(c.kicked)
+	})
+}
+
+// run is the writer goroutine draining the outbound queue.
+func (c *client) run() {
+	for {
+		select {
+		case <-c.kicked:
+			c.disconnect()
+			return
+
+		default:
+		}
+
+		select {
+		case <-c.kicked:
+			c.disconnect()
+			return
+
+		case <-c.done:
+			c.flush()
+			if closer, ok := c.w.(io.Closer); ok && c.closing {
+				_ = closer.Close()
+			}
+			return
+
+		case e := <-c.queue:
+			if err := c.write(e); err != nil {
+				log.Printf("Could not notify %s session: %s", c.name(), err.Error())
+				c.kick()
+			}
+		}
+	}
+}
+
+func (c *client) write(e Event) error {
+	data := c.format(e)
+	if data == "" {
+		return nil
+	}
+
+	_, err := io.WriteString(c.w, data)
+	return err
+}
+
+// flush writes the events left in the queue without blocking for more.
+func (c *client) flush() {
+	for {
+		select {
+		case e := <-c.queue:
+			if err := c.write(e); err != nil {
+				return
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// disconnect writes the notice (best effort) and closes the connection, which terminates the
+// session's read loop and unregisters the client.
+func (c *client) disconnect() {
+	_ = c.write(Event{Kind: EventNotice, Text: "* you are too slow - disconnecting"})
+
+	if closer, ok := c.w.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EventKind is the kind of the chat event.
+type EventKind int
+
+// Event kinds
+const (
+	EventNotice  EventKind = iota // server notice Text (room-wide if Room is set)
+	EventReply                    // front-end specific reply Text written as is
+	EventMessage                  // Text sent by From to the Room
+	EventAction                   // emote Text of From in the Room
+	EventPrivate                  // direct message Text sent by From to To
+	EventJoin                     // From has joined the Room
+	EventPart                     // From has left the Room with the optional reason Text
+	EventNames                    // Names of the other Room members sent on join
+	EventNick                     // From is now known as To
+	EventAway                     // From is away with the optional message Text
+	EventBack                     // From is back
+)
+
+// Event is a chat event delivered to the clients. Each front-end renders the events in its own
+// protocol with a Formatter.
+type Event struct {
+	Kind  EventKind
+	Room  string
+	From  string
+	To    string
+	Text  string
+	Names []string
+	Self  bool // the event is about the recipient itself
+	Other bool // the Room is not the recipient's current room
+}
+
+// Formatter renders the event as the data written to the client connection.
+// Events rendered as an empty string are skipped.
+type Formatter func(e Event) string
+
+// FormatText renders the event as a budgetchat text line. Members talking in a different room get
+// the line prefixed with the room name. The clients are not told about their own joins and parts.
+func FormatText(e Event) string {
+	if e.Self && (e.Kind == EventJoin || e.Kind == EventPart) {
+		return ""
+	}
+
+	text := e.String()
+	if e.Other && e.Room != "" {
+		text = e.Room + " " + text
+	}
+
+	return text + "\n"
+}
+
+// String returns the budgetchat text of the event as recorded in the history and the transcript.
+func (e Event) String() string {
+	switch e.Kind {
+	case EventMessage:
+		return fmt.Sprintf("[%s] %s", e.From, e.Text)
+
+	case EventAction:
+		return fmt.Sprintf("* %s %s", e.From, e.Text)
+
+	case EventPrivate:
+		return fmt.Sprintf("[%s -> %s] %s", e.From, e.To, e.Text)
+
+	case EventJoin:
+		return fmt.Sprintf("* %s has entered the room", e.From)
+
+	case EventPart:
+		if e.Text != "" {
+			return fmt.Sprintf("* %s has left the room (%s)", e.From, e.Text)
+		}
+		return fmt.Sprintf("* %s has left the room", e.From)
+
+	case EventNames:
+		return fmt.Sprintf("* the room contains: %s", strings.Join(e.Names, ", "))
+
+	case EventNick:
+		return fmt.Sprintf("* %s is now known as %s", e.From, e.To)
+
+	case EventAway:
+		if e.Text != "" {
+			return fmt.Sprintf("* %s is away (%s)", e.From, e.Text)
+		}
+		return fmt.Sprintf("* %s is away", e.From)
+
+	case EventBack:
+		return fmt.Sprintf("* %s is back", e.From)
+	}
+
+	return e.Text
+}
@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"proto/task03/pkg/chat/transcript"
+)
+
+// history is a bounded ring buffer of the recent room messages.
+type history struct {
+	entries []transcript.Entry
+	start   int
+	size    int
+}
+
+func newHistory(n int) *history {
+	return &history{entries: make([]transcript.Entry, n)}
+}
+
+func (h *history) add(e transcript.Entry) {
+	if len(h.entries) == 0 {
+		return
+	}
+
+	h.entries[(h.start+h.size)%len(h.entries)] = e
+	if h.size < len(h.entries) {
+		h.size++
+	} else {
+		h.start = (h.start + 1) % len(h.entries)
+	}
+}
+
+// last returns up to n most recent entries from the oldest to the newest.
+func (h *history) last(n int) []transcript.Entry {
+	if n > h.size {
+		n = h.size
+	}
+
+	res := make([]transcript.Entry, 0, n)
+	for i := h.size - n; i < h.size; i++ {
+		res = append(res, h.entries[(h.start+i)%len(h.entries)])
+	}
+
+	return res
+}
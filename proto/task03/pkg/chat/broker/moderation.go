@@ -0,0 +1,315 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FilterMode defines what happens to the messages containing banned words.
+type FilterMode int
+
+// Filter modes
+const (
+	FilterReject FilterMode = iota // reject the message
+	FilterMask                     // replace the banned words with asterisks
+)
+
+// ParseFilterMode parses the filter mode name (reject or mask).
+func ParseFilterMode(name string) (FilterMode, error) {
+	switch name {
+	case "reject":
+		return FilterReject, nil
+
+	case "mask":
+		return FilterMask, nil
+	}
+
+	return FilterReject, fmt.Errorf("unknown filter mode: %s", name)
+}
+
+// Operator is a name with the operator role in every room. The role is granted only to the
+// clients connecting from the network and nobody else can take the name.
+type Operator struct {
+	Name    string
+	Network *net.IPNet
+}
+
+// ParseOperator parses the operator given as name@ip or name@cidr, eg. root@10.0.0.1 or
+// root@10.0.0.0/24.
+func ParseOperator(s string) (Operator, error) {
+	name, addr, ok := strings.Cut(s, "@")
+	if !ok || name == "" || addr == "" {
+		return Operator{}, fmt.Errorf("invalid operator %q: expected name@ip or name@cidr", s)
+	}
+
+	if !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return Operator{}, fmt.Errorf("invalid operator %q: bad address", s)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		addr = fmt.Sprintf("%s/%d", addr, bits)
+	}
+
+	_, network, err := net.ParseCIDR(addr)
+	if err != nil {
+		return Operator{}, fmt.Errorf("invalid operator %q: %w", s, err)
+	}
+
+	return Operator{Name: name, Network: network}, nil
+}
+
+// allows returns true if the client's IP address belongs to the operator's network.
+func (o Operator) allows(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && o.Network.Contains(addr)
+}
+
+// reserved returns true if the name belongs to a configured operator and the IP address is not
+// one of theirs.
+func (b *Broker) reserved(name, ip string) bool {
+	found := false
+	for _, op := range b.opts.Operators {
+		if op.Name != name {
+			continue
+		}
+
+		if op.allows(ip) {
+			return false
+		}
+		found = true
+	}
+
+	return found
+}
+
+// newWordFilter builds a case insensitive whole word matcher or returns nil if there are no words.
+func newWordFilter(words []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+
+	if len(quoted) == 0 {
+		return nil
+	}
+
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// moderate applies mute, flood protection and the word filter to the client's message in the room
+// (empty room for the private messages). Returns the (possibly masked) message.
+// The caller must hold the lock.
+func (b *Broker) moderate(c *client, room, message string) (string, error) {
+	now := time.Now()
+
+	if r, ok := b.rooms[room]; ok {
+		for _, key := range []string{c.id, c.ip} {
+			until, ok := r.muted[key]
+			if !ok {
+				continue
+			}
+
+			if now.Before(until) {
+				return "", fmt.Errorf("%w for %s", ErrMuted, until.Sub(now).Round(time.Second))
+			}
+			delete(r.muted, key)
+		}
+	}
+
+	if b.opts.FloodMessages > 0 {
+		if now.Sub(c.floodStart) > b.opts.FloodInterval {
+			c.floodStart, c.floodCount = now, 0
+		}
+
+		c.floodCount++
+		if c.floodCount > b.opts.FloodMessages {
+			return "", ErrFlood
+		}
+	}
+
+	if b.filter != nil && b.filter.MatchString(message) {
+		if b.opts.Filter == FilterReject {
+			return "", ErrFiltered
+		}
+
+		message = b.filter.ReplaceAllStringFunc(message, func(word string) string {
+			return strings.Repeat("*", len(word))
+		})
+	}
+
+	return message, nil
+}
+
+// IsOperator returns true if the client is an operator of the room.
+func (b *Broker) IsOperator(id, room string) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.clients[id]
+	return ok && b.isOperator(c, room)
+}
+
+// isOperator returns true if the client is a configured operator or the room operator.
+// The caller must hold the lock.
+func (b *Broker) isOperator(c *client, room string) bool {
+	for _, op := range b.opts.Operators {
+		if op.Name == c.id && op.allows(c.ip) {
+			return true
+		}
+	}
+
+	r, ok := b.rooms[room]
+	if !ok {
+		return false
+	}
+
+	_, ok = r.ops[c]
+	return ok
+}
+
+// operatorTarget checks that the operator and the target are in the operator's current room
+// and returns them along with the room. The caller must hold the lock.
+func (b *Broker) operatorTarget(op, target string) (*client, *client, string, error) {
+	oc, ok := b.clients[op]
+	if !ok {
+		return nil, nil, "", ErrNotRegistered
+	}
+
+	room := oc.current
+	if !b.isOperator(oc, room) {
+		return nil, nil, "", ErrNotOperator
+	}
+
+	tc, ok := b.clients[target]
+	if !ok || !b.inRoom(target, room) {
+		return nil, nil, "", ErrNoSuchUser
+	}
+
+	return oc, tc, room, nil
+}
+
+// Kick removes the target from the operator's current room. Since the default room cannot be
+// left, kicking from the default room disconnects the target.
+func (b *Broker) Kick(op, target, reason string) error {
+	b.Lock()
+	_, tc, room, err := b.operatorTarget(op, target)
+	if err != nil {
+		b.Unlock()
+		return err
+	}
+
+	why := "kicked by " + op
+	if reason != "" {
+		why += ": " + reason
+	}
+
+	var out []delivery
+	var parts []Event
+	if room == DefaultRoom {
+		out, parts = b.remove(tc, why)
+		tc.close(fmt.Sprintf("* you have been %s", why))
+	} else {
+		var part Event
+		out, part = b.leave(tc, room, why)
+		parts = []Event{part}
+		tc.send(Event{Kind: EventNotice, Text: fmt.Sprintf("* you have been %s from %s", why, room)})
+	}
+
+	deliver(out)
+	b.Unlock()
+
+	b.transcribeAll(parts)
+
+	return nil
+}
+
+// Mute prevents the target from talking in the operator's current room for the duration.
+// Non-positive duration lifts the mute.
+func (b *Broker) Mute(op, target string, d time.Duration) error {
+	b.Lock()
+	_, tc, room, err := b.operatorTarget(op, target)
+	if err != nil {
+		b.Unlock()
+		return err
+	}
+
+	text := fmt.Sprintf("* %s has been unmuted by %s", target, op)
+	if d > 0 {
+		b.rooms[room].mute(tc, time.Now().Add(d))
+		text = fmt.Sprintf("* %s has been muted for %s by %s", target, d, op)
+	} else {
+		b.rooms[room].unmute(tc)
+	}
+
+	deliver(b.prepare(room, "", Event{Kind: EventNotice, Room: room, Text: text}))
+	b.Unlock()
+
+	b.transcribe(room, text)
+
+	return nil
+}
+
+// Ban bans the name or IP address and disconnects the matching clients. Only the operators of
+// the default room can ban.
+func (b *Broker) Ban(op, target string) error {
+	parts, err := b.ban(op, target)
+	b.transcribeAll(parts)
+
+	return err
+}
+
+// ban adds the ban and disconnects the matching clients under the lock. It returns the part
+// events to transcribe.
+func (b *Broker) ban(op, target string) ([]Event, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	oc, ok := b.clients[op]
+	if !ok {
+		return nil, ErrNotRegistered
+	}
+
+	if !b.isOperator(oc, DefaultRoom) {
+		return nil, ErrNotOperator
+	}
+
+	if target == op || target == oc.ip {
+		return nil, fmt.Errorf("you cannot ban yourself")
+	}
+
+	if err := b.opts.Bans.Add(target); err != nil {
+		return nil, err
+	}
+
+	why := "banned by " + op
+	var parts []Event
+	for _, c := range b.clients {
+		if c.id == target || c.ip == target {
+			out, p := b.remove(c, why)
+			deliver(out)
+			parts = append(parts, p...)
+			c.close(fmt.Sprintf("* you have been %s", why))
+		}
+	}
+
+	return parts, nil
+}
+
+// Unban lifts the ban of the name or IP address.
+func (b *Broker) Unban(op, target string) error {
+	if !b.IsOperator(op, DefaultRoom) {
+		return ErrNotOperator
+	}
+
+	return b.opts.Bans.Remove(target)
+}
@@ -0,0 +1,249 @@
+package broker_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat/broker"
+)
+
+func waitClosed(t *testing.T, s *sink) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection has not been closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBroker_KickMute(t *testing.T) {
+	is := is.New(t)
+
+	b := broker.New(broker.Options{})
+	alice, bob := newSink(), newSink()
+
+	is.NoErr(b.Register("alice", alice)) // the first one in the room
+	is.NoErr(b.Register("bob", bob))
+	alice.next(t, 2)
+	bob.next(t, 1)
+
+	is.True(b.IsOperator("alice", broker.DefaultRoom))
+	is.True(!b.IsOperator("bob", broker.DefaultRoom))
+	is.Equal(b.Kick("bob", "alice", ""), broker.ErrNotOperator)
+
+	// bob creates #dev and becomes its operator
+	is.NoErr(b.Join("bob", "#dev"))
+	is.NoErr(b.Join("alice", "#dev"))
+	bob.next(t, 2)
+	alice.next(t, 1)
+	is.True(b.IsOperator("bob", "#dev"))
+
+	// mute alice in #dev
+	is.NoErr(b.Mute("bob", "alice", time.Minute))
+	is.Equal(bob.next(t, 1), []string{"* alice has been muted for 1m0s by bob"})
+	is.Equal(alice.next(t, 1), []string{"* alice has been muted for 1m0s by bob"})
+	is.True(errors.Is(b.Send("alice", "hi"), broker.ErrMuted))
+
+	is.NoErr(b.Mute("bob", "alice", 0))
+	alice.next(t, 1)
+	bob.next(t, 1)
+	is.NoErr(b.Send("alice", "hi"))
+	is.Equal(bob.next(t, 1), []string{"[alice] hi"})
+
+	// kick alice from #dev - she stays connected
+	is.NoErr(b.Kick("bob", "alice", "spam"))
+	is.Equal(bob.next(t, 1), []string{"* alice has left the room (kicked by bob: spam)"})
+	is.Equal(alice.next(t, 1), []string{"* you have been kicked by bob: spam from #dev"})
+	is.Equal(b.Current("alice"), broker.DefaultRoom)
+	is.True(!alice.isClosed())
+
+	// kick bob from the default room - he gets disconnected
+	is.NoErr(b.Kick("alice", "bob", ""))
+	is.Equal(bob.next(t, 1), []string{"* you have been kicked by alice"})
+	waitClosed(t, bob)
+	is.Equal(b.Members(broker.DefaultRoom), []string{"alice"})
+}
+
+func TestBroker_MuteReconnect(t *testing.T) {
+	is := is.New(t)
+
+	b := broker.New(broker.Options{})
+	is.NoErr(b.RegisterFrom("bob", "10.0.0.1:1234", newSink())) // the first one in the room
+	is.NoErr(b.RegisterFrom("alice", "10.0.0.2:1234", newSink()))
+	is.NoErr(b.Mute("bob", "alice", time.Minute))
+
+	// under the same name
+	b.Quit("alice", "")
+	is.NoErr(b.RegisterFrom("alice", "10.0.0.3:1234", newSink()))
+	is.True(errors.Is(b.Send("alice", "hi"), broker.ErrMuted))
+
+	// from the same IP address
+	b.Quit("alice", "")
+	is.NoErr(b.RegisterFrom("alice2", "10.0.0.2:4321", newSink()))
+	is.True(errors.Is(b.Send("alice2", "hi"), broker.ErrMuted))
+	is.NoErr(b.Rename("alice2", "carol"))
+	is.True(errors.Is(b.Send("carol", "hi"), broker.ErrMuted))
+
+	// lifting the mute of carol clears her name and IP address only
+	is.NoErr(b.RegisterFrom("alice", "10.0.0.3:1234", newSink()))
+	is.NoErr(b.Mute("bob", "carol", 0))
+	is.NoErr(b.Send("carol", "hi"))
+	is.True(errors.Is(b.Send("alice", "hi"), broker.ErrMuted))
+
+	is.NoErr(b.Mute("bob", "alice", 0))
+	is.NoErr(b.Send("alice", "hi"))
+}
+
+func TestBroker_FloodAndFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    broker.Options
+		sends   []string
+		want    []string
+		wantErr error
+	}{
+		{
+			name:    "should reject the messages above the flood limit",
+			opts:    broker.Options{FloodMessages: 2, FloodInterval: time.Minute},
+			sends:   []string{"one", "two", "three"},
+			want:    []string{"[alice] one", "[alice] two"},
+			wantErr: broker.ErrFlood,
+		},
+		{
+			name:    "should reject the messages with banned words",
+			opts:    broker.Options{BannedWords: []string{"darn"}},
+			sends:   []string{"fine", "DARN it"},
+			want:    []string{"[alice] fine"},
+			wantErr: broker.ErrFiltered,
+		},
+		{
+			name:  "should mask the banned words",
+			opts:  broker.Options{BannedWords: []string{"darn", "heck"}, Filter: broker.FilterMask},
+			sends: []string{"Darn it, what the heck, darned"},
+			want:  []string{"[alice] **** it, what the ****, darned"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			b := broker.New(tt.opts)
+			alice, bob := newSink(), newSink()
+			is.NoErr(b.Register("alice", alice))
+			is.NoErr(b.Register("bob", bob))
+			bob.next(t, 1)
+
+			var err error
+			for _, msg := range tt.sends {
+				if e := b.Send("alice", msg); e != nil {
+					err = e
+				}
+			}
+
+			is.Equal(err, tt.wantErr)
+			is.Equal(bob.next(t, len(tt.want)), tt.want)
+			bob.nothing(t, b, "bob")
+		})
+	}
+}
+
+func TestBroker_Ban(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "bans")
+	bans, err := broker.LoadBans(path)
+	is.NoErr(err)
+
+	operator, err := broker.ParseOperator("root@10.0.0.2")
+	is.NoErr(err)
+
+	b := broker.New(broker.Options{Bans: bans, Operators: []broker.Operator{operator}})
+	root, mallory, eve := newSink(), newSink(), newSink()
+	is.NoErr(b.RegisterFrom("mallory", "10.0.0.1:1234", mallory))
+	is.NoErr(b.RegisterFrom("root", "10.0.0.2:1234", root))
+	is.NoErr(b.RegisterFrom("eve", "10.0.0.3:1234", eve))
+
+	is.Equal(b.Ban("eve", "10.0.0.1"), broker.ErrNotOperator) // not the first in the room anymore
+	is.NoErr(b.Ban("root", "10.0.0.1"))
+	waitClosed(t, mallory)
+	is.NoErr(b.Ban("root", "eve"))
+	waitClosed(t, eve)
+
+	// the bans survive a restart
+	bans, err = broker.LoadBans(path)
+	is.NoErr(err)
+
+	b = broker.New(broker.Options{Bans: bans, Operators: []broker.Operator{operator}})
+	is.Equal(b.RegisterFrom("mallory2", "10.0.0.1:4321", newSink()), broker.ErrBanned)
+	is.Equal(b.RegisterFrom("eve", "10.0.0.4:4321", newSink()), broker.ErrBanned)
+
+	// nor under another name
+	is.NoErr(b.RegisterFrom("eve2", "10.0.0.4:4321", newSink()))
+	is.Equal(b.Rename("eve2", "eve"), broker.ErrBanned)
+	is.Equal(b.Members(broker.DefaultRoom), []string{"eve2"})
+
+	is.NoErr(b.RegisterFrom("root", "10.0.0.2:4321", newSink()))
+	is.NoErr(b.Unban("root", "eve"))
+	is.NoErr(b.RegisterFrom("eve", "10.0.0.4:4321", newSink()))
+}
+
+func TestBroker_Operators(t *testing.T) {
+	is := is.New(t)
+
+	operator, err := broker.ParseOperator("root@10.0.0.0/24")
+	is.NoErr(err)
+
+	b := broker.New(broker.Options{Operators: []broker.Operator{operator}})
+	is.NoErr(b.RegisterFrom("alice", "10.0.1.1:1234", newSink())) // the first one in the room
+
+	// the name is reserved for the operator's network
+	is.Equal(b.RegisterFrom("root", "10.0.1.2:1234", newSink()), broker.ErrReserved)
+	is.NoErr(b.RegisterFrom("mallory", "10.0.1.2:1234", newSink()))
+	is.Equal(b.Rename("mallory", "root"), broker.ErrReserved)
+	is.True(!b.IsOperator("mallory", broker.DefaultRoom))
+
+	is.NoErr(b.RegisterFrom("root", "10.0.0.7:1234", newSink()))
+	is.True(b.IsOperator("root", broker.DefaultRoom))
+	is.True(b.IsOperator("root", "#elsewhere"))
+}
+
+func TestParseOperator(t *testing.T) {
+	tests := []struct {
+		input   string
+		network string
+		err     bool
+	}{
+		{input: "root@10.0.0.1", network: "10.0.0.1/32"},
+		{input: "root@10.0.0.0/8", network: "10.0.0.0/8"},
+		{input: "root@::1", network: "::1/128"},
+		{input: "root", err: true},
+		{input: "@10.0.0.1", err: true},
+		{input: "root@", err: true},
+		{input: "root@example.com", err: true},
+		{input: "root@10.0.0.0/33", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			is := is.New(t)
+
+			op, err := broker.ParseOperator(tt.input)
+			if tt.err {
+				is.True(err != nil)
+				return
+			}
+
+			is.NoErr(err)
+			is.Equal(op.Name, "root")
+			is.Equal(op.Network.String(), tt.network)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrNotAway is returned by Back if the client is not away.
+var ErrNotAway = errors.New("you are not away")
+
+// Member is a room member with its presence.
+type Member struct {
+	Name    string
+	Away    bool
+	Message string // optional away message
+}
+
+// SetAway marks the client as away with the optional message and notifies all the rooms the
+// client is in. Setting a new message while away notifies the rooms again.
+func (b *Broker) SetAway(id, message string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.clients[id]
+	if !ok {
+		return ErrNotRegistered
+	}
+
+	c.away, c.awayMessage = true, message
+	b.announce(c, Event{Kind: EventAway, From: id, Text: message})
+
+	return nil
+}
+
+// Back clears the away status of the client and notifies all the rooms the client is in.
+func (b *Broker) Back(id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.clients[id]
+	if !ok {
+		return ErrNotRegistered
+	}
+
+	if !c.away {
+		return ErrNotAway
+	}
+
+	c.away, c.awayMessage = false, ""
+	b.announce(c, Event{Kind: EventBack, From: id})
+
+	return nil
+}
+
+// Presence returns the room members with their presence sorted by name.
+func (b *Broker) Presence(room string) []Member {
+	b.Lock()
+	defer b.Unlock()
+
+	r, ok := b.rooms[room]
+	if !ok {
+		return nil
+	}
+
+	members := make([]Member, 0, len(r.members))
+	for name, c := range r.members {
+		members = append(members, Member{Name: name, Away: c.away, Message: c.awayMessage})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	return members
+}
+
+// announce delivers the client's event to the other members of all the rooms the client is in.
+// The caller must hold the lock.
+func (b *Broker) announce(c *client, e Event) {
+	for _, room := range c.rooms {
+		e.Room = room
+		deliver(b.prepare(room, c.id, e))
+	}
+}
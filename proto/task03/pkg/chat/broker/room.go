@@ -0,0 +1,43 @@
+package broker
+
+import "time"
+
+// roomState is the room membership and moderation state.
+type roomState struct {
+	members map[string]*client
+	ops     map[*client]struct{}
+	muted   map[string]time.Time // muted names and IP addresses until
+}
+
+func newRoomState() *roomState {
+	return &roomState{
+		members: make(map[string]*client),
+		ops:     make(map[*client]struct{}),
+		muted:   make(map[string]time.Time),
+	}
+}
+
+// mute mutes the client's name and IP address, so reconnecting doesn't lift the mute.
+func (r *roomState) mute(c *client, until time.Time) {
+	r.muted[c.id] = until
+	if c.ip != "" {
+		r.muted[c.ip] = until
+	}
+}
+
+// unmute lifts the mute of the client's name and IP address.
+func (r *roomState) unmute(c *client) {
+	delete(r.muted, c.id)
+	delete(r.muted, c.ip)
+}
+
+// inRoom returns true if the client is a member of the room. The caller must hold the lock.
+func (b *Broker) inRoom(id, room string) bool {
+	r, ok := b.rooms[room]
+	if !ok {
+		return false
+	}
+
+	_, ok = r.members[id]
+	return ok
+}
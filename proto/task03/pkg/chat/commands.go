@@ -0,0 +1,331 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"proto/task03/pkg/chat/broker"
+)
+
+// commandFunc handles a single chat command. args is the rest of the line after the command name.
+type commandFunc func(s *Session, args string) error
+
+// errQuit is returned by a command to terminate the session.
+var errQuit = errors.New("quit")
+
+var commands map[string]commandFunc
+
+func init() {
+	commands = map[string]commandFunc{
+		"/join":    (*Session).cmdJoin,
+		"/part":    (*Session).cmdPart,
+		"/rooms":   (*Session).cmdRooms,
+		"/who":     (*Session).cmdWho,
+		"/help":    (*Session).cmdHelp,
+		"/history": (*Session).cmdHistory,
+		"/search":  (*Session).cmdSearch,
+		"/msg":     (*Session).cmdMsg,
+		"/me":      (*Session).cmdMe,
+		"/nick":    (*Session).cmdNick,
+		"/quit":    (*Session).cmdQuit,
+		"/kick":    (*Session).cmdKick,
+		"/mute":    (*Session).cmdMute,
+		"/ban":     (*Session).cmdBan,
+		"/unban":   (*Session).cmdUnban,
+		"/away":    (*Session).cmdAway,
+		"/back":    (*Session).cmdBack,
+	}
+}
+
+var roomRe = regexp.MustCompile("^#[a-zA-Z0-9_-]{1,32}$")
+
+// command parses and runs a command line. Command lines are never sent to the room.
+// Only errQuit is returned - all other errors are reported to the client.
+func (s *Session) command(line string) error {
+	name, args, _ := strings.Cut(line, " ")
+
+	cmd, ok := commands[strings.ToLower(name)]
+	if !ok {
+		s.notify("* unknown command: %s (see /help)", name)
+		return nil
+	}
+
+	err := cmd(s, strings.TrimSpace(args))
+	if errors.Is(err, errQuit) {
+		return err
+	}
+
+	if err != nil {
+		s.notify("* error: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *Session) cmdJoin(args string) error {
+	if !roomRe.MatchString(args) {
+		return errors.New("usage: /join #room")
+	}
+
+	return s.broker.Join(s.name, args)
+}
+
+func (s *Session) cmdPart(args string) error {
+	if args != "" && !roomRe.MatchString(args) {
+		return errors.New("usage: /part [#room]")
+	}
+
+	if err := s.broker.Part(s.name, args); err != nil {
+		return err
+	}
+
+	if current := s.broker.Current(s.name); current != "" {
+		s.notify("* you are now talking in %s", current)
+	}
+
+	return nil
+}
+
+func (s *Session) cmdRooms(args string) error {
+	current := s.broker.Current(s.name)
+
+	rooms := s.broker.Rooms()
+	list := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		mark := ""
+		if room.Name == current {
+			mark = "*"
+		}
+
+		list = append(list, fmt.Sprintf("%s%s (%d)", mark, room.Name, room.Members))
+	}
+
+	s.notify("* rooms: %s", strings.Join(list, ", "))
+
+	return nil
+}
+
+func (s *Session) cmdWho(args string) error {
+	room := args
+	if room == "" {
+		room = s.broker.Current(s.name)
+	}
+
+	if room == "" {
+		return errors.New("usage: /who [#room]")
+	}
+
+	members := s.broker.Presence(room)
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		switch {
+		case m.Away && m.Message != "":
+			names = append(names, fmt.Sprintf("%s (away: %s)", m.Name, m.Message))
+
+		case m.Away:
+			names = append(names, m.Name+" (away)")
+
+		default:
+			names = append(names, m.Name)
+		}
+	}
+
+	s.notify("* %s contains: %s", room, strings.Join(names, ", "))
+
+	return nil
+}
+
+// history and search limits
+const (
+	defaultHistoryLines = 10
+	maxHistoryLines     = 100
+	maxSearchResults    = 20
+)
+
+func (s *Session) cmdHistory(args string) error {
+	n := defaultHistoryLines
+	if args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n <= 0 {
+			return errors.New("usage: /history [n]")
+		}
+	}
+
+	if n > maxHistoryLines {
+		n = maxHistoryLines
+	}
+
+	room := s.broker.Current(s.name)
+	if room == "" {
+		return broker.ErrNoRoom
+	}
+
+	entries, err := s.broker.History(room, n)
+	if err != nil {
+		return err
+	}
+
+	s.notify("* last %d messages in %s:", len(entries), room)
+	for _, e := range entries {
+		s.notify("%s", broker.FormatEntry(e, true))
+	}
+
+	return nil
+}
+
+func (s *Session) cmdSearch(args string) error {
+	if args == "" {
+		return errors.New("usage: /search <term>")
+	}
+
+	room := s.broker.Current(s.name)
+	if room == "" {
+		return broker.ErrNoRoom
+	}
+
+	entries, err := s.broker.Search(room, args, maxSearchResults)
+	if err != nil {
+		return err
+	}
+
+	s.notify("* %d matches for '%s' in %s:", len(entries), args, room)
+	for _, e := range entries {
+		s.notify("%s", broker.FormatEntry(e, true))
+	}
+
+	return nil
+}
+
+func (s *Session) cmdMsg(args string) error {
+	to, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if to == "" || text == "" {
+		return errors.New("usage: /msg <name> <text>")
+	}
+
+	if err := s.broker.Private(s.name, to, text); err != nil {
+		return err
+	}
+
+	if to != s.name {
+		s.notify("[%s -> %s] %s", s.name, to, text)
+	}
+
+	return nil
+}
+
+func (s *Session) cmdMe(args string) error {
+	if args == "" {
+		return errors.New("usage: /me <action>")
+	}
+
+	return s.broker.Action(s.name, args)
+}
+
+func (s *Session) cmdNick(args string) error {
+	if !validate(args) {
+		return errors.New("usage: /nick <newname> (alphanumeric characters only)")
+	}
+
+	if args == s.name {
+		return nil
+	}
+
+	if err := s.broker.Rename(s.name, args); err != nil {
+		return err
+	}
+
+	s.name = args
+
+	return nil
+}
+
+func (s *Session) cmdQuit(args string) error {
+	s.broker.Quit(s.name, args)
+	return errQuit
+}
+
+func (s *Session) cmdKick(args string) error {
+	target, reason, _ := strings.Cut(args, " ")
+	if target == "" {
+		return errors.New("usage: /kick <name> [reason]")
+	}
+
+	return s.broker.Kick(s.name, target, strings.TrimSpace(reason))
+}
+
+func (s *Session) cmdMute(args string) error {
+	target, duration, _ := strings.Cut(args, " ")
+	d, err := time.ParseDuration(strings.TrimSpace(duration))
+	if target == "" || err != nil {
+		return errors.New("usage: /mute <name> <duration> (eg. 5m, 0 to unmute)")
+	}
+
+	return s.broker.Mute(s.name, target, d)
+}
+
+func (s *Session) cmdBan(args string) error {
+	if args == "" {
+		return errors.New("usage: /ban <name|ip>")
+	}
+
+	if err := s.broker.Ban(s.name, args); err != nil {
+		return err
+	}
+
+	s.notify("* %s has been banned", args)
+
+	return nil
+}
+
+func (s *Session) cmdUnban(args string) error {
+	if args == "" {
+		return errors.New("usage: /unban <name|ip>")
+	}
+
+	if err := s.broker.Unban(s.name, args); err != nil {
+		return err
+	}
+
+	s.notify("* %s has been unbanned", args)
+
+	return nil
+}
+
+func (s *Session) cmdAway(args string) error {
+	if err := s.broker.SetAway(s.name, args); err != nil {
+		return err
+	}
+
+	s.away, s.autoAway = true, false
+	s.notify("* you are now away")
+
+	return nil
+}
+
+func (s *Session) cmdBack(args string) error {
+	if !s.away {
+		return broker.ErrNotAway
+	}
+
+	s.back()
+
+	return nil
+}
+
+func (s *Session) cmdHelp(args string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s.notify("* commands: %s", strings.Join(names, ", "))
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package irc
+
+import (
+	"strings"
+)
+
+// Numeric replies
+const (
+	rplWelcome        = "001"
+	rplYourHost       = "002"
+	rplMyInfo         = "004"
+	rplUnaway         = "305"
+	rplNowAway        = "306"
+	rplNamReply       = "353"
+	rplEndOfNames     = "366"
+	errNoSuchNick     = "401"
+	errNoSuchChannel  = "403"
+	errCannotSend     = "404"
+	errUnknownCommand = "421"
+	errNoMOTD         = "422"
+	errNoNickname     = "431"
+	errBadNickname    = "432"
+	errNicknameInUse  = "433"
+	errNotOnChannel   = "442"
+	errNotRegistered  = "451"
+	errNeedMoreParams = "461"
+	errAlreadyReg     = "462"
+)
+
+// message is a parsed IRC message: [:prefix] COMMAND [params] [:trailing]
+type message struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+// parse parses a single IRC line (without the line terminator). The command is upper-cased and
+// the trailing parameter (if any) is the last of the params.
+func parse(line string) message {
+	var m message
+
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		m.prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, ":") {
+			m.params = append(m.params, line[1:])
+			break
+		}
+
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		m.params = append(m.params, param)
+	}
+
+	if len(m.params) > 0 {
+		m.command, m.params = strings.ToUpper(m.params[0]), m.params[1:]
+	}
+
+	return m
+}
+
+// param returns the i-th parameter or an empty string.
+func (m message) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+
+	return ""
+}
+
+// format builds an IRC line (with the line terminator). The last parameter is sent as the
+// trailing one if it is empty, contains spaces or starts with a colon.
+func format(prefix, command string, params ...string) string {
+	var sb strings.Builder
+
+	if prefix != "" {
+		sb.WriteString(":" + prefix + " ")
+	}
+	sb.WriteString(command)
+
+	for i, param := range params {
+		sb.WriteString(" ")
+		if i == len(params)-1 && (param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			sb.WriteString(":")
+		}
+		sb.WriteString(param)
+	}
+
+	sb.WriteString("\r\n")
+
+	return sb.String()
+}
+
+// source returns the message prefix of the chat user.
+func source(nick string) string {
+	return nick + "!" + nick + "@" + ServerName
+}
@@ -0,0 +1,467 @@
+// Package irc is an IRC front-end of the chat broker. IRC clients share the rooms (channels) with
+// the budgetchat users: their messages are translated into broker events and the broker events
+// are rendered as IRC messages.
+package irc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"proto/common/pkg/iotools"
+	"proto/task03/pkg/chat/broker"
+)
+
+// ServerName is the server name used in the IRC message prefixes.
+const ServerName = "budgetchat"
+
+// errQuit is returned by a command to terminate the session.
+var errQuit = errors.New("quit")
+
+var (
+	nickRe    = regexp.MustCompile("^[a-zA-Z0-9]+$")
+	channelRe = regexp.MustCompile("^#[a-zA-Z0-9_-]{1,32}$")
+)
+
+// commandFunc handles a single IRC command.
+type commandFunc func(s *Session, m message) error
+
+var commands map[string]commandFunc
+
+// preRegistration are the commands allowed before the client has registered.
+var preRegistration = map[string]bool{
+	"NICK": true,
+	"USER": true,
+	"PING": true,
+	"PONG": true,
+	"CAP":  true,
+	"QUIT": true,
+}
+
+func init() {
+	commands = map[string]commandFunc{
+		"NICK":    (*Session).cmdNick,
+		"USER":    (*Session).cmdUser,
+		"JOIN":    (*Session).cmdJoin,
+		"PART":    (*Session).cmdPart,
+		"PRIVMSG": (*Session).cmdPrivmsg,
+		"NAMES":   (*Session).cmdNames,
+		"PING":    (*Session).cmdPing,
+		"PONG":    (*Session).cmdIgnore,
+		"CAP":     (*Session).cmdIgnore,
+		"QUIT":    (*Session).cmdQuit,
+		"AWAY":    (*Session).cmdAway,
+	}
+}
+
+// Session is a single IRC connection.
+type Session struct {
+	broker     *broker.Broker
+	addr       net.Addr
+	w          io.Writer
+	user       string
+	registered bool
+
+	mu   sync.Mutex // guards nick - it is also read by the broker's writer goroutine
+	nick string
+
+	// used by the broker's writer goroutine only
+	welcomed bool
+	renamed  string
+}
+
+// NewSession opens a new IRC session for the remote address (may be nil if unknown).
+func NewSession(broker *broker.Broker, addr net.Addr) *Session {
+	return &Session{broker: broker, addr: addr}
+}
+
+// Handle handles a single IRC connection.
+func (s *Session) Handle(ctx context.Context, rw io.ReadWriter) {
+	s.w = rw
+	defer func() {
+		if s.registered {
+			s.broker.Unregister(s.nickname())
+		}
+	}()
+
+	for buf := range iotools.GetLine(ctx, rw) {
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+		}
+
+		m := parse(strings.TrimRight(string(buf), "\r"))
+		if m.command == "" {
+			continue
+		}
+
+		if err := s.command(m); errors.Is(err, errQuit) {
+			return
+		}
+	}
+}
+
+// command runs a single command. Only errQuit is returned - all other errors are reported to the
+// client.
+func (s *Session) command(m message) error {
+	cmd, ok := commands[m.command]
+	if !ok {
+		if s.registered {
+			s.reply(errUnknownCommand, m.command, "Unknown command")
+		}
+		return nil
+	}
+
+	if !s.registered && !preRegistration[m.command] {
+		s.reply(errNotRegistered, "You have not registered")
+		return nil
+	}
+
+	return cmd(s, m)
+}
+
+func (s *Session) nickname() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.nick
+}
+
+func (s *Session) setNickname(nick string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nick = nick
+}
+
+// write writes the IRC line to the client. Once registered, the broker is the only writer to the
+// connection, so the line is passed through it.
+func (s *Session) write(line string) {
+	if s.registered {
+		s.broker.Reply(s.nickname(), line)
+		return
+	}
+
+	if _, err := io.WriteString(s.w, line); err != nil {
+		log.Println("Error write:", err.Error())
+	}
+}
+
+// reply sends a numeric reply to the client.
+func (s *Session) reply(code string, params ...string) {
+	target := s.nickname()
+	if target == "" {
+		target = "*"
+	}
+
+	s.write(format(ServerName, code, append([]string{target}, params...)...))
+}
+
+// notice sends a server notice to the client.
+func (s *Session) notice(text string) {
+	s.reply("NOTICE", text)
+}
+
+// register registers the client with the broker once both NICK and USER are received.
+func (s *Session) register() error {
+	nick := s.nickname()
+	if nick == "" || s.user == "" {
+		return nil
+	}
+
+	var addr string
+	if s.addr != nil {
+		addr = s.addr.String()
+	}
+
+	err := s.broker.RegisterWith(nick, addr, s.w, s.render)
+	switch {
+	case errors.Is(err, broker.ErrNameTaken):
+		s.setNickname("")
+		s.reply(errNicknameInUse, nick, "Nickname is already in use")
+		return nil
+
+	case err != nil:
+		log.Println("Error:", err.Error())
+		s.write(format("", "ERROR", "Closing link: "+err.Error()))
+		return errQuit
+	}
+
+	s.registered = true
+
+	return nil
+}
+
+func (s *Session) cmdNick(m message) error {
+	nick := m.param(0)
+	if nick == "" {
+		s.reply(errNoNickname, "No nickname given")
+		return nil
+	}
+
+	if !nickRe.MatchString(nick) {
+		s.reply(errBadNickname, nick, "Erroneous nickname (alphanumeric characters only)")
+		return nil
+	}
+
+	if !s.registered {
+		s.setNickname(nick)
+		return s.register()
+	}
+
+	current := s.nickname()
+	if nick == current {
+		return nil
+	}
+
+	if err := s.broker.Rename(current, nick); err != nil {
+		if errors.Is(err, broker.ErrNameTaken) {
+			s.reply(errNicknameInUse, nick, "Nickname is already in use")
+		} else {
+			s.notice(err.Error())
+		}
+		return nil
+	}
+
+	s.setNickname(nick)
+
+	return nil
+}
+
+func (s *Session) cmdUser(m message) error {
+	if s.registered {
+		s.reply(errAlreadyReg, "You may not reregister")
+		return nil
+	}
+
+	if m.param(0) == "" {
+		s.reply(errNeedMoreParams, "USER", "Not enough parameters")
+		return nil
+	}
+
+	s.user = m.param(0)
+
+	return s.register()
+}
+
+func (s *Session) cmdJoin(m message) error {
+	if m.param(0) == "" {
+		s.reply(errNeedMoreParams, "JOIN", "Not enough parameters")
+		return nil
+	}
+
+	nick := s.nickname()
+	for _, channel := range strings.Split(m.param(0), ",") {
+		if !channelRe.MatchString(channel) {
+			s.reply(errNoSuchChannel, channel, "No such channel")
+			continue
+		}
+
+		if slices.Contains(s.broker.Members(channel), nick) {
+			continue // IRC clients expect joining a channel twice to be a no-op
+		}
+
+		if err := s.broker.Join(nick, channel); err != nil {
+			s.notice(err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) cmdPart(m message) error {
+	if m.param(0) == "" {
+		s.reply(errNeedMoreParams, "PART", "Not enough parameters")
+		return nil
+	}
+
+	for _, channel := range strings.Split(m.param(0), ",") {
+		err := s.broker.Part(s.nickname(), channel)
+		switch {
+		case errors.Is(err, broker.ErrNotInRoom):
+			s.reply(errNotOnChannel, channel, "You're not on that channel")
+
+		case err != nil:
+			s.notice(err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) cmdPrivmsg(m message) error {
+	target, text := m.param(0), m.param(1)
+	if target == "" || text == "" {
+		s.reply(errNeedMoreParams, "PRIVMSG", "Not enough parameters")
+		return nil
+	}
+
+	nick := s.nickname()
+	if !strings.HasPrefix(target, "#") {
+		err := s.broker.Private(nick, target, text)
+		switch {
+		case errors.Is(err, broker.ErrNoSuchUser):
+			s.reply(errNoSuchNick, target, "No such nick/channel")
+
+		case err != nil:
+			s.notice(err.Error())
+		}
+		return nil
+	}
+
+	var err error
+	if action, ok := ctcpAction(text); ok {
+		err = s.broker.ActionTo(nick, target, action)
+	} else {
+		err = s.broker.SendTo(nick, target, text)
+	}
+
+	if err != nil {
+		s.reply(errCannotSend, target, "Cannot send to channel: "+err.Error())
+	}
+
+	return nil
+}
+
+func (s *Session) cmdNames(m message) error {
+	channels := m.param(0)
+	if channels == "" {
+		channels = s.broker.Current(s.nickname())
+	}
+
+	nick := s.nickname()
+	for _, channel := range strings.Split(channels, ",") {
+		s.write(names(nick, channel, s.broker.Members(channel)))
+	}
+
+	return nil
+}
+
+func (s *Session) cmdPing(m message) error {
+	s.write(format(ServerName, "PONG", ServerName, m.param(0)))
+	return nil
+}
+
+func (s *Session) cmdIgnore(m message) error {
+	return nil
+}
+
+func (s *Session) cmdAway(m message) error {
+	if m.param(0) == "" {
+		if err := s.broker.Back(s.nickname()); err != nil && !errors.Is(err, broker.ErrNotAway) {
+			s.notice(err.Error())
+			return nil
+		}
+
+		s.reply(rplUnaway, "You are no longer marked as being away")
+		return nil
+	}
+
+	if err := s.broker.SetAway(s.nickname(), m.param(0)); err != nil {
+		s.notice(err.Error())
+		return nil
+	}
+
+	s.reply(rplNowAway, "You have been marked as being away")
+
+	return nil
+}
+
+func (s *Session) cmdQuit(m message) error {
+	if s.registered {
+		s.broker.Quit(s.nickname(), m.param(0))
+		s.registered = false
+	}
+
+	return errQuit
+}
+
+// render renders the broker event as IRC messages. It is called by the broker's writer goroutine
+// and precedes the very first event with the welcome replies.
+func (s *Session) render(e broker.Event) string {
+	nick := s.nickname()
+
+	var out string
+	if !s.welcomed {
+		s.welcomed = true
+		out = format(ServerName, rplWelcome, nick, "Welcome to budgetchat, "+nick) +
+			format(ServerName, rplYourHost, nick, "Your host is "+ServerName) +
+			format(ServerName, rplMyInfo, nick, ServerName, "1.0", "o", "o") +
+			format(ServerName, errNoMOTD, nick, "MOTD File is missing")
+	}
+
+	switch e.Kind {
+	case broker.EventReply:
+		return out + e.Text
+
+	case broker.EventNotice:
+		target := nick
+		if e.Room != "" {
+			target = e.Room
+		}
+		return out + format(ServerName, "NOTICE", target, strings.TrimPrefix(e.Text, "* "))
+
+	case broker.EventMessage:
+		return out + format(source(e.From), "PRIVMSG", e.Room, e.Text)
+
+	case broker.EventAction:
+		return out + format(source(e.From), "PRIVMSG", e.Room, "\x01ACTION "+e.Text+"\x01")
+
+	case broker.EventPrivate:
+		return out + format(source(e.From), "PRIVMSG", e.To, e.Text)
+
+	case broker.EventJoin:
+		return out + format(source(e.From), "JOIN", e.Room)
+
+	case broker.EventPart:
+		if e.Text != "" {
+			return out + format(source(e.From), "PART", e.Room, e.Text)
+		}
+		return out + format(source(e.From), "PART", e.Room)
+
+	case broker.EventAway, broker.EventBack:
+		return out + format(ServerName, "NOTICE", e.Room, strings.TrimPrefix(e.String(), "* "))
+
+	case broker.EventNames:
+		return out + names(nick, e.Room, append(e.Names, nick))
+
+	case broker.EventNick:
+		// the rename is reported once per shared room, but IRC clients expect a single NICK.
+		if key := e.From + " " + e.To; key != s.renamed {
+			s.renamed = key
+			return out + format(source(e.From), "NICK", e.To)
+		}
+	}
+
+	return out
+}
+
+// names renders the channel member list replies.
+func names(nick, channel string, members []string) string {
+	sort.Strings(members)
+
+	var out string
+	if len(members) > 0 {
+		out = format(ServerName, rplNamReply, nick, "=", channel, strings.Join(members, " "))
+	}
+
+	return out + format(ServerName, rplEndOfNames, nick, channel, "End of /NAMES list")
+}
+
+// ctcpAction extracts the action text of a CTCP ACTION message (sent by /me).
+func ctcpAction(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01ACTION ") {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01"), true
+}
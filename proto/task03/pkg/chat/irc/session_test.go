@@ -0,0 +1,247 @@
+package irc_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat"
+	"proto/task03/pkg/chat/broker"
+	"proto/task03/pkg/chat/irc"
+)
+
+// conn is a connected IRC or budgetchat client for the tests.
+type conn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	done chan struct{}
+}
+
+func dial(t *testing.T, handle func(ctx context.Context, rw net.Conn)) *conn {
+	t.Helper()
+
+	server, client := net.Pipe()
+	c := &conn{t: t, conn: client, r: bufio.NewReader(client), done: make(chan struct{})}
+
+	go func() {
+		defer close(c.done)
+		defer func() {
+			_ = server.Close()
+		}()
+		handle(context.Background(), server)
+	}()
+
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return c
+}
+
+// connectIRC registers an IRC client and consumes the welcome burst up to the default room names.
+func connectIRC(t *testing.T, b *broker.Broker, nick string) *conn {
+	t.Helper()
+
+	c := dial(t, func(ctx context.Context, rw net.Conn) {
+		irc.NewSession(b, nil).Handle(ctx, rw)
+	})
+
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.expect(":budgetchat 001 " + nick + " :Welcome to budgetchat, " + nick)
+	c.skipUntil(":budgetchat 422 ")
+	c.expect(fmt.Sprintf(":%s!%s@budgetchat JOIN #general", nick, nick))
+	c.skipUntil(":budgetchat 366 ")
+
+	return c
+}
+
+// connectChat registers a budgetchat client and consumes the room contents line.
+func connectChat(t *testing.T, b *broker.Broker, name string) *conn {
+	t.Helper()
+
+	c := dial(t, func(ctx context.Context, rw net.Conn) {
+		chat.NewSession(b, nil).Handle(ctx, rw)
+	})
+
+	c.expect("Welcome to budgetchat! What shall I call you?")
+	c.send(name)
+	c.skipUntil("* the room contains: ")
+
+	return c
+}
+
+func (c *conn) send(line string) {
+	c.t.Helper()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := fmt.Fprint(c.conn, line+"\r\n"); err != nil {
+		c.t.Fatalf("send %q: %s", line, err.Error())
+	}
+}
+
+func (c *conn) read() string {
+	c.t.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %s", err.Error())
+	}
+
+	return strings.TrimRight(line, "\r\n")
+}
+
+func (c *conn) expect(want string) {
+	c.t.Helper()
+
+	if got := c.read(); got != want {
+		c.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// skipUntil consumes the lines up to (and including) the one with the prefix.
+func (c *conn) skipUntil(prefix string) string {
+	c.t.Helper()
+
+	for {
+		if line := c.read(); strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func (c *conn) closed() {
+	c.t.Helper()
+
+	select {
+	case <-c.done:
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("session has not terminated")
+	}
+}
+
+func TestSession_Registration(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{
+			name:  "command before registration",
+			lines: []string{"JOIN #dev"},
+			want:  ":budgetchat 451 * :You have not registered",
+		},
+		{
+			name:  "invalid nick",
+			lines: []string{"NICK bad_nick"},
+			want:  ":budgetchat 432 * bad_nick :Erroneous nickname (alphanumeric characters only)",
+		},
+		{
+			name:  "nick in use",
+			lines: []string{"NICK alice", "USER alice 0 * :Alice"},
+			want:  ":budgetchat 433 * alice :Nickname is already in use",
+		},
+		{
+			name:  "ping",
+			lines: []string{"PING :12345"},
+			want:  ":budgetchat PONG budgetchat 12345",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := broker.New(broker.Options{})
+			connectChat(t, b, "alice")
+
+			c := dial(t, func(ctx context.Context, rw net.Conn) {
+				irc.NewSession(b, nil).Handle(ctx, rw)
+			})
+
+			for _, line := range tt.lines {
+				c.send(line)
+			}
+
+			c.expect(tt.want)
+		})
+	}
+}
+
+func TestSession_Translation(t *testing.T) {
+	is := is.New(t)
+	b := broker.New(broker.Options{})
+
+	alice := connectChat(t, b, "alice")
+	bob := connectIRC(t, b, "bob")
+	alice.expect("* bob has entered the room")
+
+	// IRC -> budgetchat
+	bob.send("PRIVMSG #general :hi there")
+	alice.expect("[bob] hi there")
+
+	bob.send("PRIVMSG #general :\x01ACTION waves\x01")
+	alice.expect("* bob waves")
+
+	bob.send("PRIVMSG alice :psst")
+	alice.expect("[bob -> alice] psst")
+
+	// budgetchat -> IRC
+	alice.send("hello bob")
+	bob.expect(":alice!alice@budgetchat PRIVMSG #general :hello bob")
+
+	alice.send("/me nods")
+	bob.expect(":alice!alice@budgetchat PRIVMSG #general :\x01ACTION nods\x01")
+
+	alice.send("/msg bob secret")
+	bob.expect(":alice!alice@budgetchat PRIVMSG bob secret")
+	alice.expect("[alice -> bob] secret")
+
+	// channels
+	bob.send("JOIN #dev")
+	bob.expect(":bob!bob@budgetchat JOIN #dev")
+	bob.expect(":budgetchat 353 bob = #dev bob")
+	bob.expect(":budgetchat 366 bob #dev :End of /NAMES list")
+
+	alice.send("/join #dev")
+	alice.expect("* the room contains: bob")
+	bob.expect(":alice!alice@budgetchat JOIN #dev")
+
+	// the message to a channel which is not bob's current one keeps bob's current room intact
+	bob.send("PRIVMSG #general :still here")
+	alice.expect("#general [bob] still here")
+	is.Equal(b.Current("bob"), "#dev")
+
+	bob.send("NAMES #dev")
+	bob.expect(":budgetchat 353 bob = #dev :alice bob")
+	bob.expect(":budgetchat 366 bob #dev :End of /NAMES list")
+
+	bob.send("PRIVMSG #nowhere :hello")
+	bob.expect(":budgetchat 404 bob #nowhere :Cannot send to channel: you are not in the room")
+
+	bob.send("PRIVMSG carol :hello")
+	bob.expect(":budgetchat 401 bob carol :No such nick/channel")
+
+	bob.send("NICK robert")
+	bob.expect(":bob!bob@budgetchat NICK robert")
+	alice.expect("#general * bob is now known as robert")
+	alice.expect("* bob is now known as robert")
+
+	alice.send("/part")
+	alice.expect("* you are now talking in #general")
+	bob.expect(":alice!alice@budgetchat PART #dev")
+
+	bob.send("PART #dev")
+	bob.expect(":robert!robert@budgetchat PART #dev")
+
+	bob.send("QUIT :gone fishing")
+	bob.closed()
+	alice.expect("* robert has left the room (gone fishing)")
+	is.Equal(b.Members(broker.DefaultRoom), []string{"alice"})
+}
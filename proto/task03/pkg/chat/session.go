@@ -2,11 +2,14 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"proto/common/pkg/iotools"
 	"proto/task03/pkg/chat/broker"
@@ -14,13 +17,16 @@ import (
 
 // Session is a session struct
 type Session struct {
-	name   string
-	broker *broker.Broker
+	name     string
+	addr     net.Addr
+	broker   *broker.Broker
+	away     bool
+	autoAway bool // set by the inactivity rather than /away
 }
 
-// NewSession opens a new chat session entity.
-func NewSession(broker *broker.Broker) *Session {
-	return &Session{broker: broker}
+// NewSession opens a new chat session entity for the remote address (may be nil if unknown).
+func NewSession(broker *broker.Broker, addr net.Addr) *Session {
+	return &Session{broker: broker, addr: addr}
 }
 
 // Handle handles a single chat connection.
@@ -34,25 +40,120 @@ func (s *Session) Handle(ctx context.Context, rw io.ReadWriter) {
 		return
 	}
 
-	if err := s.broker.Register(s.name, rw); err != nil {
+	var addr string
+	if s.addr != nil {
+		addr = s.addr.String()
+	}
+
+	if err := s.broker.RegisterFrom(s.name, addr, rw); err != nil {
 		log.Println("Error:", err.Error())
+		fmt.Fprintf(rw, "* error: %s\n", err.Error())
 		return
 	}
-	defer s.broker.Unregister(s.name)
+	defer func() {
+		s.broker.Unregister(s.name) // the name may have changed in the meantime
+	}()
 
-	for buf := range lines {
+	opts := s.broker.Options()
+
+	var tick <-chan time.Time
+	if interval := idleCheckInterval(opts); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var closing <-chan time.Time // set once disconnected for being idle
+	last := time.Now()
+
+	for {
 		select {
 		case <-ctx.Done():
-			break
+			return
+
+		case <-closing:
+			return
+
+		case now := <-tick:
+			if s.idle(now.Sub(last), opts) {
+				tick, closing = nil, time.After(idleCloseTimeout)
+			}
+			continue
+
+		case buf, ok := <-lines:
+			if !ok {
+				return
+			}
+
+			last = time.Now()
+			if closing != nil {
+				continue
+			}
+
+			line := strings.TrimSpace(string(buf))
+			if s.autoAway && !strings.EqualFold(line, "/back") {
+				s.back()
+			}
+
+			if strings.HasPrefix(line, "/") {
+				if err := s.command(line); errors.Is(err, errQuit) {
+					return
+				}
+				continue
+			}
+
+			if err := s.broker.Send(s.name, line); err != nil {
+				s.notify("* error: %s", err.Error())
+			}
+		}
+	}
+}
+
+// idleCloseTimeout limits how long the idle session waits for the broker to close the connection.
+const idleCloseTimeout = time.Second
+
+// idleCheckInterval returns how often the session checks for inactivity (0 if it doesn't).
+func idleCheckInterval(opts broker.Options) time.Duration {
+	interval := opts.IdleTimeout
+	if opts.AutoAway > 0 && (interval == 0 || opts.AutoAway < interval) {
+		interval = opts.AutoAway
+	}
+
+	return interval / 4
+}
 
-		default:
+// idle applies the idle timeout and the auto-away after d of inactivity. Returns true if the
+// client has been disconnected.
+func (s *Session) idle(d time.Duration, opts broker.Options) bool {
+	if opts.IdleTimeout > 0 && d >= opts.IdleTimeout {
+		log.Printf("%s has been idle for %s - disconnecting", s.name, d.Round(time.Second))
+		s.broker.Disconnect(s.name, "idle timeout", "* you have been idle for too long - disconnecting")
+		return true
+	}
+
+	if opts.AutoAway > 0 && d >= opts.AutoAway && !s.away {
+		if err := s.broker.SetAway(s.name, "idle"); err == nil {
+			s.away, s.autoAway = true, true
+			s.notify("* you have been marked as away after %s of inactivity", opts.AutoAway)
 		}
+	}
 
-		line := strings.TrimSpace(string(buf))
-		s.broker.Send(s.name, line)
+	return false
+}
+
+// back clears the away status of the session.
+func (s *Session) back() {
+	s.away, s.autoAway = false, false
+	if err := s.broker.Back(s.name); err == nil {
+		s.notify("* you are back")
 	}
 }
 
+// notify sends a text line to the session client only.
+func (s *Session) notify(format string, args ...any) {
+	s.broker.Notify(s.name, fmt.Sprintf(format, args...))
+}
+
 func validate(name string) bool {
 	if len(name) < 1 {
 		return false
@@ -0,0 +1,215 @@
+package chat_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat"
+	"proto/task03/pkg/chat/broker"
+)
+
+// user is a connected chat client for the tests.
+type user struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	done chan struct{}
+}
+
+func connect(t *testing.T, b *broker.Broker, name string) *user {
+	t.Helper()
+
+	server, client := net.Pipe()
+	u := &user{t: t, conn: client, r: bufio.NewReader(client), done: make(chan struct{})}
+
+	go func() {
+		defer close(u.done)
+		defer func() {
+			_ = server.Close()
+		}()
+		chat.NewSession(b, nil).Handle(context.Background(), server)
+	}()
+
+	u.expect("Welcome to budgetchat! What shall I call you?")
+	u.send(name)
+
+	return u
+}
+
+func (u *user) send(line string) {
+	u.t.Helper()
+
+	_ = u.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := fmt.Fprintln(u.conn, line); err != nil {
+		u.t.Fatalf("send %q: %s", line, err.Error())
+	}
+}
+
+func (u *user) read() string {
+	u.t.Helper()
+
+	_ = u.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := u.r.ReadString('\n')
+	if err != nil {
+		u.t.Fatalf("read: %s", err.Error())
+	}
+
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (u *user) expect(want string) {
+	u.t.Helper()
+
+	if got := u.read(); got != want {
+		u.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func (u *user) expectPrefix(want string) {
+	u.t.Helper()
+
+	if got := u.read(); !strings.HasPrefix(got, want) {
+		u.t.Fatalf("got %q, want prefix %q", got, want)
+	}
+}
+
+func (u *user) closed() {
+	u.t.Helper()
+
+	select {
+	case <-u.done:
+	case <-time.After(2 * time.Second):
+		u.t.Fatal("session has not terminated")
+	}
+}
+
+func TestSession_Commands(t *testing.T) {
+	is := is.New(t)
+	b := broker.New(broker.Options{})
+
+	alice := connect(t, b, "alice")
+	alice.expect("* the room contains: ")
+
+	bob := connect(t, b, "bob")
+	bob.expect("* the room contains: alice")
+	alice.expect("* bob has entered the room")
+
+	// plain messages keep the original format
+	alice.send("hello")
+	bob.expect("[alice] hello")
+
+	// unknown commands never leak into the room
+	alice.send("/dance")
+	alice.expect("* unknown command: /dance (see /help)")
+
+	alice.send("/me waves")
+	bob.expect("* alice waves")
+
+	alice.send("/msg bob psst")
+	bob.expect("[alice -> bob] psst")
+	alice.expect("[alice -> bob] psst")
+
+	alice.send("/msg carol psst")
+	alice.expect("* error: no such user")
+
+	alice.send("/nick bad name")
+	alice.expectPrefix("* error: usage: /nick")
+
+	alice.send("/nick bob")
+	alice.expect("* error: the name is already taken")
+
+	alice.send("/nick alice2")
+	alice.expect("* alice is now known as alice2")
+	bob.expect("* alice is now known as alice2")
+	is.Equal(b.Members(broker.DefaultRoom), []string{"alice2", "bob"})
+
+	bob.send("/join #dev")
+	bob.expect("* the room contains: ")
+	bob.send("/rooms")
+	bob.expect("* rooms: *#dev (1), #general (2)")
+	bob.send("/who #general")
+	bob.expect("* #general contains: alice2, bob")
+
+	alice.send("/quit bye all")
+	alice.closed()
+	bob.expect("#general * alice2 has left the room (bye all)")
+	is.Equal(b.Members(broker.DefaultRoom), []string{"bob"})
+}
+
+func TestSession_Away(t *testing.T) {
+	b := broker.New(broker.Options{})
+
+	alice := connect(t, b, "alice")
+	alice.expect("* the room contains: ")
+
+	bob := connect(t, b, "bob")
+	bob.expect("* the room contains: alice")
+	alice.expect("* bob has entered the room")
+
+	bob.send("/back")
+	bob.expect("* error: you are not away")
+
+	bob.send("/away lunch")
+	bob.expect("* you are now away")
+	alice.expect("* bob is away (lunch)")
+
+	alice.send("/who")
+	alice.expect("* #general contains: alice, bob (away: lunch)")
+
+	// talking does not clear the explicit away status
+	bob.send("still eating")
+	alice.expect("[bob] still eating")
+
+	bob.send("/back")
+	bob.expect("* you are back")
+	alice.expect("* bob is back")
+
+	alice.send("/who")
+	alice.expect("* #general contains: alice, bob")
+}
+
+func TestSession_Idle(t *testing.T) {
+	b := broker.New(broker.Options{AutoAway: 100 * time.Millisecond, IdleTimeout: 400 * time.Millisecond})
+
+	alice := connect(t, b, "alice")
+	alice.expect("* the room contains: ")
+
+	bob := connect(t, b, "bob")
+	bob.expect("* the room contains: alice")
+	alice.expect("* bob has entered the room")
+
+	// alice keeps talking, bob goes idle
+	alice.send("anyone?")
+	bob.expect("[alice] anyone?")
+	bob.expect("* you have been marked as away after 100ms of inactivity")
+	alice.expect("* bob is away (idle)")
+
+	alice.send("/who")
+	alice.expect("* #general contains: alice, bob (away: idle)")
+
+	// any activity clears the automatic away
+	bob.send("here")
+	bob.expect("* you are back")
+	alice.expect("* bob is back")
+	alice.expect("[bob] here")
+
+	// alice may go away (and get disconnected) as well in the meantime
+	for {
+		line := bob.read()
+		if line == "* you have been idle for too long - disconnecting" {
+			break
+		}
+	}
+	bob.closed()
+
+	is := is.New(t)
+	is.True(!slices.Contains(b.Members(broker.DefaultRoom), "bob"))
+}
@@ -0,0 +1,268 @@
+package transcript
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults
+const (
+	DefaultMaxSize  = 10 << 20 // 10MiB
+	DefaultMaxFiles = 5
+)
+
+// Entry is a single transcript line.
+type Entry struct {
+	Time time.Time
+	Room string
+	Text string
+}
+
+// Options configures the Transcript rotation policy.
+type Options struct {
+	MaxSize  int64 // rotate once the file grows above the size - DefaultMaxSize if 0.
+	MaxFiles int   // number of rotated files to keep - DefaultMaxFiles if 0.
+}
+
+// Transcript is an append-only chat transcript rotated by size.
+// Each line has the format: RFC3339 timestamp <TAB> room <TAB> text
+type Transcript struct {
+	mu   sync.Mutex
+	path string
+	opts Options
+	f    *os.File
+	size int64
+}
+
+// Open opens (or creates) the transcript file for appending.
+func Open(path string, opts Options) (*Transcript, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = DefaultMaxFiles
+	}
+
+	t := &Transcript{path: path, opts: opts}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Append appends the entry to the transcript rotating the file if needed.
+func (t *Transcript) Append(e Entry) error {
+	line := format(e)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return errors.New("transcript is closed")
+	}
+
+	if t.size > 0 && t.size+int64(len(line)) > t.opts.MaxSize {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := t.f.WriteString(line)
+	t.size += int64(n)
+
+	return err
+}
+
+// Last returns up to n most recent entries of the room.
+func (t *Transcript) Last(room string, n int) ([]Entry, error) {
+	var res []Entry
+
+	err := t.scan(func(e Entry) {
+		if e.Room != room {
+			return
+		}
+
+		res = append(res, e)
+		if len(res) > n {
+			res = res[1:]
+		}
+	})
+
+	return res, err
+}
+
+// Search returns up to limit most recent entries of the room containing the term
+// (case insensitive).
+func (t *Transcript) Search(room, term string, limit int) ([]Entry, error) {
+	var res []Entry
+
+	term = strings.ToLower(term)
+	err := t.scan(func(e Entry) {
+		if e.Room != room || !strings.Contains(strings.ToLower(e.Text), term) {
+			return
+		}
+
+		res = append(res, e)
+		if len(res) > limit {
+			res = res[1:]
+		}
+	})
+
+	return res, err
+}
+
+// Close closes the transcript.
+func (t *Transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return nil
+	}
+
+	err := t.f.Close()
+	t.f = nil
+
+	return err
+}
+
+// scan calls fn for every entry from the oldest rotated file to the current one. The files are
+// opened under the lock, but read without it so the appends don't wait for the scan. The open
+// files survive a rotation, and the current one is read only up to its size at the time of the
+// scan.
+func (t *Transcript) scan(fn func(e Entry)) error {
+	files, err := t.snapshot()
+	defer func() {
+		for _, r := range files {
+			_ = r.f.Close()
+		}
+	}()
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range files {
+		if err := scanReader(io.LimitReader(r.f, r.size), fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type snapshotFile struct {
+	f    *os.File
+	size int64
+}
+
+// snapshot opens the existing transcript files from the oldest to the current one.
+func (t *Transcript) snapshot() ([]snapshotFile, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var files []snapshotFile
+	for i := t.opts.MaxFiles; i >= 0; i-- {
+		f, err := os.Open(t.rotated(i))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return files, fmt.Errorf("failed to open transcript: %w", err)
+		}
+
+		size := t.size
+		if i > 0 {
+			info, err := f.Stat()
+			if err != nil {
+				_ = f.Close()
+				return files, fmt.Errorf("failed to stat transcript: %w", err)
+			}
+			size = info.Size()
+		}
+
+		files = append(files, snapshotFile{f: f, size: size})
+	}
+
+	return files, nil
+}
+
+func (t *Transcript) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open transcript: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat transcript: %w", err)
+	}
+
+	t.f, t.size = f, info.Size()
+
+	return nil
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1 and opens a fresh file. The caller must
+// hold the lock.
+func (t *Transcript) rotate() error {
+	if err := t.f.Close(); err != nil {
+		log.Println("Error closing transcript:", err.Error())
+	}
+
+	_ = os.Remove(t.rotated(t.opts.MaxFiles))
+	for i := t.opts.MaxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(t.rotated(i), t.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate transcript: %w", err)
+		}
+	}
+
+	return t.open()
+}
+
+// rotated returns the path of the i-th rotated file (0 is the current file).
+func (t *Transcript) rotated(i int) string {
+	if i == 0 {
+		return t.path
+	}
+
+	return fmt.Sprintf("%s.%d", t.path, i)
+}
+
+func scanReader(r io.Reader, fn func(e Entry)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if e, ok := parse(scanner.Text()); ok {
+			fn(e)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func format(e Entry) string {
+	return fmt.Sprintf("%s\t%s\t%s\n", e.Time.UTC().Format(time.RFC3339), e.Room, e.Text)
+}
+
+func parse(line string) (Entry, bool) {
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 {
+		return Entry{}, false
+	}
+
+	tm, err := time.Parse(time.RFC3339, parts[0])
+	if err != nil {
+		return Entry{}, false
+	}
+
+	return Entry{Time: tm, Room: parts[1], Text: parts[2]}, true
+}
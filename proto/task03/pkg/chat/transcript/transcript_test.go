@@ -0,0 +1,111 @@
+package transcript_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat/transcript"
+)
+
+func TestTranscript_Rotation(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "chat.log")
+	tr, err := transcript.Open(path, transcript.Options{MaxSize: 200, MaxFiles: 2})
+	is.NoErr(err)
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		room := "#general"
+		if i%2 == 1 {
+			room = "#dev"
+		}
+
+		is.NoErr(tr.Append(transcript.Entry{
+			Time: now.Add(time.Duration(i) * time.Second),
+			Room: room,
+			Text: fmt.Sprintf("[alice] message %d", i),
+		}))
+	}
+	is.NoErr(tr.Close())
+
+	// each line is 45-49 bytes - 4 lines per file and only 2 rotated files kept (12 lines total).
+	_, err = os.Stat(path + ".2")
+	is.NoErr(err)
+	_, err = os.Stat(path + ".3")
+	is.True(os.IsNotExist(err))
+
+	tr, err = transcript.Open(path, transcript.Options{MaxSize: 200, MaxFiles: 2})
+	is.NoErr(err)
+	defer func() {
+		_ = tr.Close()
+	}()
+
+	last, err := tr.Last("#general", 2)
+	is.NoErr(err)
+	is.Equal(last, []transcript.Entry{
+		{Time: now.Add(16 * time.Second), Room: "#general", Text: "[alice] message 16"},
+		{Time: now.Add(18 * time.Second), Room: "#general", Text: "[alice] message 18"},
+	})
+
+	found, err := tr.Search("#dev", "MESSAGE 1", 10)
+	is.NoErr(err)
+	is.Equal(len(found), 5) // 11 .. 19 - 1 has been rotated away
+	is.Equal(found[0].Text, "[alice] message 11")
+	is.Equal(found[4].Text, "[alice] message 19")
+
+	found, err = tr.Search("#dev", "message", 2)
+	is.NoErr(err)
+	is.Equal(len(found), 2) // the most recent matches
+	is.Equal(found[1].Text, "[alice] message 19")
+}
+
+func TestTranscript_ScanDuringAppend(t *testing.T) {
+	is := is.New(t)
+
+	path := filepath.Join(t.TempDir(), "chat.log")
+	tr, err := transcript.Open(path, transcript.Options{MaxSize: 200, MaxFiles: 2})
+	is.NoErr(err)
+	defer func() {
+		_ = tr.Close()
+	}()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 500; i++ {
+			err := tr.Append(transcript.Entry{
+				Time: now.Add(time.Duration(i) * time.Second),
+				Room: "#general",
+				Text: fmt.Sprintf("[alice] message %d", i),
+			})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		close(done)
+	}()
+
+	// the scans see whole lines in order despite the rotations
+	for {
+		last, err := tr.Last("#general", 20)
+		is.NoErr(err)
+
+		for i := 1; i < len(last); i++ {
+			is.True(last[i].Time.After(last[i-1].Time))
+		}
+
+		select {
+		case err := <-done:
+			is.NoErr(err)
+			return
+		default:
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Package web is a browser front-end of the chat. It serves a minimal HTML client and bridges
+// its WebSocket connections to the regular chat sessions, so web users and TCP users share rooms.
+package web
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"log"
+	"net/http"
+
+	"proto/task03/pkg/chat"
+	"proto/task03/pkg/chat/broker"
+	"proto/task03/pkg/chat/websocket"
+)
+
+//go:embed index.html
+var index []byte
+
+// NewHandler creates the HTTP handler serving the HTML client at / and the chat WebSocket at /ws.
+func NewHandler(ctx context.Context, b *broker.Broker) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(index)
+	})
+
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			if !errors.Is(err, websocket.ErrHandshake) {
+				log.Println("Error upgrade:", err.Error())
+			}
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		log.Printf("Accepted websocket connection from %s", conn.RemoteAddr().String())
+		chat.NewSession(b, conn.RemoteAddr()).Handle(ctx, conn)
+	})
+
+	return mux
+}
@@ -0,0 +1,165 @@
+package web_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat"
+	"proto/task03/pkg/chat/broker"
+	"proto/task03/pkg/chat/web"
+)
+
+// wsUser is a browser-like chat user for the tests.
+type wsUser struct {
+	t       *testing.T
+	conn    net.Conn
+	r       *bufio.Reader
+	pending string
+}
+
+func connect(t *testing.T, srv *httptest.Server, name string) *wsUser {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, _ = fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	u := &wsUser{t: t, conn: conn, r: r}
+	u.expect("Welcome to budgetchat! What shall I call you?")
+	u.send(name)
+
+	return u
+}
+
+// send sends the line as a masked text frame.
+func (u *wsUser) send(line string) {
+	u.t.Helper()
+
+	data := []byte(line + "\n")
+	mask := []byte{7, 8, 9, 10}
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+
+	frame := append([]byte{0x81, 0x80 | byte(len(data))}, mask...)
+	if _, err := u.conn.Write(append(frame, data...)); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+// read returns the next line, reading the text frames as needed.
+func (u *wsUser) read() string {
+	u.t.Helper()
+
+	for !strings.Contains(u.pending, "\n") {
+		var hdr [2]byte
+		if _, err := io.ReadFull(u.r, hdr[:]); err != nil {
+			u.t.Fatal(err)
+		}
+
+		payload := make([]byte, hdr[1]&0x7f)
+		if _, err := io.ReadFull(u.r, payload); err != nil {
+			u.t.Fatal(err)
+		}
+
+		u.pending += string(payload)
+	}
+
+	line, rest, _ := strings.Cut(u.pending, "\n")
+	u.pending = rest
+
+	return line
+}
+
+func (u *wsUser) expect(want string) {
+	u.t.Helper()
+
+	if got := u.read(); got != want {
+		u.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestHandler_Index(t *testing.T) {
+	is := is.New(t)
+	srv := httptest.NewServer(web.NewHandler(context.Background(), broker.New(broker.Options{})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	is.NoErr(err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	is.NoErr(err)
+	is.Equal(resp.StatusCode, http.StatusOK)
+	is.True(strings.Contains(string(body), "<title>budgetchat</title>"))
+
+	resp, err = http.Get(srv.URL + "/missing")
+	is.NoErr(err)
+	_ = resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusNotFound)
+}
+
+func TestHandler_SharedRooms(t *testing.T) {
+	b := broker.New(broker.Options{})
+	srv := httptest.NewServer(web.NewHandler(context.Background(), b))
+	defer srv.Close()
+
+	// a raw TCP user
+	server, client := net.Pipe()
+	defer func() {
+		_ = client.Close()
+	}()
+	go chat.NewSession(b, nil).Handle(context.Background(), server)
+
+	tcp := bufio.NewReader(client)
+	readTCP := func() string {
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, err := tcp.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	readTCP() // welcome
+	_, _ = fmt.Fprintln(client, "alice")
+	readTCP() // room contents
+
+	bob := connect(t, srv, "bob")
+	bob.expect("* the room contains: alice")
+
+	if got := readTCP(); got != "* bob has entered the room" {
+		t.Fatalf("got %q", got)
+	}
+
+	bob.send("hello from the browser")
+	if got := readTCP(); got != "[bob] hello from the browser" {
+		t.Fatalf("got %q", got)
+	}
+
+	_, _ = fmt.Fprintln(client, "hello from the terminal")
+	bob.expect("[alice] hello from the terminal")
+}
@@ -0,0 +1,286 @@
+// Package websocket is a minimal server side RFC 6455 implementation on top of net/http.
+// A Conn is a plain io.ReadWriteCloser: the payloads of the received data frames are read as
+// a byte stream and every write is sent as a single text frame.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505 -- mandated by RFC 6455, not used for security
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxFrameSize limits the payload of a single received frame.
+const MaxFrameSize = 64 << 10
+
+// acceptGUID is the magic value used to compute the Sec-WebSocket-Accept header.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeTimeout limits how long the close frame may take to write.
+const closeTimeout = time.Second
+
+// Opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close status codes
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+// Errors
+var (
+	ErrHandshake = errors.New("websocket: bad handshake")
+	ErrProtocol  = errors.New("websocket: protocol error")
+	ErrTooBig    = errors.New("websocket: frame is too big")
+)
+
+// Conn is a server side WebSocket connection.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	buf  []byte // unread payload of the current data frame
+
+	mu        sync.Mutex // serializes the frame writes
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Upgrade performs the opening handshake and takes over the underlying connection.
+// On failure an HTTP error response is written and ErrHandshake is returned.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return nil, ErrHandshake
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrHandshake
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, ErrHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, ErrHandshake
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: hijack: %w", err)
+	}
+
+	_, _ = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", AcceptKey(key))
+
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket: handshake: %w", err)
+	}
+
+	return &Conn{conn: conn, r: rw.Reader}, nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept header value for the client key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID)) // #nosec G401
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains returns true if the comma separated header values contain the token.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Read reads the payload of the received data frames. Control frames are handled transparently.
+// io.EOF is returned once the peer has closed the connection.
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrTooBig):
+				c.closeWith(closeTooBig)
+			case errors.Is(err, ErrProtocol):
+				c.closeWith(closeProtocolError)
+			}
+			return 0, err
+		}
+
+		switch op {
+		case opText, opBinary, opContinuation:
+			c.buf = payload
+
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, err
+			}
+
+		case opClose:
+			c.closeWith(closeNormal)
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+// Write sends p as a single text frame. Invalid UTF-8 sequences are replaced, since the browsers
+// fail the connection on invalid text frames.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opText, []byte(strings.ToValidUTF8(string(p), "\uFFFD"))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close sends the close frame (best effort) and closes the underlying connection.
+func (c *Conn) Close() error {
+	c.closeWith(closeNormal)
+	return c.closeErr
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) closeWith(code uint16) {
+	c.closeOnce.Do(func() {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.writeFrame(opClose, binary.BigEndian.AppendUint16(nil, code))
+		c.closeErr = c.conn.Close()
+	})
+}
+
+// readFrame reads a single frame and unmasks its payload. Client frames must be masked.
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	fin := hdr[0]&0x80 != 0
+	op := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	size := uint64(hdr[1] & 0x7f)
+
+	switch {
+	case hdr[0]&0x70 != 0:
+		return 0, nil, fmt.Errorf("%w: reserved bits are set", ErrProtocol)
+
+	case !masked:
+		return 0, nil, fmt.Errorf("%w: client frame is not masked", ErrProtocol)
+
+	case op >= opClose && (!fin || size > 125):
+		return 0, nil, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+
+	case op > opBinary && op < opClose || op > opPong:
+		return 0, nil, fmt.Errorf("%w: unknown opcode %d", ErrProtocol, op)
+	}
+
+	switch size {
+	case 126:
+		var ext uint16
+		if err := binary.Read(c.r, binary.BigEndian, &ext); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(ext)
+
+	case 127:
+		if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if size > MaxFrameSize {
+		return 0, nil, ErrTooBig
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return op, payload, nil
+}
+
+// writeFrame writes a single unmasked final frame.
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|op)
+
+	switch size := len(payload); {
+	case size <= 125:
+		frame = append(frame, byte(size))
+
+	case size <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+
+	frame = append(frame, payload...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.conn.Write(frame)
+	return err
+}
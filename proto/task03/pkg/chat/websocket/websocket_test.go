@@ -0,0 +1,260 @@
+package websocket_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task03/pkg/chat/websocket"
+)
+
+// client is a raw WebSocket client for the tests.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// echo upgrades the connection and writes back everything it reads.
+func echo(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, _ = io.Copy(conn, conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func dial(t *testing.T, srv *httptest.Server) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	_, _ = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got accept key %q", got)
+	}
+
+	return &client{t: t, conn: conn, r: r}
+}
+
+// send writes a single frame with the payload masked as the clients must do (unless disabled).
+func (c *client) send(header byte, payload []byte, masked bool) {
+	c.t.Helper()
+
+	frame := []byte{header}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, maskBit|byte(len(payload)))
+
+	default:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+
+	data := append([]byte(nil), payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+
+	if _, err := c.conn.Write(append(frame, data...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read reads a single server frame.
+func (c *client) read() (byte, []byte) {
+	c.t.Helper()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+
+	size := int(hdr[1] & 0x7f)
+	if size == 126 {
+		var ext uint16
+		_ = binary.Read(c.r, binary.BigEndian, &ext)
+		size = int(ext)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return hdr[0], payload
+}
+
+func TestConn_Frames(t *testing.T) {
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name   string
+		frames [][]byte // header byte followed by the payload
+		want   []byte   // expected header byte
+		data   string   // expected payload
+	}{
+		{
+			name:   "text",
+			frames: [][]byte{append([]byte{0x81}, "hello\n"...)},
+			want:   []byte{0x81},
+			data:   "hello\n",
+		},
+		{
+			name:   "extended length",
+			frames: [][]byte{append([]byte{0x81}, long...)},
+			want:   []byte{0x81},
+			data:   long,
+		},
+		{
+			name:   "ping",
+			frames: [][]byte{append([]byte{0x89}, "ping"...)},
+			want:   []byte{0x8a},
+			data:   "ping",
+		},
+		{
+			name: "fragmented",
+			frames: [][]byte{
+				append([]byte{0x01}, "frag"...),
+				append([]byte{0x80}, "mented"...),
+			},
+			want: []byte{0x81, 0x81},
+			data: "fragmented",
+		},
+		{
+			name:   "close",
+			frames: [][]byte{{0x88, 0x03, 0xe8}},
+			want:   []byte{0x88},
+			data:   "\x03\xe8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			c := dial(t, echo(t))
+
+			for _, f := range tt.frames {
+				c.send(f[0], f[1:], true)
+			}
+
+			var data string
+			for _, want := range tt.want {
+				header, payload := c.read()
+				is.Equal(header, want)
+				data += string(payload)
+			}
+
+			is.Equal(data, tt.data)
+		})
+	}
+}
+
+func TestConn_ProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  byte
+		payload []byte
+		masked  bool
+		code    uint16
+	}{
+		{name: "unmasked", header: 0x81, payload: []byte("hi"), code: 1002},
+		{name: "reserved bits", header: 0xc1, payload: []byte("hi"), masked: true, code: 1002},
+		{name: "unknown opcode", header: 0x83, payload: []byte("hi"), masked: true, code: 1002},
+		{name: "fragmented ping", header: 0x09, payload: []byte("hi"), masked: true, code: 1002},
+		{name: "too big", header: 0x81, payload: make([]byte, websocket.MaxFrameSize+1), masked: true, code: 1009},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			c := dial(t, echo(t))
+
+			if len(tt.payload) > 0xffff {
+				// 64-bit length - the server gives up before reading the payload.
+				frame := []byte{tt.header, 0x80 | 127}
+				frame = binary.BigEndian.AppendUint64(frame, uint64(len(tt.payload)))
+				_, _ = c.conn.Write(frame)
+			} else {
+				c.send(tt.header, tt.payload, tt.masked)
+			}
+
+			header, payload := c.read()
+			is.Equal(header, byte(0x88))
+			is.Equal(binary.BigEndian.Uint16(payload), tt.code)
+
+			_, err := c.r.ReadByte()
+			is.Equal(err, io.EOF) // the server has closed the connection
+		})
+	}
+}
+
+func TestUpgrade_BadHandshake(t *testing.T) {
+	is := is.New(t)
+	srv := echo(t)
+
+	resp, err := http.Get(srv.URL)
+	is.NoErr(err)
+	_ = resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusBadRequest)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	resp, err = http.DefaultClient.Do(req)
+	is.NoErr(err)
+	_ = resp.Body.Close()
+	is.Equal(resp.StatusCode, http.StatusUpgradeRequired)
+	is.Equal(resp.Header.Get("Sec-WebSocket-Version"), "13")
+}
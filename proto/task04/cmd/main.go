@@ -6,9 +6,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"proto/common/pkg/udpserver"
 	"proto/task04/pkg/database"
+	"proto/task04/pkg/database/wal"
 )
 
 const udpPort = 5000
@@ -26,21 +30,104 @@ const udpPort = 5000
 //	   port = 5000
 
 // Task04 - Unusual Database Program - https://protohackers.com/problem/4
+//
+// Optional environment variables:
+//
+//	DATA_DIR              - data directory of the persistent database (in-memory if empty)
+//	SYNC_POLICY           - when the inserts are flushed to disk: always, interval (default) or never
+//	SYNC_INTERVAL         - flush interval of the interval policy (default 1s)
+//	SNAPSHOT_INTERVAL     - how often the snapshot is taken and the log truncated (default 1m)
+//	SHARDS                - number of the store shards (default 32)
+//	TTL_PREFIX            - enables the inserts with a TTL: <prefix><ttl>:<key>=<value> (eg. "ttl:")
+//	SWEEP_INTERVAL        - how often the expired keys are removed (default 10s)
+//	MAX_KEYS              - the least recently used keys are evicted above it (unlimited if empty)
+//	STATS_KEY             - read-only key with the hit/miss/eviction statistics (eg. "stats")
+//	REPLICATION_ADDRESS   - UDP address the updates of the peers are received at (disabled if empty)
+//	PEERS                 - comma separated replication addresses of the other instances
+//	ANTI_ENTROPY_INTERVAL - how often the key digests are exchanged with the peers (default 5s)
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	db := database.New()
+	db, err := database.Open(ctx, options())
+	if err != nil {
+		log.Fatalln("Error: [Open]:", err.Error())
+	}
+	defer func() {
+		_ = db.Close()
+	}()
 
 	listen := os.Getenv("ADDRESS")
 	if listen == "" {
 		listen = fmt.Sprintf(":%d", udpPort)
 	}
 
-	err := udpserver.Listen(ctx, listen, func(ctx context.Context, w io.Writer, buf []byte) {
+	err = udpserver.Listen(ctx, listen, func(ctx context.Context, w io.Writer, buf []byte) {
 		db.Handle(ctx, w, buf)
 	})
 	if err != nil {
 		log.Println("Error: [Listen]:", err.Error())
 	}
 }
+
+func options() database.Options {
+	opts := database.Options{
+		Dir:              os.Getenv("DATA_DIR"),
+		SyncInterval:     envDuration("SYNC_INTERVAL", wal.DefaultSyncInterval),
+		SnapshotInterval: envDuration("SNAPSHOT_INTERVAL", time.Minute),
+		TTLPrefix:        os.Getenv("TTL_PREFIX"),
+		SweepInterval:    envDuration("SWEEP_INTERVAL", database.DefaultSweepInterval),
+		StatsKey:         os.Getenv("STATS_KEY"),
+		Shards:           envInt("SHARDS"),
+		MaxKeys:          envInt("MAX_KEYS"),
+
+		ReplicationAddr:     os.Getenv("REPLICATION_ADDRESS"),
+		AntiEntropyInterval: envDuration("ANTI_ENTROPY_INTERVAL", database.DefaultAntiEntropyInterval),
+	}
+
+	if v := os.Getenv("PEERS"); v != "" {
+		for _, peer := range strings.Split(v, ",") {
+			opts.Peers = append(opts.Peers, strings.TrimSpace(peer))
+		}
+	}
+
+	if v := os.Getenv("SYNC_POLICY"); v != "" {
+		policy, err := wal.ParseSyncPolicy(v)
+		if err != nil {
+			log.Fatalln("Error: invalid SYNC_POLICY:", err.Error())
+		}
+		opts.Sync = policy
+	}
+
+	return opts
+}
+
+// envInt returns the positive int value of the environment variable or 0 if not set.
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("Error: invalid %s: %s", name, v)
+	}
+
+	return n
+}
+
+// envDuration returns the duration value of the environment variable or the default if not set.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Error: invalid %s: %s", name, err.Error())
+	}
+
+	return d
+}
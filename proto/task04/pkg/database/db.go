@@ -2,44 +2,231 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"proto/task04/pkg/database/wal"
 )
 
 const (
 	version = "wierd database v1.0"
 )
 
-// DB is a wierd database implementation.
+// DefaultSweepInterval is used if the TTLs are enabled and no sweep interval is set.
+const DefaultSweepInterval = 10 * time.Second
+
+// Options configures the durability and the cache behaviour of the DB. The cache extensions are
+// disabled by default, as they reserve keys the spec allows to be used freely.
+type Options struct {
+	Dir              string         // data directory - in-memory database if empty
+	Sync             wal.SyncPolicy // when the inserts are flushed to the stable storage
+	SyncInterval     time.Duration  // flush interval of wal.SyncInterval policy
+	SnapshotInterval time.Duration  // how often the snapshot is taken - disabled if 0
+	Shards           int            // number of the store shards - DefaultShards if 0
+
+	// TTLPrefix enables the inserts with a TTL: <prefix><ttl>:<key>=<value>, where the TTL is
+	// either whole seconds or a Go duration (eg. "ttl:30:foo=bar" or "ttl:1m30s:foo=bar").
+	// Disabled if empty.
+	TTLPrefix     string
+	SweepInterval time.Duration // how often the expired keys are removed - DefaultSweepInterval if 0
+	MaxKeys       int           // the least recently used keys are evicted above it - unlimited if 0
+	StatsKey      string        // read-only key with the statistics - disabled if empty
+
+	// ReplicationAddr enables the replication: the UDP address the updates of the Peers are
+	// received at. Disabled if empty.
+	ReplicationAddr     string
+	Peers               []string      // replication addresses of the other instances
+	AntiEntropyInterval time.Duration // how often the digests are exchanged - DefaultAntiEntropyInterval if 0
+}
+
+// DB is a wierd database implementation. It is safe for concurrent use - see store for the
+// consistency guarantees.
 type DB struct {
-	store map[string]string
+	opts  Options
+	store *store
+	wal   *wal.Log     // nil for the in-memory database
+	snap  sync.RWMutex // held exclusively by the snapshot to pause the inserts
+	repl  *replicator  // nil if the replication is disabled
 }
 
-// New creates a new DB instance
+// New creates a new in-memory DB instance
 func New() *DB {
 	return &DB{
-		store: make(map[string]string),
+		store: newStore(DefaultShards, 0),
+	}
+}
+
+// Open creates a new DB instance and restores its content from the data directory (if any).
+func Open(ctx context.Context, opts Options) (*DB, error) {
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = DefaultSweepInterval
+	}
+
+	d := &DB{opts: opts, store: newStore(opts.Shards, opts.MaxKeys)}
+	if opts.TTLPrefix != "" {
+		go d.sweepLoop(ctx)
+	}
+
+	if opts.Dir != "" {
+		l, data, err := wal.Open(ctx, opts.Dir, wal.Options{Sync: opts.Sync, SyncInterval: opts.SyncInterval})
+		if err != nil {
+			return nil, err
+		}
+
+		d.store.load(data)
+		d.wal = l
+
+		if opts.SnapshotInterval > 0 {
+			go d.snapshotLoop(ctx, opts.SnapshotInterval)
+		}
+	}
+
+	if opts.ReplicationAddr != "" {
+		r, err := listenReplication(ctx, d, opts)
+		if err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+		d.repl = r
 	}
+
+	return d, nil
 }
 
 // Handle handles an UDP message
 func (d *DB) Handle(ctx context.Context, w io.Writer, buf []byte) {
 	key, value, insert := parseMessage(string(buf))
 	if insert {
-		d.store[key] = value
+		if err := d.insert(key, value); err != nil {
+			log.Println("Error insert:", err.Error())
+		}
 		return
 	}
 
 	// retrieve
-	if key == "version" {
+	switch {
+	case key == "version":
 		send(fmt.Sprintf("version=%s", version), w)
-		return
+
+	case d.opts.StatsKey != "" && key == d.opts.StatsKey:
+		s := d.Stats()
+		send(fmt.Sprintf("%s=keys=%d hits=%d misses=%d evictions=%d expired=%d",
+			key, s.Keys, s.Hits, s.Misses, s.Evictions, s.Expired), w)
+
+	default:
+		value, _ := d.store.get(key)
+		send(fmt.Sprintf("%s=%s", key, value), w)
 	}
+}
 
-	value = d.store[key]
-	send(fmt.Sprintf("%s=%s", key, value), w)
+// Stats returns the statistics of the store.
+func (d *DB) Stats() Stats {
+	return d.store.statistics()
+}
+
+// insert stores the value (once it's in the log) and forwards it to the peers.
+func (d *DB) insert(key, value string) error {
+	e := wal.Entry{Value: value}
+	if k, ttl, ok := parseTTL(d.opts.TTLPrefix, key); ok {
+		key, e.Expires = k, time.Now().Add(ttl)
+	}
+
+	e, applied, err := d.apply(key, e)
+	if err != nil || !applied {
+		return err
+	}
+
+	if d.repl != nil {
+		d.repl.forward(key, e)
+	}
+
+	return nil
+}
+
+// apply stores the entry (once it's in the log) - see store.set. Modifications of the version
+// and the stats are ignored.
+func (d *DB) apply(key string, e wal.Entry) (wal.Entry, bool, error) {
+	if key == "version" || (d.opts.StatsKey != "" && key == d.opts.StatsKey) {
+		return e, false, nil
+	}
+
+	if d.wal == nil {
+		return d.store.set(key, e, nil)
+	}
+
+	d.snap.RLock()
+	defer d.snap.RUnlock()
+
+	return d.store.set(key, e, func(e wal.Entry) error {
+		return d.wal.Append(key, e)
+	})
+}
+
+// Snapshot writes the snapshot of the store and truncates the log.
+func (d *DB) Snapshot() error {
+	if d.wal == nil {
+		return nil
+	}
+
+	// inserts are blocked until the log is truncated, otherwise they would be lost.
+	d.snap.Lock()
+	defer d.snap.Unlock()
+
+	return d.wal.Snapshot(d.store.copy())
+}
+
+// Close stops the replication and closes the log.
+func (d *DB) Close() error {
+	var errs []error
+	if d.repl != nil {
+		errs = append(errs, d.repl.close())
+	}
+
+	if d.wal != nil {
+		errs = append(errs, d.wal.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (d *DB) snapshotLoop(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			if err := d.Snapshot(); err != nil {
+				log.Println("Error snapshot:", err.Error())
+			}
+		}
+	}
+}
+
+func (d *DB) sweepLoop(ctx context.Context) {
+	tick := time.NewTicker(d.opts.SweepInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			if n := d.store.sweep(); n > 0 {
+				log.Printf("Removed %d expired keys", n)
+			}
+		}
+	}
 }
 
 func send(msg string, w io.Writer) {
@@ -63,3 +250,26 @@ func parseMessage(buf string) (string, string, bool) {
 
 	return buf[:idx], buf[idx+1:], true
 }
+
+// parseTTL splits the key of the insert with a TTL into the actual key and the TTL. Keys without
+// the prefix or with an invalid TTL are regular keys.
+func parseTTL(prefix, key string) (string, time.Duration, bool) {
+	if prefix == "" || !strings.HasPrefix(key, prefix) {
+		return key, 0, false
+	}
+
+	ttl, rest, ok := strings.Cut(key[len(prefix):], ":")
+	if !ok {
+		return key, 0, false
+	}
+
+	d, err := time.ParseDuration(ttl)
+	if n, nerr := strconv.Atoi(ttl); nerr == nil {
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || d <= 0 {
+		return key, 0, false
+	}
+
+	return rest, d, true
+}
@@ -0,0 +1,295 @@
+package database_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task04/pkg/database"
+	"proto/task04/pkg/database/wal"
+)
+
+// query sends the request datagram and returns the response (if any).
+func query(db *database.DB, req string) string {
+	var buf bytes.Buffer
+	db.Handle(context.Background(), &buf, []byte(req))
+
+	return buf.String()
+}
+
+func TestDB_Handle(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		want     string
+	}{
+		{name: "missing key", requests: []string{"foo"}, want: "foo="},
+		{name: "insert", requests: []string{"foo=bar", "foo"}, want: "foo=bar"},
+		{name: "overwrite", requests: []string{"foo=bar", "foo=baz", "foo"}, want: "foo=baz"},
+		{name: "value with equals", requests: []string{"foo=bar=baz", "foo"}, want: "foo=bar=baz"},
+		{name: "empty key", requests: []string{"=foo", ""}, want: "=foo"},
+		{name: "version", requests: []string{"version"}, want: "version=wierd database v1.0"},
+		{name: "read-only version", requests: []string{"version=hacked", "version"}, want: "version=wierd database v1.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			db := database.New()
+
+			var got string
+			for _, req := range tt.requests {
+				got = query(db, req)
+			}
+
+			is.Equal(got, tt.want)
+		})
+	}
+}
+
+func TestDB_Persistence(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := database.Options{Dir: t.TempDir(), Sync: wal.SyncNever}
+
+	db, err := database.Open(ctx, opts)
+	is.NoErr(err)
+	query(db, "foo=bar")
+	query(db, "version=hacked")
+	is.NoErr(db.Snapshot())
+	query(db, "bar=baz")
+	is.NoErr(db.Close())
+
+	db, err = database.Open(ctx, opts)
+	is.NoErr(err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	is.Equal(query(db, "foo"), "foo=bar")
+	is.Equal(query(db, "bar"), "bar=baz")
+	is.Equal(query(db, "version"), "version=wierd database v1.0")
+}
+
+func TestDB_Cache(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     database.Options
+		requests []string
+		wait     time.Duration // before the last request
+		want     string
+	}{
+		{
+			name:     "ttl disabled by default",
+			requests: []string{"ttl:60:foo=bar", "ttl:60:foo"},
+			want:     "ttl:60:foo=bar",
+		},
+		{
+			name:     "ttl insert",
+			opts:     database.Options{TTLPrefix: "ttl:"},
+			requests: []string{"ttl:60:foo=bar", "foo"},
+			want:     "foo=bar",
+		},
+		{
+			name:     "ttl expired",
+			opts:     database.Options{TTLPrefix: "ttl:"},
+			requests: []string{"ttl:20ms:foo=bar", "foo"},
+			wait:     50 * time.Millisecond,
+			want:     "foo=",
+		},
+		{
+			name:     "insert without ttl clears it",
+			opts:     database.Options{TTLPrefix: "ttl:"},
+			requests: []string{"ttl:20ms:foo=bar", "foo=baz", "foo"},
+			wait:     50 * time.Millisecond,
+			want:     "foo=baz",
+		},
+		{
+			name:     "invalid ttl is a regular key",
+			opts:     database.Options{TTLPrefix: "ttl:"},
+			requests: []string{"ttl:soon:foo=bar", "ttl:soon:foo"},
+			want:     "ttl:soon:foo=bar",
+		},
+		{
+			name:     "lru eviction",
+			opts:     database.Options{MaxKeys: 2, Shards: 1},
+			requests: []string{"a=1", "b=2", "a", "c=3", "b"},
+			want:     "b=",
+		},
+		{
+			name:     "recently used key kept",
+			opts:     database.Options{MaxKeys: 2, Shards: 1},
+			requests: []string{"a=1", "b=2", "a", "c=3", "a"},
+			want:     "a=1",
+		},
+		{
+			name:     "stats disabled by default",
+			requests: []string{"stats"},
+			want:     "stats=",
+		},
+		{
+			name:     "stats",
+			opts:     database.Options{MaxKeys: 2, Shards: 1, StatsKey: "stats"},
+			requests: []string{"a=1", "b=2", "c=3", "a", "c", "stats=hacked", "stats"},
+			want:     "stats=keys=2 hits=1 misses=1 evictions=1 expired=0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			db, err := database.Open(ctx, tt.opts)
+			is.NoErr(err)
+
+			for _, req := range tt.requests[:len(tt.requests)-1] {
+				query(db, req)
+			}
+			time.Sleep(tt.wait)
+
+			is.Equal(query(db, tt.requests[len(tt.requests)-1]), tt.want)
+		})
+	}
+}
+
+func TestDB_Sweep(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := database.Open(ctx, database.Options{TTLPrefix: "ttl:", SweepInterval: 10 * time.Millisecond})
+	is.NoErr(err)
+
+	query(db, "ttl:20ms:foo=bar")
+	query(db, "bar=baz")
+	is.Equal(db.Stats().Keys, int64(2))
+
+	time.Sleep(100 * time.Millisecond)
+
+	s := db.Stats()
+	is.Equal(s.Keys, int64(1))
+	is.Equal(s.Expired, int64(1))
+	is.Equal(s.Misses, int64(0)) // removed without a retrieve
+}
+
+func TestDB_PersistentTTL(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := database.Options{Dir: t.TempDir(), Sync: wal.SyncNever, TTLPrefix: "ttl:", MaxKeys: 2, Shards: 1}
+
+	db, err := database.Open(ctx, opts)
+	is.NoErr(err)
+	query(db, "ttl:20ms:gone=1")
+	query(db, "ttl:1h:kept=2")
+	is.NoErr(db.Snapshot())
+	query(db, "a=3")
+	query(db, "b=4") // evicts kept, but the log still has it
+	is.NoErr(db.Close())
+
+	time.Sleep(50 * time.Millisecond)
+
+	db, err = database.Open(ctx, opts)
+	is.NoErr(err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	// replaying the log applies the limit again, in the insert order
+	is.Equal(query(db, "gone"), "gone=")
+	is.Equal(query(db, "kept"), "kept=")
+	is.Equal(query(db, "a"), "a=3")
+	is.Equal(query(db, "b"), "b=4")
+}
+
+func TestDB_ConcurrentInserts(t *testing.T) {
+	is := is.New(t)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	db, err := database.Open(context.Background(), database.Options{Shards: 4})
+	is.NoErr(err)
+
+	const writers, inserts = 8, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < inserts; i++ {
+				query(db, fmt.Sprintf("shared=w%d-%d", w, i))
+				query(db, fmt.Sprintf("own%d=%d", w, i))
+				query(db, "shared")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// racing inserts: the last one processed wins, and it is one of the final values of a writer
+	// since each writer's inserts are sequential.
+	got := strings.TrimPrefix(query(db, "shared"), "shared=")
+	is.True(strings.HasSuffix(got, fmt.Sprintf("-%d", inserts-1)))
+
+	for w := 0; w < writers; w++ {
+		is.Equal(query(db, fmt.Sprintf("own%d", w)), fmt.Sprintf("own%d=%d", w, inserts-1))
+	}
+}
+
+// BenchmarkDB_Handle fires concurrent insert and retrieve datagrams (1 in 4 is an insert) over
+// a small key space for different shard counts.
+func BenchmarkDB_Handle(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const keys = 1024
+
+	inserts := make([][]byte, keys)
+	retrieves := make([][]byte, keys)
+	for i := range inserts {
+		inserts[i] = []byte(fmt.Sprintf("key%d=value%d", i, i))
+		retrieves[i] = []byte(fmt.Sprintf("key%d", i))
+	}
+
+	for _, shards := range []int{1, 8, 32, 128} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			db, err := database.Open(context.Background(), database.Options{Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var seq atomic.Int64
+			ctx := context.Background()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				n := seq.Add(1) * 7919 // each goroutine walks the key space from a different offset
+				for pb.Next() {
+					n++
+					if n%4 == 0 {
+						db.Handle(ctx, io.Discard, inserts[n%keys])
+					} else {
+						db.Handle(ctx, io.Discard, retrieves[n%keys])
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+// clock is a hybrid logical clock. The timestamps pack the physical time in unix milliseconds
+// into the upper 48 bits and a logical counter into the lower 16 bits, so they compare as plain
+// integers. They stay close to the wall clock, but unlike it they never go backwards and always
+// order an insert after every insert it could have observed (including the replicated ones).
+type clock struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func physical() uint64 {
+	return uint64(time.Now().UnixMilli()) << 16
+}
+
+// now returns a timestamp greater than any returned or observed before.
+func (c *clock) now() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last = max(c.last+1, physical())
+
+	return c.last
+}
+
+// observe advances the clock past the remote timestamp.
+func (c *clock) observe(ts uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last = max(c.last, ts)
+}
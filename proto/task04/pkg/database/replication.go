@@ -0,0 +1,325 @@
+package database
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"proto/task04/pkg/database/wal"
+)
+
+// DefaultAntiEntropyInterval is used if the replication is enabled and no interval is set.
+const DefaultAntiEntropyInterval = 5 * time.Second
+
+// digestBuckets is the number of the key space buckets compared by the anti-entropy.
+const digestBuckets = 64
+
+// Replication message types
+const (
+	msgUpdate byte = 'U' // a single insert
+	msgDigest byte = 'D' // the hashes of the digest buckets
+)
+
+// errInvalidMessage is returned for malformed replication datagrams.
+var errInvalidMessage = errors.New("invalid replication message")
+
+// replicator exchanges the inserts with the peers over its own UDP socket (the database port
+// speaks the spec protocol only). Every applied insert is forwarded to all the peers, so they
+// are expected to form a full mesh. The inserts are not acknowledged - lost datagrams are
+// repaired by the anti-entropy: each instance periodically sends its digest to the peers, and a
+// peer answers with its inserts of the buckets that differ. Both directions are covered as every
+// instance sends its own digests.
+//
+// Datagrams from addresses other than the peers are dropped. The peers send from their
+// replication address, so Peers must list exactly the addresses the peers listen at.
+type replicator struct {
+	db *DB
+	pc net.PacketConn
+
+	mu    sync.RWMutex
+	peers []*net.UDPAddr
+}
+
+func listenReplication(ctx context.Context, d *DB, opts Options) (*replicator, error) {
+	pc, err := net.ListenPacket("udp", opts.ReplicationAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for replication: %w", err)
+	}
+
+	r := &replicator{db: d, pc: pc}
+	for _, peer := range opts.Peers {
+		if err := r.addPeer(peer); err != nil {
+			_ = pc.Close()
+			return nil, err
+		}
+	}
+
+	interval := opts.AntiEntropyInterval
+	if interval <= 0 {
+		interval = DefaultAntiEntropyInterval
+	}
+
+	log.Printf("Replicating on %s to %d peers", pc.LocalAddr(), len(opts.Peers))
+
+	go r.serve(ctx)
+	go r.antiEntropyLoop(ctx, interval)
+
+	return r, nil
+}
+
+// ReplicationAddr returns the address the replication listens at, or nil if it is disabled.
+func (d *DB) ReplicationAddr() net.Addr {
+	if d.repl == nil {
+		return nil
+	}
+
+	return d.repl.pc.LocalAddr()
+}
+
+// AddPeer adds the replication address of another instance.
+func (d *DB) AddPeer(addr string) error {
+	if d.repl == nil {
+		return errors.New("replication is disabled")
+	}
+
+	return d.repl.addPeer(addr)
+}
+
+func (r *replicator) addPeer(addr string) error {
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("invalid peer %s: %w", addr, err)
+	}
+
+	r.mu.Lock()
+	r.peers = append(r.peers, ua)
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *replicator) isPeer(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, peer := range r.peers {
+		if peer.Port == ua.Port && peer.IP.Equal(ua.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *replicator) close() error {
+	err := r.pc.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// forward sends the insert to all the peers.
+func (r *replicator) forward(key string, e wal.Entry) {
+	r.broadcast(encodeUpdate(key, e))
+}
+
+func (r *replicator) broadcast(msg []byte) {
+	r.mu.RLock()
+	peers := r.peers
+	r.mu.RUnlock()
+
+	for _, peer := range peers {
+		r.send(msg, peer)
+	}
+}
+
+func (r *replicator) send(msg []byte, addr net.Addr) {
+	if _, err := r.pc.WriteTo(msg, addr); err != nil {
+		log.Printf("Error replicating to %s: %s", addr, err.Error())
+	}
+}
+
+func (r *replicator) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		_ = r.pc.Close()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := r.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println("Error replication read:", err.Error())
+			continue
+		}
+
+		if !r.isPeer(addr) {
+			log.Println("Dropping replication datagram from unknown peer", addr)
+			continue
+		}
+
+		if err := r.handle(buf[:n], addr); err != nil {
+			log.Printf("Error replication from %s: %s", addr, err.Error())
+		}
+	}
+}
+
+func (r *replicator) handle(msg []byte, from net.Addr) error {
+	if len(msg) == 0 {
+		return errInvalidMessage
+	}
+
+	switch msg[0] {
+	case msgUpdate:
+		key, e, err := decodeUpdate(msg[1:])
+		if err != nil {
+			return err
+		}
+
+		_, _, err = r.db.apply(key, e)
+		return err
+
+	case msgDigest:
+		remote, err := decodeDigest(msg[1:])
+		if err != nil {
+			return err
+		}
+
+		r.repair(remote, from)
+		return nil
+	}
+
+	return fmt.Errorf("%w: type %q", errInvalidMessage, msg[0])
+}
+
+// repair sends the local inserts of the buckets that differ from the remote digest.
+func (r *replicator) repair(remote [digestBuckets]uint64, to net.Addr) {
+	data := r.db.store.copy()
+	local := digest(data)
+
+	for _, rec := range data {
+		if b := bucket(rec.Key); local[b] != remote[b] {
+			r.send(encodeUpdate(rec.Key, rec.Entry), to)
+		}
+	}
+}
+
+func (r *replicator) antiEntropyLoop(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			r.broadcast(encodeDigest(digest(r.db.store.copy())))
+		}
+	}
+}
+
+func bucket(key string) int {
+	return int(hashKey(key) % digestBuckets)
+}
+
+// digest returns the XOR of the entry hashes per bucket, which does not depend on the order of
+// the entries.
+func digest(data []wal.Record) [digestBuckets]uint64 {
+	var res [digestBuckets]uint64
+	for _, rec := range data {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(rec.Key))
+		_, _ = h.Write(binary.AppendUvarint([]byte{0}, rec.Version))
+		_, _ = h.Write([]byte(rec.Value))
+
+		res[bucket(rec.Key)] ^= h.Sum64()
+	}
+
+	return res
+}
+
+// update format: type, uvarint version, varint expiry time in unix milliseconds (0 if none),
+// uvarint key length, key, value
+func encodeUpdate(key string, e wal.Entry) []byte {
+	var expires int64
+	if !e.Expires.IsZero() {
+		expires = e.Expires.UnixMilli()
+	}
+
+	msg := []byte{msgUpdate}
+	msg = binary.AppendUvarint(msg, e.Version)
+	msg = binary.AppendVarint(msg, expires)
+	msg = binary.AppendUvarint(msg, uint64(len(key)))
+	msg = append(msg, key...)
+
+	return append(msg, e.Value...)
+}
+
+func decodeUpdate(buf []byte) (string, wal.Entry, error) {
+	var e wal.Entry
+
+	version, n := binary.Uvarint(buf)
+	if n <= 0 || version == 0 {
+		return "", e, errInvalidMessage
+	}
+	buf = buf[n:]
+	e.Version = version
+
+	expires, n := binary.Varint(buf)
+	if n <= 0 {
+		return "", e, errInvalidMessage
+	}
+	buf = buf[n:]
+	if expires != 0 {
+		e.Expires = time.UnixMilli(expires)
+	}
+
+	klen, n := binary.Uvarint(buf)
+	if n <= 0 || klen > uint64(len(buf)-n) {
+		return "", e, errInvalidMessage
+	}
+	key := string(buf[n : n+int(klen)])
+	e.Value = string(buf[n+int(klen):])
+
+	return key, e, nil
+}
+
+// digest format: type, uint64 hash of every bucket
+func encodeDigest(d [digestBuckets]uint64) []byte {
+	msg := make([]byte, 1, 1+8*digestBuckets)
+	msg[0] = msgDigest
+	for _, h := range d {
+		msg = binary.BigEndian.AppendUint64(msg, h)
+	}
+
+	return msg
+}
+
+func decodeDigest(buf []byte) ([digestBuckets]uint64, error) {
+	var d [digestBuckets]uint64
+	if len(buf) != 8*digestBuckets {
+		return d, errInvalidMessage
+	}
+
+	for i := range d {
+		d[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+
+	return d, nil
+}
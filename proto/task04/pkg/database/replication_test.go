@@ -0,0 +1,179 @@
+package database_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task04/pkg/database"
+)
+
+// cluster opens n replicated in-memory instances on loopback. They are connected in a full mesh
+// if connect is set.
+func cluster(t *testing.T, n int, connect bool) []*database.DB {
+	t.Helper()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	dbs := make([]*database.DB, n)
+	for i := range dbs {
+		db, err := database.Open(ctx, database.Options{
+			ReplicationAddr:     "127.0.0.1:0",
+			AntiEntropyInterval: 20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = db.Close()
+		})
+
+		dbs[i] = db
+	}
+
+	if connect {
+		mesh(t, dbs)
+	}
+
+	return dbs
+}
+
+func mesh(t *testing.T, dbs []*database.DB) {
+	t.Helper()
+
+	for _, db := range dbs {
+		for _, peer := range dbs {
+			if peer != db {
+				if err := db.AddPeer(peer.ReplicationAddr().String()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// converged waits until the key has the same value on all the instances and returns it.
+func converged(t *testing.T, dbs []*database.DB, key string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		want := query(dbs[0], key)
+
+		same := true
+		for _, db := range dbs[1:] {
+			same = same && query(db, key) == want
+		}
+
+		if same && want != key+"=" {
+			return want
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has not converged", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication_Forward(t *testing.T) {
+	is := is.New(t)
+	dbs := cluster(t, 3, true)
+
+	query(dbs[1], "foo=bar")
+	is.Equal(converged(t, dbs, "foo"), "foo=bar")
+}
+
+func TestReplication_LastWriterWins(t *testing.T) {
+	is := is.New(t)
+	dbs := cluster(t, 3, true)
+
+	query(dbs[0], "foo=first")
+	is.Equal(converged(t, dbs, "foo"), "foo=first")
+
+	query(dbs[2], "foo=second")
+	is.Equal(converged(t, dbs, "foo"), "foo=second")
+}
+
+func TestReplication_ConcurrentInserts(t *testing.T) {
+	dbs := cluster(t, 3, true)
+
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := 0; n < 50; n++ {
+				query(db, fmt.Sprintf("shared=db%d-%d", i, n))
+			}
+		}()
+	}
+	wg.Wait()
+
+	converged(t, dbs, "shared")
+}
+
+func TestReplication_AntiEntropy(t *testing.T) {
+	is := is.New(t)
+	dbs := cluster(t, 2, false)
+
+	// inserted before the instances know each other, as if the datagrams were lost
+	query(dbs[0], "foo=bar")
+	query(dbs[1], "bar=baz")
+
+	mesh(t, dbs)
+
+	is.Equal(converged(t, dbs, "foo"), "foo=bar")
+	is.Equal(converged(t, dbs, "bar"), "bar=baz")
+}
+
+func TestReplication_UnknownPeer(t *testing.T) {
+	is := is.New(t)
+	dbs := cluster(t, 1, false)
+	addr := dbs[0].ReplicationAddr()
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer func() {
+		_ = peer.Close()
+	}()
+	is.NoErr(dbs[0].AddPeer(peer.LocalAddr().String()))
+
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	is.NoErr(err)
+	defer func() {
+		_ = stranger.Close()
+	}()
+
+	// update of the key foo with the version 1<<56 and no expiry
+	update := func(value string) []byte {
+		msg := []byte{'U', 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0x00, 0x03, 'f', 'o', 'o'}
+		return append(msg, value...)
+	}
+
+	_, err = peer.WriteTo(update("bar"), addr)
+	is.NoErr(err)
+	is.Equal(converged(t, dbs, "foo"), "foo=bar")
+
+	// the same version with a greater value would win, if it was accepted
+	_, err = stranger.WriteTo(update("baz"), addr)
+	is.NoErr(err)
+
+	time.Sleep(50 * time.Millisecond)
+	is.Equal(query(dbs[0], "foo"), "foo=bar")
+}
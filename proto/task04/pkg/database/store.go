@@ -0,0 +1,305 @@
+package database
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proto/task04/pkg/database/wal"
+)
+
+// DefaultShards is the default number of the store shards.
+const DefaultShards = 32
+
+// store is a map split into independently locked shards, so that the datagrams handled by
+// concurrent goroutines rarely contend for the same lock.
+//
+// Consistency: every key belongs to exactly one shard, so all the operations on a key are
+// serialized by its shard lock. Racing inserts to the same key are applied in the order they
+// acquire the lock and the last one wins; a concurrent retrieve observes either the old or the
+// new value, never a mix of both. Since UDP does not preserve the order of the datagrams, the
+// "last" insert is the last one processed by the server, not necessarily the last one sent.
+// There is no atomicity across keys.
+//
+// Versions: every insert is stamped with the hybrid logical clock under the shard lock, so the
+// versions of a key grow in the order the inserts are applied. Replicated inserts carry their
+// version and are applied only if it is newer than the current one (last writer wins, ties are
+// broken by the greater value), so the replicas converge regardless of the delivery order.
+//
+// Limits: expired keys read as missing and are removed by the retrieve or the sweep. If maxKeys
+// is set, every shard keeps its keys in the least recently used order and an insert over the
+// limit evicts the least recently used key of its own shard (or of the next non-empty one). That
+// approximates the global LRU order without a global lock.
+type store struct {
+	shards  []shard
+	maxKeys int64 // unlimited if 0
+	keys    atomic.Int64
+	stats   counters
+	clock   clock
+}
+
+type shard struct {
+	sync.Mutex // retrieves update the LRU order, so there are no read-only operations
+	data       map[string]*list.Element
+	lru        list.List // of *entry, the most recently used first
+}
+
+type entry struct {
+	key string
+	wal.Entry
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// counters of the retrieves and removals
+type counters struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+	expired   atomic.Int64
+}
+
+// Stats are the store statistics.
+type Stats struct {
+	Keys      int64 // current number of keys (including the expired ones not removed yet)
+	Hits      int64 // retrieves of existing keys
+	Misses    int64 // retrieves of missing or expired keys
+	Evictions int64 // keys removed to stay within the limit
+	Expired   int64 // expired keys removed
+}
+
+func newStore(n, maxKeys int) *store {
+	if n <= 0 {
+		n = DefaultShards
+	}
+
+	s := &store{shards: make([]shard, n), maxKeys: int64(max(maxKeys, 0))}
+	for i := range s.shards {
+		s.shards[i].data = make(map[string]*list.Element)
+	}
+
+	return s
+}
+
+// hashKey returns the FNV-1a hash of the key.
+func hashKey(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return h
+}
+
+// shard returns the index of the shard the key belongs to.
+func (s *store) shard(key string) int {
+	return int(hashKey(key) % uint32(len(s.shards)))
+}
+
+// set stores the entry once commit (if any) succeeds. commit is called with the shard locked, so
+// the commit order of the inserts to a key matches the order they are applied in.
+//
+// An entry without a version is a local insert and gets the next clock timestamp. An entry with
+// a version is a replicated one and it is discarded (reported as not applied) unless it is newer
+// than the current entry of the key. The stored entry is returned.
+func (s *store) set(key string, e wal.Entry, commit func(e wal.Entry) error) (wal.Entry, bool, error) {
+	i := s.shard(key)
+	sh := &s.shards[i]
+
+	sh.Lock()
+
+	if e.Version == 0 {
+		e.Version = s.clock.now()
+	} else {
+		if el, ok := sh.data[key]; ok {
+			if cur := el.Value.(*entry); !cur.expired(time.Now()) && !newer(e, cur.Entry) {
+				sh.Unlock()
+				return cur.Entry, false, nil
+			}
+		}
+		s.clock.observe(e.Version)
+	}
+
+	if commit != nil {
+		if err := commit(e); err != nil {
+			sh.Unlock()
+			return e, false, err
+		}
+	}
+
+	added := s.put(sh, key, e)
+
+	sh.Unlock()
+
+	if added {
+		s.evict(i, key)
+	}
+
+	return e, true, nil
+}
+
+// newer reports whether the entry a wins over the entry b.
+func newer(a, b wal.Entry) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+
+	return a.Value > b.Value
+}
+
+// put stores the entry as the most recently used one and reports whether the key is new.
+// The shard must be locked.
+func (s *store) put(sh *shard, key string, e wal.Entry) bool {
+	if el, ok := sh.data[key]; ok {
+		el.Value.(*entry).Entry = e
+		sh.lru.MoveToFront(el)
+		return false
+	}
+
+	sh.data[key] = sh.lru.PushFront(&entry{key: key, Entry: e})
+	s.keys.Add(1)
+
+	return true
+}
+
+// remove removes the element of the shard. The shard must be locked.
+func (s *store) remove(sh *shard, el *list.Element) {
+	delete(sh.data, el.Value.(*entry).key)
+	sh.lru.Remove(el)
+	s.keys.Add(-1)
+}
+
+// evict removes the least recently used keys while the store is over the limit, starting with
+// the shard i. The just inserted key is kept.
+func (s *store) evict(i int, keep string) {
+	for s.maxKeys > 0 && s.keys.Load() > s.maxKeys {
+		if !s.evictOne(i, keep) {
+			return
+		}
+	}
+}
+
+func (s *store) evictOne(start int, keep string) bool {
+	for n := 0; n < len(s.shards); n++ {
+		sh := &s.shards[(start+n)%len(s.shards)]
+
+		sh.Lock()
+		el := sh.lru.Back()
+		if el != nil && el.Value.(*entry).key != keep {
+			s.remove(sh, el)
+			s.stats.evictions.Add(1)
+			sh.Unlock()
+			return true
+		}
+		sh.Unlock()
+	}
+
+	return false
+}
+
+// get returns the value of the key and whether it exists (and is not expired).
+func (s *store) get(key string) (string, bool) {
+	sh := &s.shards[s.shard(key)]
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	el, ok := sh.data[key]
+	if !ok {
+		s.stats.misses.Add(1)
+		return "", false
+	}
+
+	e := el.Value.(*entry)
+	if e.expired(time.Now()) {
+		s.remove(sh, el)
+		s.stats.expired.Add(1)
+		s.stats.misses.Add(1)
+		return "", false
+	}
+
+	sh.lru.MoveToFront(el)
+	s.stats.hits.Add(1)
+
+	return e.Value, true
+}
+
+// sweep removes the expired keys of all the shards. It returns the number of removed keys.
+func (s *store) sweep() int {
+	var n int
+	for i := range s.shards {
+		sh := &s.shards[i]
+		now := time.Now()
+
+		sh.Lock()
+		for el := sh.lru.Back(); el != nil; {
+			prev := el.Prev()
+			if el.Value.(*entry).expired(now) {
+				s.remove(sh, el)
+				n++
+			}
+			el = prev
+		}
+		sh.Unlock()
+	}
+
+	s.stats.expired.Add(int64(n))
+
+	return n
+}
+
+// load stores the records in their order, skipping the expired ones. It is only used before the
+// store is shared.
+func (s *store) load(data []wal.Record) {
+	now := time.Now()
+	for _, rec := range data {
+		i := s.shard(rec.Key)
+		sh := &s.shards[i]
+
+		s.clock.observe(rec.Version)
+
+		if rec.Entry.Expires.IsZero() || now.Before(rec.Expires) {
+			if s.put(sh, rec.Key, rec.Entry) {
+				s.evict(i, rec.Key)
+			}
+		} else if el, ok := sh.data[rec.Key]; ok {
+			// the expired insert overwrote an older value
+			s.remove(sh, el)
+		}
+	}
+}
+
+// copy returns a copy of the whole store without the expired keys, the least recently used keys
+// of each shard first. Each shard is copied atomically, but the copy is consistent across the
+// shards only if there are no concurrent inserts.
+func (s *store) copy() []wal.Record {
+	res := make([]wal.Record, 0, s.keys.Load())
+	for i := range s.shards {
+		sh := &s.shards[i]
+		now := time.Now()
+
+		sh.Lock()
+		for el := sh.lru.Back(); el != nil; el = el.Prev() {
+			if e := el.Value.(*entry); !e.expired(now) {
+				res = append(res, wal.Record{Key: e.key, Entry: e.Entry})
+			}
+		}
+		sh.Unlock()
+	}
+
+	return res
+}
+
+func (s *store) statistics() Stats {
+	return Stats{
+		Keys:      s.keys.Load(),
+		Hits:      s.stats.hits.Load(),
+		Misses:    s.stats.misses.Load(),
+		Evictions: s.stats.evictions.Load(),
+		Expired:   s.stats.expired.Load(),
+	}
+}
@@ -0,0 +1,402 @@
+// Package wal implements the durable storage of the database: an append-only log of inserts and
+// periodic snapshots of the whole key space, after which the log is truncated.
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File names within the data directory
+const (
+	logName      = "wal.log"
+	snapshotName = "snapshot"
+)
+
+// maxRecordSize guards the recovery against allocating huge buffers for corrupt length fields.
+// UDP datagrams are limited to 64KiB anyway.
+const maxRecordSize = 1 << 20
+
+// SyncPolicy defines when the appended records are flushed to the stable storage.
+type SyncPolicy int
+
+// Sync policies
+const (
+	SyncInterval SyncPolicy = iota // fsync every Options.SyncInterval (if anything was appended)
+	SyncAlways                     // fsync after every append
+	SyncNever                      // leave it to the OS
+)
+
+// ParseSyncPolicy parses the policy name (always, interval or never).
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+
+	case "interval":
+		return SyncInterval, nil
+
+	case "never":
+		return SyncNever, nil
+	}
+
+	return SyncInterval, fmt.Errorf("unknown sync policy: %s", name)
+}
+
+// DefaultSyncInterval is used by SyncInterval policy if no interval is set.
+const DefaultSyncInterval = time.Second
+
+// Entry is a stored value with its optional expiry time and version.
+type Entry struct {
+	Value   string
+	Expires time.Time // zero if the value never expires
+	Version uint64    // hybrid logical clock timestamp of the insert
+}
+
+// Options configures the Log.
+type Options struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// Log is the write-ahead log with snapshots stored in a single directory.
+type Log struct {
+	mu    sync.Mutex
+	dir   string
+	opts  Options
+	f     *os.File
+	dirty bool // appended since the last fsync
+}
+
+// Open recovers the content of the data directory (creating it if needed) and opens the log for
+// appending. A partially written record at the tail of the log (eg. after a crash) is discarded.
+// The entries are returned in no particular order except that the log ones follow the snapshot
+// ones in the order they were appended.
+func Open(ctx context.Context, dir string, opts Options) (*Log, []Record, error) {
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := restoreSnapshot(filepath.Join(dir, snapshotName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log: %w", err)
+	}
+
+	data, err = replay(f, data)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	l := &Log{dir: dir, opts: opts, f: f}
+	if opts.Sync == SyncInterval {
+		go l.syncLoop(ctx)
+	}
+
+	return l, data, nil
+}
+
+// Record is a single key insert.
+type Record struct {
+	Key string
+	Entry
+}
+
+// Append appends the insert to the log and syncs it according to the policy.
+func (l *Log) Append(key string, e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+
+	if _, err := l.f.Write(encode(Record{Key: key, Entry: e})); err != nil {
+		return fmt.Errorf("failed to append to log: %w", err)
+	}
+
+	if l.opts.Sync == SyncAlways {
+		return l.f.Sync()
+	}
+
+	l.dirty = true
+
+	return nil
+}
+
+// Snapshot atomically replaces the snapshot with the data and truncates the log. The caller must
+// make sure no inserts are applied between capturing the data and Snapshot returning, otherwise
+// they would be lost with the truncated log.
+func (l *Log) Snapshot(data []Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+
+	path := filepath.Join(l.dir, snapshotName)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, rec := range data {
+		if _, err := w.Write(encode(rec)); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+
+	// a crash before the truncation only means the log is replayed on top of the snapshot, which
+	// yields the same state.
+	if err := l.f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+
+	l.dirty = false
+
+	return l.f.Sync()
+}
+
+// Close syncs and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := errors.Join(l.f.Sync(), l.f.Close())
+	l.f = nil
+
+	return err
+}
+
+func (l *Log) syncLoop(ctx context.Context) {
+	tick := time.NewTicker(l.opts.SyncInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			if err := l.sync(); err != nil {
+				log.Println("Error sync:", err.Error())
+			}
+		}
+	}
+}
+
+func (l *Log) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil || !l.dirty {
+		return nil
+	}
+
+	l.dirty = false
+
+	return l.f.Sync()
+}
+
+// syncDir makes the rename within the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %w", err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync data directory: %w", err)
+	}
+
+	return nil
+}
+
+func restoreSnapshot(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// the snapshot is written atomically, so any damage is a real corruption.
+	data, _, err := readRecords(bufio.NewReader(f), nil)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted snapshot: %w", err)
+	}
+
+	log.Printf("Restored %d keys from the snapshot", len(data))
+
+	return data, nil
+}
+
+// replay appends the log records to the data and truncates the log after the last valid record.
+// The file is left positioned at its end.
+func replay(f *os.File, data []Record) ([]Record, error) {
+	r := bufio.NewReader(f)
+	data, n, err := readRecords(r, data)
+	if err != nil {
+		log.Printf("Discarding the tail of the log after %d bytes: %s", n, err.Error())
+
+		if err := f.Truncate(n); err != nil {
+			return nil, fmt.Errorf("failed to truncate log: %w", err)
+		}
+	}
+
+	if _, err := f.Seek(n, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek log: %w", err)
+	}
+
+	return data, nil
+}
+
+// readRecords appends the records read until EOF to the data. It also returns the number of
+// bytes of the valid records.
+func readRecords(r io.Reader, data []Record) ([]Record, int64, error) {
+	var n int64
+	for {
+		rec, size, err := decode(r)
+		if errors.Is(err, io.EOF) {
+			return data, n, nil
+		} else if err != nil {
+			return data, n, err
+		}
+
+		data = append(data, rec)
+		n += size
+	}
+}
+
+// record format: uint32 payload length, uint32 CRC-32 of the payload,
+// payload: uvarint key length, key, varint expiry time in unix milliseconds (0 if none),
+// uvarint version, value
+func encode(rec Record) []byte {
+	var expires int64
+	if !rec.Expires.IsZero() {
+		expires = rec.Expires.UnixMilli()
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(len(rec.Key)))
+	payload = append(payload, rec.Key...)
+	payload = binary.AppendVarint(payload, expires)
+	payload = binary.AppendUvarint(payload, rec.Version)
+	payload = append(payload, rec.Value...)
+
+	buf := make([]byte, 0, 8+len(payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+
+	return append(buf, payload...)
+}
+
+// decode reads a single record. io.EOF is returned only if there is no data at all.
+func decode(r io.Reader) (Record, int64, error) {
+	var rec Record
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return rec, 0, fmt.Errorf("truncated record header: %w", err)
+		}
+		return rec, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size > maxRecordSize {
+		return rec, 0, fmt.Errorf("invalid record length %d", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, fmt.Errorf("truncated record: %w", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:]) {
+		return rec, 0, errors.New("record checksum mismatch")
+	}
+
+	klen, n := binary.Uvarint(payload)
+	if n <= 0 || klen > uint64(len(payload)-n) {
+		return rec, 0, errors.New("invalid record key length")
+	}
+	rec.Key = string(payload[n : n+int(klen)])
+	payload = payload[n+int(klen):]
+
+	expires, n := binary.Varint(payload)
+	if n <= 0 {
+		return rec, 0, errors.New("invalid record expiry")
+	}
+	if expires != 0 {
+		rec.Expires = time.UnixMilli(expires)
+	}
+	payload = payload[n:]
+
+	rec.Version, n = binary.Uvarint(payload)
+	if n <= 0 {
+		return rec, 0, errors.New("invalid record version")
+	}
+	rec.Value = string(payload[n:])
+
+	return rec, int64(len(hdr)) + int64(size), nil
+}
@@ -0,0 +1,158 @@
+package wal_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task04/pkg/database/wal"
+)
+
+// open opens the log and returns the recovered values (the last record of a key wins).
+func open(t *testing.T, dir string) (*wal.Log, map[string]string) {
+	t.Helper()
+
+	l, recs, err := wal.Open(context.Background(), dir, wal.Options{Sync: wal.SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make(map[string]string)
+	for _, rec := range recs {
+		data[rec.Key] = rec.Value
+	}
+
+	return l, data
+}
+
+func entry(value string) wal.Entry {
+	return wal.Entry{Value: value}
+}
+
+func TestLog_Recovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string) // applied to the log after the inserts
+		want   map[string]string
+	}{
+		{
+			name:   "clean",
+			damage: func(t *testing.T, path string) {},
+			want:   map[string]string{"foo": "baz", "empty": "", "a=b": "c=d"},
+		},
+		{
+			name: "torn tail",
+			damage: func(t *testing.T, path string) {
+				fi, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(path, fi.Size()-3); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"foo": "baz", "empty": ""},
+		},
+		{
+			name: "garbage tail",
+			damage: func(t *testing.T, path string) {
+				f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = f.Write([]byte{0, 0, 0, 5, 1, 2, 3, 4, 'x', 'y', 'z', 'z', 'y'})
+				_ = f.Close()
+			},
+			want: map[string]string{"foo": "baz", "empty": "", "a=b": "c=d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			dir := t.TempDir()
+
+			l, data := open(t, dir)
+			is.Equal(len(data), 0)
+
+			is.NoErr(l.Append("foo", entry("bar")))
+			is.NoErr(l.Append("foo", entry("baz")))
+			is.NoErr(l.Append("empty", entry("")))
+			is.NoErr(l.Append("a=b", entry("c=d")))
+			is.NoErr(l.Close())
+
+			tt.damage(t, filepath.Join(dir, "wal.log"))
+
+			l, data = open(t, dir)
+			is.Equal(data, tt.want)
+
+			// the damaged tail is discarded, so new records are recovered as well
+			is.NoErr(l.Append("new", entry("1")))
+			is.NoErr(l.Close())
+
+			_, data = open(t, dir)
+			is.Equal(data["new"], "1")
+			is.Equal(len(data), len(tt.want)+1)
+		})
+	}
+}
+
+func TestLog_Snapshot(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+
+	l, _ := open(t, dir)
+	is.NoErr(l.Append("foo", entry("bar")))
+	is.NoErr(l.Append("bar", entry("baz")))
+	is.NoErr(l.Snapshot([]wal.Record{{Key: "foo", Entry: entry("bar")}, {Key: "bar", Entry: entry("baz")}}))
+
+	fi, err := os.Stat(filepath.Join(dir, "wal.log"))
+	is.NoErr(err)
+	is.Equal(fi.Size(), int64(0)) // truncated
+
+	is.NoErr(l.Append("foo", entry("qux")))
+	is.NoErr(l.Close())
+
+	_, data := open(t, dir)
+	is.Equal(data, map[string]string{"foo": "qux", "bar": "baz"})
+}
+
+func TestLog_Metadata(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+
+	expires := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+
+	l, _ := open(t, dir)
+	is.NoErr(l.Append("foo", wal.Entry{Value: "bar", Expires: expires, Version: 42}))
+	is.NoErr(l.Append("bar", entry("baz")))
+	is.NoErr(l.Close())
+
+	_, recs, err := wal.Open(context.Background(), dir, wal.Options{Sync: wal.SyncAlways})
+	is.NoErr(err)
+	is.Equal(len(recs), 2)
+	is.True(recs[0].Expires.Equal(expires))
+	is.Equal(recs[0].Version, uint64(42))
+	is.True(recs[1].Expires.IsZero())
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	is := is.New(t)
+
+	for name, want := range map[string]wal.SyncPolicy{
+		"always":   wal.SyncAlways,
+		"interval": wal.SyncInterval,
+		"never":    wal.SyncNever,
+	} {
+		got, err := wal.ParseSyncPolicy(name)
+		is.NoErr(err)
+		is.Equal(got, want)
+	}
+
+	_, err := wal.ParseSyncPolicy("sometimes")
+	is.True(err != nil)
+}
@@ -2,24 +2,177 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"proto/common/pkg/tcpserver"
 	"proto/task05/pkg/proxy"
+	"proto/task05/pkg/proxy/audit"
+	"proto/task05/pkg/proxy/pool"
+	"proto/task05/pkg/proxy/rewrite"
 )
 
 const tcpPort = 8080
 
 // Task05 - Mob in the Middle - https://protohackers.com/problem/5
+//
+// Optional environment variables:
+//
+//	ADDRESS         - comma separated upstream chat servers (default localhost:8100)
+//	BALANCE         - backend selection: roundrobin (default) or leastconn
+//	CONNECT_TIMEOUT - backend connect timeout before trying the next one (default 3s)
+//	HEALTH_INTERVAL - how often the backends are checked (default 10s, disabled if negative)
+//	MAX_FAILURES    - consecutive backend errors after which it is ejected (default 3)
+//	EJECT_TIME      - how long an ejected backend is skipped (default 30s)
+//	RULES_FILE      - JSON rewrite rules reloaded on change (see package rewrite), the BogusCoin
+//	                  rules if empty
+//	IDLE_TIMEOUT    - sessions without a line for so long are closed (disabled if empty)
+//	DRAIN_TIMEOUT   - how long a side may still send after the other one's EOF (default 1s)
+//	AUDIT_FILE      - JSON lines audit log of the sessions (disabled if empty)
+//	AUDIT_MAX_SIZE  - size in bytes the audit log is rotated at (default 10MiB)
+//	AUDIT_MAX_FILES - number of the rotated audit logs kept (default 5)
+//
+// The "audit SESSION_ID" command prints the conversation of the session from the AUDIT_FILE.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := queryAudit(os.Args[2:]); err != nil {
+			log.Fatalln("Error: [Audit]:", err.Error())
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	err := tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
-		proxy.New(conn).Handle(ctx, conn)
+	backends, err := pool.New(ctx, backendAddrs(), poolOptions())
+	if err != nil {
+		log.Fatalln("Error: [Pool]:", err.Error())
+	}
+
+	rules := rewrite.NewEngine(proxy.DefaultRules())
+	if path := os.Getenv("RULES_FILE"); path != "" {
+		if rules, err = rewrite.Watch(ctx, path, rewrite.DefaultReloadInterval); err != nil {
+			log.Fatalln("Error: [Rules]:", err.Error())
+		}
+	}
+
+	opts := proxy.Options{
+		Backends:     backends,
+		Rules:        rules,
+		IdleTimeout:  envDuration("IDLE_TIMEOUT"),
+		DrainTimeout: envDuration("DRAIN_TIMEOUT"),
+	}
+	if path := os.Getenv("AUDIT_FILE"); path != "" {
+		alog, err := audit.Open(path, auditOptions())
+		if err != nil {
+			log.Fatalln("Error: [Audit]:", err.Error())
+		}
+		defer func() {
+			_ = alog.Close()
+		}()
+		opts.Audit = alog
+	}
+
+	err = tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
+		proxy.New(conn, opts).Handle(ctx, conn)
 	})
 	if err != nil {
 		log.Println("Error: [Listen]:", err.Error())
 	}
 }
+
+func backendAddrs() []string {
+	v := os.Getenv("ADDRESS")
+	if v == "" {
+		return []string{proxy.DefaultBackend}
+	}
+
+	var addrs []string
+	for _, addr := range strings.Split(v, ",") {
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+
+	return addrs
+}
+
+func poolOptions() pool.Options {
+	opts := pool.Options{
+		ConnectTimeout: envDuration("CONNECT_TIMEOUT"),
+		HealthInterval: envDuration("HEALTH_INTERVAL"),
+		EjectTime:      envDuration("EJECT_TIME"),
+	}
+
+	if v := os.Getenv("BALANCE"); v != "" {
+		strategy, err := pool.ParseStrategy(v)
+		if err != nil {
+			log.Fatalln("Error: invalid BALANCE:", err.Error())
+		}
+		opts.Strategy = strategy
+	}
+
+	opts.MaxFailures = envInt("MAX_FAILURES")
+
+	return opts
+}
+
+func auditOptions() audit.Options {
+	return audit.Options{
+		MaxSize:  int64(envInt("AUDIT_MAX_SIZE")),
+		MaxFiles: envInt("AUDIT_MAX_FILES"),
+	}
+}
+
+// queryAudit prints the conversation of the session given by the args.
+func queryAudit(args []string) error {
+	path := os.Getenv("AUDIT_FILE")
+	if len(args) != 1 || path == "" {
+		return errors.New("usage: AUDIT_FILE=<path> audit SESSION_ID")
+	}
+
+	recs, err := audit.Query(path, args[0])
+	if err != nil {
+		return err
+	}
+
+	if len(recs) == 0 {
+		return fmt.Errorf("session %s not found", args[0])
+	}
+
+	return audit.Format(os.Stdout, recs)
+}
+
+// envInt returns the positive int value of the environment variable or 0 if not set.
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("Error: invalid %s: %s", name, v)
+	}
+
+	return n
+}
+
+// envDuration returns the duration value of the environment variable or 0 if not set.
+func envDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Error: invalid %s: %s", name, err.Error())
+	}
+
+	return d
+}
@@ -1,3 +1,5 @@
 module proto/task05
 
 go 1.23.9
+
+require github.com/matryer/is v1.4.1
@@ -0,0 +1,252 @@
+// Package audit implements the audit log of the proxied sessions: JSON lines records written to a
+// size-rotated file, and the queries reconstructing the sessions.
+package audit
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record kinds
+const (
+	KindOpen  = "open"  // the session was connected to the Backend
+	KindLine  = "line"  // a proxied Line
+	KindClose = "close" // the session has ended
+)
+
+// Record is a single audit log entry.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Kind      string    `json:"kind"`
+	Direction string    `json:"direction,omitempty"` // client (to server) or server (to client)
+	Line      string    `json:"line,omitempty"`      // as sent to the peer
+	Original  string    `json:"original,omitempty"`  // as received, if rewritten
+	Client    string    `json:"client,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+}
+
+// NewSessionID returns a random session ID.
+func NewSessionID() string {
+	var buf [8]byte
+	_, _ = rand.Read(buf[:]) // never fails
+
+	return hex.EncodeToString(buf[:])
+}
+
+// Defaults used for the unset Options
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 5
+)
+
+// Options configures the Log rotation.
+type Options struct {
+	MaxSize  int64 // the file is rotated before exceeding it
+	MaxFiles int   // number of the rotated files kept: path.1 (the newest) ... path.MaxFiles
+}
+
+// Log is the audit log. It is safe for concurrent use.
+type Log struct {
+	path string
+	opts Options
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Open opens the audit log file for appending.
+func Open(path string, opts Options) (*Log, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = DefaultMaxFiles
+	}
+
+	l := &Log{path: path, opts: opts}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.f, l.size = f, fi.Size()
+
+	return nil
+}
+
+// Write appends the record, rotating the file first if it would grow over the limit.
+func (l *Log) Write(rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+
+	if l.size > 0 && l.size+int64(len(data)) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+
+	return err
+}
+
+// rotate shifts the rotated files (dropping the oldest one) and starts a new file.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	l.f = nil
+
+	for i := l.opts.MaxFiles - 1; i >= 1; i-- {
+		err := os.Rename(rotated(l.path, i), rotated(l.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	if err := os.Rename(l.path, rotated(l.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+
+	return l.open()
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
+
+func rotated(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Query returns the records of the session from the log and its rotated files, in the order they
+// were written. The rotated files are looked up until the first missing one.
+func Query(path, session string) ([]Record, error) {
+	files := []string{path}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated(path, i)); err != nil {
+			break
+		}
+		files = append(files, rotated(path, i))
+	}
+
+	var res []Record
+	for i := len(files) - 1; i >= 0; i-- {
+		recs, err := query(files[i], session)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, recs...)
+	}
+
+	return res, nil
+}
+
+func query(path, session string) ([]Record, error) {
+	f, err := os.Open(path) // #nosec G304 -- the path is the configured audit log
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var res []Record
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("invalid audit record in %s: %w", path, err)
+		}
+
+		if rec.Session == session {
+			res = append(res, rec)
+		}
+	}
+
+	return res, scanner.Err()
+}
+
+// Format writes the session conversation as a human readable transcript: the lines sent by the
+// client are marked with "-->", the ones sent by the server with "<--".
+func Format(w io.Writer, recs []Record) error {
+	for _, rec := range recs {
+		ts := rec.Time.Format("2006-01-02 15:04:05.000")
+
+		var err error
+		switch rec.Kind {
+		case KindOpen:
+			_, err = fmt.Fprintf(w, "%s session %s: client %s connected to backend %s\n", ts, rec.Session, rec.Client, rec.Backend)
+
+		case KindClose:
+			_, err = fmt.Fprintf(w, "%s session %s closed\n", ts, rec.Session)
+
+		case KindLine:
+			arrow := "-->"
+			if rec.Direction == "server" {
+				arrow = "<--"
+			}
+
+			_, err = fmt.Fprintf(w, "%s %s %s\n", ts, arrow, rec.Line)
+			if err == nil && rec.Original != "" {
+				_, err = fmt.Fprintf(w, "%s     (rewritten from: %s)\n", ts, rec.Original)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package audit_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task05/pkg/proxy/audit"
+)
+
+func TestLog_Rotation(t *testing.T) {
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := audit.Open(path, audit.Options{MaxSize: 512, MaxFiles: 3})
+	is.NoErr(err)
+
+	// two interleaved sessions, large enough to rotate several times
+	for i := 0; i < 20; i++ {
+		for _, session := range []string{"a", "b"} {
+			is.NoErr(l.Write(audit.Record{
+				Time:      time.Now(),
+				Session:   session,
+				Kind:      audit.KindLine,
+				Direction: "client",
+				Line:      fmt.Sprintf("line %d", i),
+			}))
+		}
+	}
+	is.NoErr(l.Close())
+
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2", "audit.log.3"} {
+		fi, err := os.Stat(filepath.Join(filepath.Dir(path), name))
+		is.NoErr(err)
+		is.True(fi.Size() <= 512)
+	}
+	_, err = os.Stat(path + ".4")
+	is.True(os.IsNotExist(err))
+
+	// the oldest records are rotated away, the rest is in order
+	recs, err := audit.Query(path, "b")
+	is.NoErr(err)
+	is.True(len(recs) > 0 && len(recs) < 20)
+	for i, rec := range recs {
+		is.Equal(rec.Session, "b")
+		is.Equal(rec.Line, fmt.Sprintf("line %d", 20-len(recs)+i))
+	}
+}
+
+func TestLog_Reopen(t *testing.T) {
+	is := is.New(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for _, line := range []string{"first", "second"} {
+		l, err := audit.Open(path, audit.Options{})
+		is.NoErr(err)
+		is.NoErr(l.Write(audit.Record{Session: "s", Kind: audit.KindLine, Line: line}))
+		is.NoErr(l.Close())
+	}
+
+	recs, err := audit.Query(path, "s")
+	is.NoErr(err)
+	is.Equal(len(recs), 2)
+	is.Equal(recs[1].Line, "second")
+}
+
+func TestFormat(t *testing.T) {
+	is := is.New(t)
+	ts := time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC)
+
+	var buf bytes.Buffer
+	is.NoErr(audit.Format(&buf, []audit.Record{
+		{Time: ts, Session: "s1", Kind: audit.KindOpen, Client: "10.0.0.1:5000", Backend: "chat:16963"},
+		{Time: ts, Session: "s1", Kind: audit.KindLine, Direction: "server", Line: "Welcome"},
+		{Time: ts, Session: "s1", Kind: audit.KindLine, Direction: "client", Line: "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI", Original: "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ"},
+		{Time: ts, Session: "s1", Kind: audit.KindClose},
+	}))
+
+	is.Equal(buf.String(), ""+
+		"2024-05-01 12:30:15.000 session s1: client 10.0.0.1:5000 connected to backend chat:16963\n"+
+		"2024-05-01 12:30:15.000 <-- Welcome\n"+
+		"2024-05-01 12:30:15.000 --> pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI\n"+
+		"2024-05-01 12:30:15.000     (rewritten from: pay 7F1u3wSD5RbOHQmupo9nx4TnhQ)\n"+
+		"2024-05-01 12:30:15.000 session s1 closed\n")
+}
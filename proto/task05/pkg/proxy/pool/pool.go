@@ -0,0 +1,323 @@
+// Package pool implements the pool of the proxy backends: the backend selection, active health
+// checks, connect timeouts with the failover to the next backend and passive ejection.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects the order the backends are tried in.
+type Strategy int
+
+// Strategies
+const (
+	RoundRobin Strategy = iota // rotate the starting backend with every connection
+	LeastConn                  // the backend with the least active connections first
+)
+
+// ParseStrategy parses the strategy name (roundrobin or leastconn).
+func ParseStrategy(name string) (Strategy, error) {
+	switch name {
+	case "roundrobin":
+		return RoundRobin, nil
+
+	case "leastconn":
+		return LeastConn, nil
+	}
+
+	return RoundRobin, fmt.Errorf("unknown strategy: %s", name)
+}
+
+// Defaults used for the unset Options
+const (
+	DefaultConnectTimeout = 3 * time.Second
+	DefaultHealthInterval = 10 * time.Second
+	DefaultMaxFailures    = 3
+	DefaultEjectTime      = 30 * time.Second
+)
+
+// Options configures the Pool.
+type Options struct {
+	Strategy       Strategy
+	ConnectTimeout time.Duration // of both the connections and the health checks
+	HealthInterval time.Duration // how often the backends are checked - disabled if negative
+	MaxFailures    int           // consecutive errors after which a backend is ejected
+	EjectTime      time.Duration // how long an ejected backend is skipped
+
+	// Dial connects to the backend address (a TCP connection with the ConnectTimeout if nil).
+	// The context is canceled after the ConnectTimeout.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// ErrNoBackend is returned if no backend could be connected.
+var ErrNoBackend = errors.New("no backend available")
+
+// Pool is a set of the backends. It is safe for concurrent use.
+//
+// A backend is skipped while it fails the health checks or is ejected after MaxFailures
+// consecutive connect or read errors. If all the backends are skipped, all of them are tried
+// anyway - a possibly broken backend is better than none.
+type Pool struct {
+	opts Options
+
+	mu       sync.Mutex
+	backends []*backend
+	next     int // round-robin position
+}
+
+type backend struct {
+	addr     string
+	active   int
+	failures int
+	healthy  bool
+	ejected  time.Time // until
+}
+
+// New creates a pool of the backend addresses and starts the health checks.
+func New(ctx context.Context, addrs []string, opts Options) (*Pool, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no backends")
+	}
+
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	if opts.HealthInterval == 0 {
+		opts.HealthInterval = DefaultHealthInterval
+	}
+	if opts.MaxFailures <= 0 {
+		opts.MaxFailures = DefaultMaxFailures
+	}
+	if opts.EjectTime <= 0 {
+		opts.EjectTime = DefaultEjectTime
+	}
+	if opts.Dial == nil {
+		opts.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+
+	p := &Pool{opts: opts}
+	for _, addr := range addrs {
+		p.backends = append(p.backends, &backend{addr: addr, healthy: true})
+	}
+
+	if opts.HealthInterval > 0 {
+		go p.healthLoop(ctx)
+	}
+
+	return p, nil
+}
+
+// Conn is a connection to a backend. Closing it releases the backend.
+type Conn struct {
+	net.Conn
+	pool    *Pool
+	backend *backend
+	once    sync.Once
+	failed  atomic.Bool // a read error has been counted
+}
+
+// Backend returns the address of the backend.
+func (c *Conn) Backend() string {
+	return c.backend.addr
+}
+
+// Read reads from the backend. Errors other than the end of the stream count as the backend
+// failures.
+func (c *Conn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+		c.failed.Store(true)
+		c.pool.failed(c.backend, err)
+	}
+
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the connection (if supported, otherwise it closes
+// the connection), so the backend reads EOF.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// Close closes the connection and releases the backend. A session closed without a read error
+// resets the consecutive failures of the backend.
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.pool.release(c.backend, !c.failed.Load())
+	})
+
+	return c.Conn.Close()
+}
+
+// Dial connects to a backend selected by the strategy. If the connection fails or times out, the
+// next backend is tried, until all of them have been tried once.
+func (p *Pool) Dial(ctx context.Context) (*Conn, error) {
+	for _, b := range p.candidates() {
+		conn, err := p.dial(ctx, b.addr)
+		if err != nil {
+			p.failed(b, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		p.acquire(b)
+
+		return &Conn{Conn: conn, pool: p, backend: b}, nil
+	}
+
+	return nil, ErrNoBackend
+}
+
+func (p *Pool) dial(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.opts.ConnectTimeout)
+	defer cancel()
+
+	return p.opts.Dial(ctx, addr)
+}
+
+// candidates returns the backends in the order they should be tried.
+func (p *Pool) candidates() []*backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	n := len(p.backends)
+
+	res := make([]*backend, 0, n)
+	for i := 0; i < n; i++ {
+		b := p.backends[(p.next+i)%n]
+		if b.healthy && now.After(b.ejected) {
+			res = append(res, b)
+		}
+	}
+	p.next = (p.next + 1) % n
+
+	if len(res) == 0 {
+		for i := 0; i < n; i++ {
+			res = append(res, p.backends[(p.next+i)%n])
+		}
+	}
+
+	if p.opts.Strategy == LeastConn {
+		sort.SliceStable(res, func(i, j int) bool {
+			return res[i].active < res[j].active
+		})
+	}
+
+	return res
+}
+
+func (p *Pool) acquire(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.active++
+}
+
+// release releases the backend. The failures are reset only by a clean session, not by the
+// connect - a backend accepting the connections and failing all the sessions gets ejected too.
+func (p *Pool) release(b *backend, clean bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.active--
+	if clean {
+		b.failures = 0
+	}
+}
+
+// failed records the backend error and ejects the backend after too many consecutive ones.
+func (p *Pool) failed(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b.failures++
+	log.Printf("Backend %s error (%d in a row): %s", b.addr, b.failures, err.Error())
+
+	if b.failures >= p.opts.MaxFailures {
+		b.failures = 0
+		b.ejected = time.Now().Add(p.opts.EjectTime)
+		log.Printf("Backend %s ejected for %s", b.addr, p.opts.EjectTime)
+	}
+}
+
+// Status is the state of a backend.
+type Status struct {
+	Addr    string
+	Active  int  // number of the open connections
+	Healthy bool // passed the last health check
+	Ejected bool
+}
+
+// Status returns the state of the backends.
+func (p *Pool) Status() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+
+	res := make([]Status, 0, len(p.backends))
+	for _, b := range p.backends {
+		res = append(res, Status{Addr: b.addr, Active: b.active, Healthy: b.healthy, Ejected: now.Before(b.ejected)})
+	}
+
+	return res
+}
+
+func (p *Pool) healthLoop(ctx context.Context) {
+	tick := time.NewTicker(p.opts.HealthInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			p.checkHealth(ctx)
+		}
+	}
+}
+
+// checkHealth connects to every backend concurrently and updates their health.
+func (p *Pool) checkHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := p.dial(ctx, b.addr)
+			if err == nil {
+				_ = conn.Close()
+			}
+
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			if healthy := err == nil; healthy != b.healthy {
+				b.healthy = healthy
+				log.Printf("Backend %s healthy: %t", b.addr, healthy)
+			}
+		}()
+	}
+	wg.Wait()
+}
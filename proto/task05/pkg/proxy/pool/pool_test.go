@@ -0,0 +1,259 @@
+package pool_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task05/pkg/proxy/pool"
+)
+
+// backend starts a TCP listener accepting (and holding) the connections.
+func backend(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// resetting starts a TCP listener accepting the connections and resetting them on the first
+// request.
+func resetting(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = conn.Read(make([]byte, 1))
+				_ = conn.(*net.TCPConn).SetLinger(0) // RST on close
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// dead returns an address nobody listens at.
+func dead(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	return l.Addr().String()
+}
+
+func quiet(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func newPool(t *testing.T, addrs []string, opts pool.Options) *pool.Pool {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	if opts.HealthInterval == 0 {
+		opts.HealthInterval = -1
+	}
+
+	p, err := pool.New(ctx, addrs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// dial connects n times and returns the backends, keeping the connections open.
+func dial(t *testing.T, p *pool.Pool, n int) []string {
+	t.Helper()
+
+	var res []string
+	for i := 0; i < n; i++ {
+		conn, err := p.Dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		res = append(res, conn.Backend())
+	}
+
+	return res
+}
+
+func TestPool_Strategy(t *testing.T) {
+	quiet(t)
+	a, b := backend(t), backend(t)
+
+	// 4 connections spread over a and b, then the ones to a are closed before 2 more dials
+	tests := []struct {
+		name     string
+		strategy pool.Strategy
+		want     []string
+	}{
+		{name: "round robin", strategy: pool.RoundRobin, want: []string{a, b}},
+		{name: "least conn", strategy: pool.LeastConn, want: []string{a, a}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			p := newPool(t, []string{a, b}, pool.Options{Strategy: tt.strategy})
+
+			var conns []*pool.Conn
+			for i := 0; i < 4; i++ {
+				conn, err := p.Dial(context.Background())
+				is.NoErr(err)
+				is.Equal(conn.Backend(), []string{a, b}[i%2])
+				conns = append(conns, conn)
+			}
+
+			for _, conn := range conns {
+				if conn.Backend() == a {
+					_ = conn.Close()
+				} else {
+					t.Cleanup(func() {
+						_ = conn.Close()
+					})
+				}
+			}
+
+			is.Equal(dial(t, p, len(tt.want)), tt.want)
+		})
+	}
+}
+
+func TestPool_Failover(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+
+	live := backend(t)
+	p := newPool(t, []string{dead(t), live}, pool.Options{MaxFailures: 2, EjectTime: time.Minute})
+
+	// the dead backend is tried first every other time until it is ejected
+	is.Equal(dial(t, p, 4), []string{live, live, live, live})
+
+	status := p.Status()
+	is.True(status[0].Ejected)
+	is.True(!status[1].Ejected)
+	is.Equal(status[1].Active, 4)
+}
+
+func TestPool_SessionFailures(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+
+	p := newPool(t, []string{resetting(t)}, pool.Options{MaxFailures: 2, EjectTime: time.Minute})
+
+	// the connects succeed, but every session is reset
+	for i := 0; i < 2; i++ {
+		is.True(!p.Status()[0].Ejected)
+
+		conn, err := p.Dial(context.Background())
+		is.NoErr(err)
+
+		_, err = conn.Write([]byte{'x'})
+		is.NoErr(err)
+		_, err = conn.Read(make([]byte, 1))
+		is.True(err != nil && !errors.Is(err, io.EOF))
+		_ = conn.Close()
+	}
+
+	is.True(p.Status()[0].Ejected)
+}
+
+func TestPool_NoBackend(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+
+	p := newPool(t, []string{dead(t), dead(t)}, pool.Options{ConnectTimeout: time.Second})
+
+	_, err := p.Dial(context.Background())
+	is.True(errors.Is(err, pool.ErrNoBackend))
+}
+
+func TestPool_HealthChecks(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+
+	live, down := backend(t), dead(t)
+	p := newPool(t, []string{down, live}, pool.Options{HealthInterval: 10 * time.Millisecond})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Status()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("dead backend still healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.True(p.Status()[1].Healthy)
+
+	// the unhealthy backend is skipped without a connect attempt, so it's not ejected either
+	is.Equal(dial(t, p, 2), []string{live, live})
+	is.True(!p.Status()[0].Ejected)
+}
+
+func TestParseStrategy(t *testing.T) {
+	is := is.New(t)
+
+	for name, want := range map[string]pool.Strategy{
+		"roundrobin": pool.RoundRobin,
+		"leastconn":  pool.LeastConn,
+	} {
+		got, err := pool.ParseStrategy(name)
+		is.NoErr(err)
+		is.Equal(got, want)
+	}
+
+	_, err := pool.ParseStrategy("random")
+	is.True(err != nil)
+}
@@ -1,129 +1,184 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"io"
 	"log"
 	"net"
-	"os"
+	"time"
 
-	"proto/common/pkg/iotools"
+	"proto/task05/pkg/proxy/audit"
+	"proto/task05/pkg/proxy/pool"
+	"proto/task05/pkg/proxy/rewrite"
 )
 
-// Proxy is a BogusCoin proxy
+// DefaultBackend is the upstream chat server used if no backends are given.
+const DefaultBackend = "localhost:8100"
+
+// Options configures the Proxy. All of them are shared by the sessions.
+type Options struct {
+	Backends *pool.Pool      // DefaultBackend if nil
+	Rules    *rewrite.Engine // DefaultRules if nil
+	Audit    Auditor         // no audit if nil
+
+	IdleTimeout  time.Duration // the session is closed after no line for so long - disabled if 0
+	DrainTimeout time.Duration // how long the other side may still send after EOF - DefaultDrainTimeout if 0
+}
+
+// Auditor records the session events - an *audit.Log.
+type Auditor interface {
+	Write(rec audit.Record) error
+}
+
+// Proxy is a line rewriting proxy of a single session - a BogusCoin one with the default rules.
 type Proxy struct {
 	rw      io.ReadWriter
-	backend string
+	opts    Options
+	session string
 }
 
 // EvilAddr where to send stolen monies ;)
 var EvilAddr = []byte("7YWHMfk9JZe0LM0g1ZauHuiSxhI")
 
-// New creates a new Proxy instance.
-func New(rw io.ReadWriter) *Proxy {
-	backend := os.Getenv("ADDRESS")
-	if backend == "" {
-		backend = "localhost:8100"
+// DefaultRules returns the BogusCoin rule set: every address is replaced with the EvilAddr.
+func DefaultRules() rewrite.Rules {
+	return rewrite.Default(string(EvilAddr))
+}
+
+// New creates a new Proxy instance with a new session ID.
+func New(rw io.ReadWriter, opts Options) *Proxy {
+	if opts.Backends == nil {
+		// cannot fail with a backend given; no health checks, so no context needed
+		opts.Backends, _ = pool.New(context.Background(), []string{DefaultBackend}, pool.Options{HealthInterval: -1})
+	}
+
+	if opts.Rules == nil {
+		opts.Rules = rewrite.NewEngine(DefaultRules())
 	}
 
-	return &Proxy{rw: rw, backend: backend}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = DefaultDrainTimeout
+	}
+
+	return &Proxy{rw: rw, opts: opts, session: audit.NewSessionID()}
+}
+
+// Session returns the session ID (as recorded in the audit log).
+func (p *Proxy) Session() string {
+	return p.session
 }
 
-// Handle handles the proxy connection
+// Handle handles the proxy connection. When either side finishes sending, EOF is propagated to
+// the other one (with CloseWrite if supported) and its remaining lines are proxied for up to the
+// DrainTimeout, then both connections are closed. Idle sessions are closed as well.
 func (p *Proxy) Handle(ctx context.Context, fe io.ReadWriter) {
+	start := time.Now()
+
 	be, err := p.connect(ctx)
 	if err != nil {
 		return
 	}
-	defer func() {
-		_ = be.Close()
-	}()
 
-	go handleLines(ctx, be, fe)
-	handleLines(ctx, fe, be)
-}
+	s := &session{fe: fe, be: be}
+	s.touch()
 
-func (p *Proxy) connect(ctx context.Context) (net.Conn, error) {
-	log.Println("Connecting to", p.backend)
-	be, err := net.Dial("tcp", p.backend)
-	if err != nil {
-		log.Println("Error client dial:", err.Error())
-		return nil, err
-	}
+	done := make(chan flow, 2)
+	go func() {
+		done <- p.pump(s, be, fe, rewrite.ServerToClient)
+	}()
+	go func() {
+		done <- p.pump(s, fe, be, rewrite.ClientToServer)
+	}()
 
-	return be, nil
-}
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.watch(ctx, s, stop)
 
-func handleLines(ctx context.Context, from, to io.ReadWriter) {
-	for line := range iotools.GetLineStrict(ctx, from) {
-		if len(line) == 0 {
-			continue
-		}
+	flows := make(map[rewrite.Direction]flow, 2)
 
-		idx, sz := 0, 0
-		for {
-			idx, sz = findAddress(line, idx+sz)
-			if idx == -1 {
-				break
-			}
-
-			addr := line[idx : idx+sz]
+	first := <-done
+	flows[first.dir] = first
 
-			if !bytes.Equal(addr, EvilAddr) {
-				log.Printf("rewriting %s with %s", addr, EvilAddr)
-				line = bytes.ReplaceAll(line, addr, EvilAddr)
+	to := io.Writer(be)
+	if first.dir == rewrite.ServerToClient {
+		to = fe
+	}
 
-				// adjust index since we updated the string
-				idx -= len(addr) - len(EvilAddr)
-			}
+	if first.err == nil && closeWrite(to) {
+		timer := time.NewTimer(p.opts.DrainTimeout)
+		select {
+		case f := <-done:
+			flows[f.dir] = f
+		case <-timer.C:
 		}
+		timer.Stop()
+	}
 
-		if _, err := to.Write(append(line, '\n')); err != nil {
-			log.Println("Error handleLines:", err.Error())
-		}
+	s.teardown(first.end())
+
+	if len(flows) < 2 {
+		f := <-done
+		flows[f.dir] = f
 	}
+
+	p.summary(s, start, flows)
+	p.audit(audit.Record{Kind: audit.KindClose})
 }
 
-// returns index and length or -1 as index if not found
-// laborous version - perhaps should try my luck with regexp.
-func findAddress(line []byte, i int) (int, int) {
-	start := -1
+// watch tears down the session once it is idle for too long or the proxy is stopped.
+func (p *Proxy) watch(ctx context.Context, s *session, stop <-chan struct{}) {
+	var tick <-chan time.Time
+	if p.opts.IdleTimeout > 0 {
+		t := time.NewTicker(max(p.opts.IdleTimeout/4, 10*time.Millisecond))
+		defer t.Stop()
+		tick = t.C
+	}
 
-	for ; i < len(line); i++ {
-		ch := line[i]
+	for {
+		select {
+		case <-stop:
+			return
 
-		// if not within a token AND found a start of a token - mark it and advance
-		if start < 0 && ch == '7' && (i == 0 || line[i-1] == ' ') {
-			start = i
-			continue
-		}
+		case <-ctx.Done():
+			s.teardown("proxy stopped")
+			return
 
-		// if not within a token OR within a token AND on legit chars - advance
-		if start < 0 ||
-			('a' <= ch && ch <= 'z') ||
-			('A' <= ch && ch <= 'Z') ||
-			('0' <= ch && ch <= '9') {
-			continue
+		case <-tick:
+			if s.idle() >= p.opts.IdleTimeout {
+				s.teardown("idle timeout")
+				return
+			}
 		}
+	}
+}
 
-		// if we're here - we have been within a token AND found a non-legit char - handle buffer
-		sz := i - start
-		if ch == ' ' && 26 <= sz && sz <= 35 {
-			return start, sz
-		}
+func (p *Proxy) connect(ctx context.Context) (net.Conn, error) {
+	be, err := p.opts.Backends.Dial(ctx)
+	if err != nil {
+		log.Println("Error client dial:", err.Error())
+		return nil, err
+	}
 
-		// the collected token isn't valid - reset
-		start = -1
+	client := "client"
+	if conn, ok := p.rw.(net.Conn); ok {
+		client = conn.RemoteAddr().String()
 	}
+	log.Printf("Session %s: %s connected to backend %s", p.session, client, be.Backend())
+	p.audit(audit.Record{Kind: audit.KindOpen, Client: client, Backend: be.Backend()})
 
-	// found the end of line and have a token buffer - deal with it
-	if start > -1 {
-		sz := i - start
-		if 26 <= sz && sz <= 35 {
-			return start, sz
-		}
+	return be, nil
+}
+
+// audit writes the record of the session to the audit log (if any).
+func (p *Proxy) audit(rec audit.Record) {
+	if p.opts.Audit == nil {
+		return
 	}
 
-	return -1, -1
+	rec.Time = time.Now()
+	rec.Session = p.session
+
+	if err := p.opts.Audit.Write(rec); err != nil {
+		log.Println("Error audit:", err.Error())
+	}
 }
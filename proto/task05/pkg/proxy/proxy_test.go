@@ -0,0 +1,338 @@
+package proxy_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task05/pkg/proxy"
+	"proto/task05/pkg/proxy/audit"
+	"proto/task05/pkg/proxy/pool"
+)
+
+// pipeConn is an in-memory connection supporting the half-close, unlike net.Pipe.
+type pipeConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+// halfPipe returns both ends of an in-memory connection supporting the half-close.
+func halfPipe() (net.Conn, net.Conn) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+
+	return &pipeConn{r: ar, w: aw}, &pipeConn{r: br, w: bw}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *pipeConn) CloseWrite() error           { return c.w.Close() }
+
+func (c *pipeConn) Close() error {
+	_ = c.w.Close()
+	return c.r.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr              { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr             { return pipeAddr{} }
+func (c *pipeConn) SetDeadline(time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// memoryAudit records the audit records in memory.
+type memoryAudit struct {
+	mu   sync.Mutex
+	recs []audit.Record
+}
+
+func (a *memoryAudit) Write(rec audit.Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.recs = append(a.recs, rec)
+
+	return nil
+}
+
+func (a *memoryAudit) records() []audit.Record {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]audit.Record(nil), a.recs...)
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// session runs the proxy between the in-memory client and server connections. It returns the
+// test ends of both and a channel closed once the proxy is done.
+func session(t *testing.T, opts proxy.Options, pipe func() (net.Conn, net.Conn)) (net.Conn, net.Conn, <-chan struct{}) {
+	t.Helper()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	fe, client := pipe()
+	be, server := pipe()
+
+	backends, err := pool.New(ctx, []string{"memory"}, pool.Options{
+		HealthInterval: -1,
+		Dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return be, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Backends = backends
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.New(fe, opts).Handle(ctx, fe)
+	}()
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server, done
+}
+
+// readAll reads the connection until EOF (or an error) with a timeout.
+func readAll(t *testing.T, conn net.Conn) string {
+	t.Helper()
+
+	ch := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(conn)
+		ch <- data
+	}()
+
+	select {
+	case data := <-ch:
+		return string(data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read timed out")
+		return ""
+	}
+}
+
+// write sends the data. It may be called from any goroutine.
+func write(t *testing.T, conn net.Conn, data string) {
+	t.Helper()
+
+	if _, err := io.WriteString(conn, data); err != nil {
+		t.Error(err)
+	}
+}
+
+func wait(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not torn down")
+	}
+}
+
+func TestProxy_Rewrite(t *testing.T) {
+	is := is.New(t)
+	client, server, done := session(t, proxy.Options{}, net.Pipe)
+
+	go write(t, client, "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ please\n")
+
+	r := bufio.NewReader(server)
+	line, err := r.ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI please\n")
+
+	go write(t, server, "* 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX joined\n")
+
+	line, err = bufio.NewReader(client).ReadString('\n')
+	is.NoErr(err)
+	is.Equal(line, "* 7YWHMfk9JZe0LM0g1ZauHuiSxhI joined\n")
+
+	_ = client.Close()
+	wait(t, done)
+}
+
+func TestProxy_LineEndings(t *testing.T) {
+	is := is.New(t)
+	client, server, done := session(t, proxy.Options{}, net.Pipe)
+	r := bufio.NewReader(server)
+
+	tests := []struct {
+		in, want string
+	}{
+		{in: "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ\r\n", want: "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI\r\n"},
+		{in: "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ\n", want: "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI\n"},
+		{in: "hello\r\n", want: "hello\r\n"},
+	}
+
+	for _, tt := range tests {
+		go write(t, client, tt.in)
+
+		line, err := r.ReadString('\n')
+		is.NoErr(err)
+		is.Equal(line, tt.want)
+	}
+
+	_ = client.Close()
+	wait(t, done)
+}
+
+func TestProxy_Audit(t *testing.T) {
+	is := is.New(t)
+
+	rec := &memoryAudit{}
+	client, server, done := session(t, proxy.Options{Audit: rec}, net.Pipe)
+	cr, sr := bufio.NewReader(client), bufio.NewReader(server)
+
+	// one line at a time, so the records are in a known order
+	for _, tt := range []struct {
+		from net.Conn
+		to   *bufio.Reader
+		line string
+	}{
+		{from: client, to: sr, line: "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ please\n"},
+		{from: client, to: sr, line: "hello\n"},
+		{from: server, to: cr, line: "* 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX joined\n"},
+	} {
+		go write(t, tt.from, tt.line)
+		_, err := tt.to.ReadString('\n')
+		is.NoErr(err)
+	}
+
+	_ = client.Close()
+	wait(t, done)
+
+	recs := rec.records()
+	is.Equal(len(recs), 5)
+
+	id := recs[0].Session
+	is.True(id != "")
+	for i := range recs {
+		is.True(!recs[i].Time.IsZero())
+		is.Equal(recs[i].Session, id) // all the records of the session
+		recs[i].Time, recs[i].Session = time.Time{}, ""
+	}
+
+	is.Equal(recs, []audit.Record{
+		{Kind: audit.KindOpen, Client: "pipe", Backend: "memory"},
+		{
+			Kind:      audit.KindLine,
+			Direction: "client",
+			Line:      "pay 7YWHMfk9JZe0LM0g1ZauHuiSxhI please",
+			Original:  "pay 7F1u3wSD5RbOHQmupo9nx4TnhQ please",
+		},
+		{Kind: audit.KindLine, Direction: "client", Line: "hello"},
+		{
+			Kind:      audit.KindLine,
+			Direction: "server",
+			Line:      "* 7YWHMfk9JZe0LM0g1ZauHuiSxhI joined",
+			Original:  "* 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX joined",
+		},
+		{Kind: audit.KindClose},
+	})
+}
+
+func TestProxy_Teardown(t *testing.T) {
+	tests := []struct {
+		name       string
+		pipe       func() (net.Conn, net.Conn)
+		client     string // sent by the client before it disconnects
+		wantServer string // everything the server reads
+	}{
+		{name: "client disconnects", pipe: net.Pipe, client: "hello\n", wantServer: "hello\n"},
+		{name: "unterminated line dropped", pipe: net.Pipe, client: "hello\npartial", wantServer: "hello\n"},
+		{name: "empty lines skipped", pipe: net.Pipe, client: "\n\r\nhello\n", wantServer: "hello\n"},
+		{name: "crlf kept", pipe: net.Pipe, client: "hello\r\n", wantServer: "hello\r\n"},
+		{name: "half-close", pipe: halfPipe, client: "hello\npartial", wantServer: "hello\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			client, server, done := session(t, proxy.Options{}, tt.pipe)
+
+			go func() {
+				write(t, client, tt.client)
+				_ = client.Close()
+			}()
+
+			// the server reads EOF once the client is gone
+			is.Equal(readAll(t, server), tt.wantServer)
+			wait(t, done)
+		})
+	}
+}
+
+func TestProxy_ServerDisconnects(t *testing.T) {
+	is := is.New(t)
+	client, server, done := session(t, proxy.Options{}, net.Pipe)
+
+	go func() {
+		write(t, server, "bye\n")
+		_ = server.Close()
+	}()
+
+	is.Equal(readAll(t, client), "bye\n")
+	wait(t, done)
+}
+
+func TestProxy_Drain(t *testing.T) {
+	is := is.New(t)
+	client, server, done := session(t, proxy.Options{DrainTimeout: 5 * time.Second}, halfPipe)
+
+	write(t, client, "last words\n")
+	is.NoErr(client.(*pipeConn).CloseWrite())
+
+	// the server gets EOF, but can still answer the client
+	is.Equal(readAll(t, server), "last words\n")
+	go func() {
+		write(t, server, "noted\n")
+		_ = server.Close()
+	}()
+
+	is.Equal(readAll(t, client), "noted\n")
+	wait(t, done)
+}
+
+func TestProxy_DrainTimeout(t *testing.T) {
+	is := is.New(t)
+	client, server, done := session(t, proxy.Options{DrainTimeout: 50 * time.Millisecond}, halfPipe)
+
+	is.NoErr(client.(*pipeConn).CloseWrite())
+	is.Equal(readAll(t, server), "")
+
+	// the server never closes, but the session is torn down anyway
+	wait(t, done)
+	is.Equal(readAll(t, client), "")
+}
+
+func TestProxy_IdleTimeout(t *testing.T) {
+	is := is.New(t)
+	client, server, done := session(t, proxy.Options{IdleTimeout: 50 * time.Millisecond}, net.Pipe)
+
+	wait(t, done)
+	is.Equal(readAll(t, client), "")
+	is.Equal(readAll(t, server), "")
+}
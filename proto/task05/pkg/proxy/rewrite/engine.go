@@ -0,0 +1,95 @@
+package rewrite
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReloadInterval is how often Watch checks the rules file for changes.
+const DefaultReloadInterval = time.Second
+
+// Engine holds the current rule set. It is safe for concurrent use, so the rules can be replaced
+// while the connections are being proxied - the lines already being rewritten keep the old set.
+type Engine struct {
+	rules atomic.Pointer[Rules]
+}
+
+// NewEngine creates an engine with the rule set.
+func NewEngine(rs Rules) *Engine {
+	e := &Engine{}
+	e.Set(rs)
+
+	return e
+}
+
+// Set replaces the rule set.
+func (e *Engine) Set(rs Rules) {
+	e.rules.Store(&rs)
+}
+
+// Apply applies the current rules to the n-th line (starting with 1) sent in the direction.
+func (e *Engine) Apply(dir Direction, n int, line []byte) []byte {
+	return e.rules.Load().Apply(dir, n, line)
+}
+
+// Watch loads the rules file and reloads it whenever its modification time or size changes.
+// An invalid file fails the initial load, later the previous rules are kept until it's fixed.
+func Watch(ctx context.Context, path string, interval time.Duration) (*Engine, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded %d rules from %s", len(rs), path)
+
+	e := NewEngine(rs)
+	go e.watch(ctx, path, interval, fi)
+
+	return e, nil
+}
+
+func (e *Engine) watch(ctx context.Context, path string, interval time.Duration, last os.FileInfo) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Println("Error rules stat:", err.Error())
+			continue
+		}
+
+		if fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+
+		rs, err := Load(path)
+		if err != nil {
+			log.Println("Error rules reload, keeping the previous rules:", err.Error())
+			continue
+		}
+
+		e.Set(rs)
+		log.Printf("Reloaded %d rules from %s", len(rs), path)
+	}
+}
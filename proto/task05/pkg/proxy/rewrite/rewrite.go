@@ -0,0 +1,287 @@
+// Package rewrite implements the line rewriting rules of the proxy.
+//
+// The rules file is a JSON array of rules applied in order to every proxied line:
+//
+//	[
+//	  {"type": "boguscoin", "replace": "7YWHMfk9JZe0LM0g1ZauHuiSxhI"},
+//	  {"type": "literal", "match": "hello", "replace": "bye", "direction": "client", "lines": "1-3"},
+//	  {"type": "regex", "match": "[0-9]+", "replace": "<$0>", "direction": "server"}
+//	]
+//
+// Rule types:
+//   - literal - replaces every occurrence of the match
+//   - regex - replaces the space separated tokens matching the regular expression as a whole
+//     (the replacement may refer to the submatches: $0, $1...)
+//   - boguscoin - replaces the Boguscoin addresses (the match is not used)
+//
+// The direction is client (client to server), server (server to client) or both (default).
+// The lines optionally limit the rule to a connection phase by the line numbers of the direction
+// (starting with 1): "N" (only the N-th line), "N-M", "N-" (from N on) or "-M" (first M lines).
+package rewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Direction of the proxied line
+type Direction int
+
+// Directions
+const (
+	ClientToServer Direction = 1 << iota
+	ServerToClient
+	Both = ClientToServer | ServerToClient
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client"
+	case ServerToClient:
+		return "server"
+	case Both:
+		return "both"
+	}
+
+	return "unknown"
+}
+
+// Rule is a rule definition as stored in the rules file.
+type Rule struct {
+	Type      string `json:"type"`
+	Match     string `json:"match,omitempty"`
+	Replace   string `json:"replace"`
+	Direction string `json:"direction,omitempty"`
+	Lines     string `json:"lines,omitempty"`
+}
+
+// Rules is a compiled rule set.
+type Rules []rule
+
+type rule struct {
+	dir         Direction
+	first, last int // line range, 0 if unbounded
+	apply       func(line []byte) []byte
+}
+
+// Default returns the built-in rule set: the Boguscoin addresses in both directions are replaced
+// with the addr.
+func Default(addr string) Rules {
+	return Rules{{dir: Both, apply: boguscoin([]byte(addr))}}
+}
+
+// Load reads and compiles the rules file.
+func Load(path string) (Rules, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- the path is the configured rules file
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	return Parse(data)
+}
+
+// Parse compiles the JSON rule definitions.
+func Parse(data []byte) (Rules, error) {
+	var defs []Rule
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return nil, fmt.Errorf("invalid rules: %w", err)
+	}
+
+	return Compile(defs)
+}
+
+// Compile compiles the rule definitions.
+func Compile(defs []Rule) (Rules, error) {
+	rs := make(Rules, 0, len(defs))
+	for i, def := range defs {
+		r, err := compile(def)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
+func compile(def Rule) (rule, error) {
+	var r rule
+
+	switch def.Direction {
+	case "", "both":
+		r.dir = Both
+	case "client":
+		r.dir = ClientToServer
+	case "server":
+		r.dir = ServerToClient
+	default:
+		return r, fmt.Errorf("unknown direction %q", def.Direction)
+	}
+
+	var err error
+	if r.first, r.last, err = parseLines(def.Lines); err != nil {
+		return r, err
+	}
+
+	switch def.Type {
+	case "literal":
+		if def.Match == "" {
+			return r, fmt.Errorf("empty literal match")
+		}
+		r.apply = literal([]byte(def.Match), []byte(def.Replace))
+
+	case "regex":
+		re, err := regexp.Compile("^(?:" + def.Match + ")$")
+		if err != nil {
+			return r, fmt.Errorf("invalid regex: %w", err)
+		}
+		r.apply = token(re, def.Replace)
+
+	case "boguscoin":
+		r.apply = boguscoin([]byte(def.Replace))
+
+	default:
+		return r, fmt.Errorf("unknown rule type %q", def.Type)
+	}
+
+	return r, nil
+}
+
+// parseLines parses the line range: "", "N", "N-M", "N-" or "-M".
+func parseLines(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+
+	first, err := parseLine(from)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid lines %q", s)
+	}
+
+	last, err := parseLine(to)
+	if err != nil || (last > 0 && last < first) || (first == 0 && last == 0) {
+		return 0, 0, fmt.Errorf("invalid lines %q", s)
+	}
+
+	return first, last, nil
+}
+
+func parseLine(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 1 {
+		err = fmt.Errorf("invalid line number %d", n)
+	}
+
+	return n, err
+}
+
+// Apply applies the rules to the n-th line (starting with 1) sent in the direction.
+func (rs Rules) Apply(dir Direction, n int, line []byte) []byte {
+	for _, r := range rs {
+		if r.dir&dir == 0 || (r.first > 0 && n < r.first) || (r.last > 0 && n > r.last) {
+			continue
+		}
+
+		line = r.apply(line)
+	}
+
+	return line
+}
+
+func literal(match, repl []byte) func([]byte) []byte {
+	return func(line []byte) []byte {
+		return bytes.ReplaceAll(line, match, repl)
+	}
+}
+
+func token(re *regexp.Regexp, repl string) func([]byte) []byte {
+	return func(line []byte) []byte {
+		tokens := bytes.Split(line, []byte(" "))
+		for i, tok := range tokens {
+			if re.Match(tok) {
+				tokens[i] = re.ReplaceAll(tok, []byte(repl))
+			}
+		}
+
+		return bytes.Join(tokens, []byte(" "))
+	}
+}
+
+func boguscoin(addr []byte) func([]byte) []byte {
+	return func(line []byte) []byte {
+		idx, sz := 0, 0
+		for {
+			idx, sz = findAddress(line, idx+sz)
+			if idx == -1 {
+				return line
+			}
+
+			found := line[idx : idx+sz]
+
+			if !bytes.Equal(found, addr) {
+				log.Printf("rewriting %s with %s", found, addr)
+				line = bytes.Join([][]byte{line[:idx], addr, line[idx+sz:]}, nil)
+				sz = len(addr)
+			}
+		}
+	}
+}
+
+// returns index and length or -1 as index if not found
+// laborous version - perhaps should try my luck with regexp.
+func findAddress(line []byte, i int) (int, int) {
+	start := -1
+
+	for ; i < len(line); i++ {
+		ch := line[i]
+
+		// if not within a token AND found a start of a token - mark it and advance
+		if start < 0 && ch == '7' && (i == 0 || line[i-1] == ' ') {
+			start = i
+			continue
+		}
+
+		// if not within a token OR within a token AND on legit chars - advance
+		if start < 0 ||
+			('a' <= ch && ch <= 'z') ||
+			('A' <= ch && ch <= 'Z') ||
+			('0' <= ch && ch <= '9') {
+			continue
+		}
+
+		// if we're here - we have been within a token AND found a non-legit char - handle buffer
+		sz := i - start
+		if ch == ' ' && 26 <= sz && sz <= 35 {
+			return start, sz
+		}
+
+		// the collected token isn't valid - reset
+		start = -1
+	}
+
+	// found the end of line and have a token buffer - deal with it
+	if start > -1 {
+		sz := i - start
+		if 26 <= sz && sz <= 35 {
+			return start, sz
+		}
+	}
+
+	return -1, -1
+}
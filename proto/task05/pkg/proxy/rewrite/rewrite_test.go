@@ -0,0 +1,178 @@
+package rewrite_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task05/pkg/proxy/rewrite"
+)
+
+const evil = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{name: "alone", line: "7F1u3wSD5RbOHQmupo9nx4TnhQ", want: evil},
+		{name: "start", line: "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX send", want: evil + " send"},
+		{name: "end", line: "send to 7LOrwbDlS8NujgjddyogWgIM93MV5N2VR", want: "send to " + evil},
+		{name: "several", line: "7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T or 7YWHMfk9JZe0LM0g1ZauHuiSxhI", want: evil + " or " + evil},
+		{name: "too short", line: "send 7F1u3wSD5RbOHQmupo9nx4Tnh", want: "send 7F1u3wSD5RbOHQmupo9nx4Tnh"},
+		{name: "too long", line: "7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T1", want: "7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T1"},
+		{name: "not a token", line: "x7F1u3wSD5RbOHQmupo9nx4TnhQ", want: "x7F1u3wSD5RbOHQmupo9nx4TnhQ"},
+		{name: "invalid char", line: "7F1u3wSD5RbOHQmupo9nx4TnhQ-x", want: "7F1u3wSD5RbOHQmupo9nx4TnhQ-x"},
+	}
+
+	rs := rewrite.Default(evil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			is.Equal(string(rs.Apply(rewrite.ClientToServer, 1, []byte(tt.line))), tt.want)
+			is.Equal(string(rs.Apply(rewrite.ServerToClient, 1, []byte(tt.line))), tt.want)
+		})
+	}
+}
+
+func TestRules_Apply(t *testing.T) {
+	tests := []struct {
+		name string
+		rule rewrite.Rule
+		dir  rewrite.Direction
+		n    int
+		line string
+		want string
+	}{
+		{
+			name: "literal",
+			rule: rewrite.Rule{Type: "literal", Match: "cat", Replace: "dog"},
+			dir:  rewrite.ClientToServer, n: 1, line: "cat concatenated", want: "dog condogenated",
+		},
+		{
+			name: "regex matches whole tokens",
+			rule: rewrite.Rule{Type: "regex", Match: "[0-9]+", Replace: "<$0>"},
+			dir:  rewrite.ClientToServer, n: 1, line: "12 a34 56", want: "<12> a34 <56>",
+		},
+		{
+			name: "regex submatch",
+			rule: rewrite.Rule{Type: "regex", Match: "(\\w+)@(\\w+)", Replace: "$2@$1"},
+			dir:  rewrite.ClientToServer, n: 1, line: "mail bob@home", want: "mail home@bob",
+		},
+		{
+			name: "boguscoin",
+			rule: rewrite.Rule{Type: "boguscoin", Replace: "7xxxxxxxxxxxxxxxxxxxxxxxxxxx"},
+			dir:  rewrite.ServerToClient, n: 1, line: "7F1u3wSD5RbOHQmupo9nx4TnhQ", want: "7xxxxxxxxxxxxxxxxxxxxxxxxxxx",
+		},
+		{
+			name: "client direction only",
+			rule: rewrite.Rule{Type: "literal", Match: "a", Replace: "b", Direction: "client"},
+			dir:  rewrite.ServerToClient, n: 1, line: "a", want: "a",
+		},
+		{
+			name: "server direction",
+			rule: rewrite.Rule{Type: "literal", Match: "a", Replace: "b", Direction: "server"},
+			dir:  rewrite.ServerToClient, n: 1, line: "a", want: "b",
+		},
+		{
+			name: "single line",
+			rule: rewrite.Rule{Type: "literal", Match: "a", Replace: "b", Lines: "2"},
+			dir:  rewrite.ClientToServer, n: 3, line: "a", want: "a",
+		},
+		{
+			name: "first lines",
+			rule: rewrite.Rule{Type: "literal", Match: "a", Replace: "b", Lines: "-2"},
+			dir:  rewrite.ClientToServer, n: 2, line: "a", want: "b",
+		},
+		{
+			name: "after the first lines",
+			rule: rewrite.Rule{Type: "literal", Match: "a", Replace: "b", Lines: "3-"},
+			dir:  rewrite.ClientToServer, n: 2, line: "a", want: "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			rs, err := rewrite.Compile([]rewrite.Rule{tt.rule})
+			is.NoErr(err)
+			is.Equal(string(rs.Apply(tt.dir, tt.n, []byte(tt.line))), tt.want)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		valid bool
+	}{
+		{name: "empty", rules: `[]`, valid: true},
+		{name: "all types", rules: `[{"type":"literal","match":"a"},{"type":"regex","match":"a+"},{"type":"boguscoin","replace":"x"}]`, valid: true},
+		{name: "not json", rules: `type=literal`},
+		{name: "unknown type", rules: `[{"type":"magic"}]`},
+		{name: "empty literal", rules: `[{"type":"literal"}]`},
+		{name: "invalid regex", rules: `[{"type":"regex","match":"("}]`},
+		{name: "unknown direction", rules: `[{"type":"boguscoin","direction":"up"}]`},
+		{name: "invalid lines", rules: `[{"type":"boguscoin","lines":"3-1"}]`},
+		{name: "zero line", rules: `[{"type":"boguscoin","lines":"0"}]`},
+		{name: "open range", rules: `[{"type":"boguscoin","lines":"-"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			_, err := rewrite.Parse([]byte(tt.rules))
+			is.Equal(err == nil, tt.valid)
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(rules string, mtime time.Time) {
+		is.NoErr(os.WriteFile(path, []byte(rules), 0o600))
+		is.NoErr(os.Chtimes(path, mtime, mtime))
+	}
+
+	now := time.Now()
+	write(`[{"type":"literal","match":"a","replace":"b"}]`, now)
+
+	e, err := rewrite.Watch(ctx, path, 10*time.Millisecond)
+	is.NoErr(err)
+	is.Equal(string(e.Apply(rewrite.ClientToServer, 1, []byte("a"))), "b")
+
+	write(`[{"type":"literal","match":"a","replace":"c"}]`, now.Add(time.Second))
+	waitFor(t, func() bool {
+		return string(e.Apply(rewrite.ClientToServer, 1, []byte("a"))) == "c"
+	})
+
+	// invalid rules keep the previous ones
+	write(`[{"type":"magic"}]`, now.Add(2*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	is.Equal(string(e.Apply(rewrite.ClientToServer, 1, []byte("a"))), "c")
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proto/task05/pkg/proxy/audit"
+	"proto/task05/pkg/proxy/rewrite"
+)
+
+// MaxLineLength is the longest line proxied, longer ones end the session.
+const MaxLineLength = 64 * 1024
+
+// DefaultDrainTimeout is used if no drain timeout is set.
+const DefaultDrainTimeout = time.Second
+
+var errLineTooLong = errors.New("line too long")
+
+// flow is the outcome of a single direction of the session.
+type flow struct {
+	dir      rewrite.Direction
+	lines    int   // proxied lines
+	bytes    int64 // written to the peer
+	rewrites int   // rewritten lines
+	dropped  int   // bytes of the unterminated line at the end of the stream
+	err      error // nil on EOF
+}
+
+// session tears down both connections once: when a direction ends, when the session is idle for
+// too long or when the proxy is stopped.
+type session struct {
+	fe, be   io.ReadWriter
+	once     sync.Once
+	reason   string
+	activity atomic.Int64 // unix nanoseconds of the last proxied line
+}
+
+func (s *session) touch() {
+	s.activity.Store(time.Now().UnixNano())
+}
+
+func (s *session) idle() time.Duration {
+	return time.Since(time.Unix(0, s.activity.Load()))
+}
+
+// teardown closes both connections, unblocking the reads of both directions.
+func (s *session) teardown(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		closeConn(s.fe)
+		closeConn(s.be)
+	})
+}
+
+func closeConn(rw io.ReadWriter) {
+	if c, ok := rw.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// closeWrite propagates EOF to the peer. It reports false if the half-close isn't supported.
+func closeWrite(w io.Writer) bool {
+	cw, ok := w.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+
+	return cw.CloseWrite() == nil
+}
+
+// end describes why the direction ended.
+func (f flow) end() string {
+	side := "client"
+	if f.dir == rewrite.ServerToClient {
+		side = "server"
+	}
+
+	if f.err != nil {
+		return fmt.Sprintf("%s error: %s", side, f.err.Error())
+	}
+
+	return side + " disconnected"
+}
+
+// pump proxies the lines from one side to the other until EOF or an error. An unterminated line
+// at the end of the stream is not a complete message, so it is dropped (and reported).
+func (p *Proxy) pump(s *session, from io.Reader, to io.Writer, dir rewrite.Direction) flow {
+	f := flow{dir: dir}
+	r := bufio.NewReaderSize(from, MaxLineLength)
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			switch {
+			case errors.Is(err, bufio.ErrBufferFull):
+				f.err = errLineTooLong
+
+			case errors.Is(err, io.EOF):
+				if len(line) > 0 {
+					f.dropped = len(line)
+					log.Printf("Session %s: dropping unterminated %s line: %q", p.session, dir, line)
+				}
+
+			default:
+				f.err = err
+			}
+
+			return f
+		}
+
+		s.touch()
+
+		// the rules see the content only, the line ending is forwarded as received
+		content := bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		ending := line[len(content):]
+		line = content
+		if len(line) == 0 {
+			continue
+		}
+
+		f.lines++
+		rewritten := p.opts.Rules.Apply(dir, f.lines, line)
+
+		changed := !bytes.Equal(rewritten, line)
+		if changed {
+			f.rewrites++
+		}
+
+		if p.opts.Audit != nil {
+			rec := audit.Record{Kind: audit.KindLine, Direction: dir.String(), Line: string(rewritten)}
+			if changed {
+				rec.Original = string(line)
+			}
+			p.audit(rec)
+		}
+
+		// the rewritten line may share the read buffer, so it's copied before appending
+		out := make([]byte, 0, len(rewritten)+len(ending))
+		out = append(append(out, rewritten...), ending...)
+
+		n, err := to.Write(out)
+		f.bytes += int64(n)
+		if err != nil {
+			f.err = err
+			return f
+		}
+	}
+}
+
+// summary logs the session statistics.
+func (p *Proxy) summary(s *session, start time.Time, flows map[rewrite.Direction]flow) {
+	cs, sc := flows[rewrite.ClientToServer], flows[rewrite.ServerToClient]
+
+	log.Printf("Session %s closed (%s) after %s: client->server %d lines %d bytes, "+
+		"server->client %d lines %d bytes, %d rewrites, %d bytes dropped",
+		p.session, s.reason, time.Since(start).Round(time.Millisecond),
+		cs.lines, cs.bytes, sc.lines, sc.bytes, cs.rewrites+sc.rewrites, cs.dropped+sc.dropped)
+}
@@ -2,22 +2,84 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"proto/common/pkg/tcpserver"
 	"proto/task06/pkg/speed"
+	"proto/task06/pkg/speed/admin"
+	"proto/task06/pkg/speed/sim"
 )
 
 const tcpPort = 8080
 
 // Task06 - Speed Daemon - https://protohackers.com/problem/6
+//
+// Optional environment variables:
+//
+//	DATA_DIR         - data directory of the persistent ticket outbox (in-memory if empty)
+//	RETENTION        - how long the plate readings are kept, eg. 24h (forever if empty)
+//	PRUNE_INTERVAL   - how often the readings out of the retention are removed and the ticket
+//	                   journal compacted (default 1m)
+//	ADMIN_PORT       - port of the HTTP admin interface with the ticket ledger (disabled if empty),
+//	                   see package admin. The ledger keeps the pending tickets and the ones
+//	                   covering a day within RETENTION (all of them if empty).
+//	MAX_PLATE_LENGTH - longer plates are a protocol error (default 255)
+//	MAX_ROADS        - dispatchers of more roads are a protocol error (default 255)
+//
+// The "simulate [SCENARIO_FILE]" command drives the traffic of the JSON scenario (see package sim,
+// a small default one if omitted) through the server at SIM_ADDRESS (default localhost:8080) and
+// reports the tickets not received exactly once per plate and day. SIM_TIMEOUT is how long the
+// tickets are waited for (default 30s).
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := simulate(os.Args[2:]); err != nil {
+			log.Fatalln("Error: [Simulate]:", err.Error())
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	sd := speed.New(ctx)
-	err := tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
+	sd, err := speed.Open(ctx, speed.Options{
+		Dir:           os.Getenv("DATA_DIR"),
+		Retention:     envDuration("RETENTION"),
+		PruneInterval: envDuration("PRUNE_INTERVAL"),
+		Limits: speed.Limits{
+			MaxPlateLength: envInt("MAX_PLATE_LENGTH"),
+			MaxRoads:       envInt("MAX_ROADS"),
+		},
+	})
+	if err != nil {
+		log.Fatalln("Error: [Open]:", err.Error())
+	}
+	defer func() {
+		_ = sd.Close()
+	}()
+
+	if port := envInt("ADMIN_PORT"); port > 0 {
+		go func() {
+			log.Printf("Listening on: %d (admin)\n", port)
+			srv := &http.Server{
+				Addr:              fmt.Sprintf(":%d", port),
+				Handler:           admin.NewHandler(sd),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			err := srv.ListenAndServe()
+			if err != nil {
+				log.Println("Error: [Listen admin]:", err.Error())
+			}
+		}()
+	}
+
+	err = tcpserver.Listen(ctx, tcpPort, func(ctx context.Context, conn net.Conn) {
 		ctx, cancel := context.WithCancel(ctx)
 		defer cancel()
 
@@ -27,3 +89,72 @@ func main() {
 		log.Println("Error: [Listen]:", err.Error())
 	}
 }
+
+// simulate runs the traffic simulation given by the args.
+func simulate(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: simulate [SCENARIO_FILE]")
+	}
+
+	sc := sim.DefaultScenario()
+	if len(args) == 1 {
+		var err error
+		if sc, err = sim.Load(args[0]); err != nil {
+			return err
+		}
+	}
+
+	plan, err := sim.NewPlan(sc)
+	if err != nil {
+		return err
+	}
+
+	addr := os.Getenv("SIM_ADDRESS")
+	if addr == "" {
+		addr = fmt.Sprintf("localhost:%d", tcpPort)
+	}
+
+	report, err := sim.Run(context.Background(), addr, plan, sim.Options{Timeout: envDuration("SIM_TIMEOUT")})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range report.Mismatches {
+		fmt.Println(m)
+	}
+	fmt.Println(report)
+
+	if !report.OK() {
+		return errors.New("tickets mismatch")
+	}
+
+	return nil
+}
+
+func envDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Error: invalid %s: %s", name, err.Error())
+	}
+
+	return d
+}
+
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Error: invalid %s: %s", name, err.Error())
+	}
+
+	return n
+}
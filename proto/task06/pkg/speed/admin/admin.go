@@ -0,0 +1,86 @@
+// Package admin is the HTTP admin interface of the speed daemon. It serves the ticket ledger:
+//
+//	GET /tickets?plate=UN1X&road=123&from=19000&to=19007&format=csv
+//
+// All the parameters are optional: from and to are the (inclusive) range of the days the tickets
+// cover (unix timestamp / 86400) and the format is json (default) or csv.
+package admin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"proto/task06/pkg/speed"
+)
+
+// NewHandler creates the HTTP handler of the admin interface.
+func NewHandler(s *speed.Speed) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/tickets", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f, err := parseFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries := s.Tickets(f)
+
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			err = speed.WriteJSON(w, entries)
+
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="tickets.csv"`)
+			err = speed.WriteCSV(w, entries)
+
+		default:
+			http.Error(w, "unknown format: "+format, http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			log.Println("Error ticket export:", err.Error())
+		}
+	})
+
+	return mux
+}
+
+func parseFilter(r *http.Request) (speed.TicketFilter, error) {
+	q := r.URL.Query()
+	f := speed.TicketFilter{Plate: q.Get("plate")}
+
+	if v := q.Get("road"); v != "" {
+		road, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return f, fmt.Errorf("invalid road: %s", v)
+		}
+		f.Road = ptr(uint16(road))
+	}
+
+	for name, day := range map[string]**uint32{"from": &f.FromDay, "to": &f.ToDay} {
+		if v := q.Get(name); v != "" {
+			d, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s day: %s", name, v)
+			}
+			*day = ptr(uint32(d))
+		}
+	}
+
+	return f, nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
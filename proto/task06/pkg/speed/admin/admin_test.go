@@ -0,0 +1,111 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+
+	"proto/task06/pkg/speed"
+	"proto/task06/pkg/speed/admin"
+)
+
+// sample returns a speed daemon with the ticket of a speeding car on the 2nd day.
+func sample(t *testing.T) *speed.Speed {
+	t.Helper()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	sd := speed.New(context.Background())
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	for _, c := range []struct {
+		mile uint16
+		ts   uint32
+	}{{mile: 8, ts: 86400}, {mile: 9, ts: 86400 + 45}} {
+		client, server := net.Pipe()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sd.Handle(context.Background(), server, addr)
+		}()
+
+		_, err := (&speed.Camera{Road: 123, Mile: c.mile, Limit: 60}).WriteTo(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = (&speed.Plate{Plate: "UN1X", Timestamp: c.ts}).WriteTo(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the plate is processed once the camera disconnects
+		_ = client.Close()
+		<-done
+	}
+
+	return sd
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantType string
+		wantRows int // tickets
+	}{
+		{name: "json", query: "", wantCode: http.StatusOK, wantType: "application/json", wantRows: 1},
+		{name: "csv", query: "format=csv", wantCode: http.StatusOK, wantType: "text/csv", wantRows: 1},
+		{name: "filtered", query: "plate=UN1X&road=123&from=1&to=1", wantCode: http.StatusOK, wantType: "application/json", wantRows: 1},
+		{name: "other day", query: "from=2", wantCode: http.StatusOK, wantType: "application/json", wantRows: 0},
+		{name: "invalid road", query: "road=x", wantCode: http.StatusBadRequest},
+		{name: "invalid day", query: "to=-1", wantCode: http.StatusBadRequest},
+		{name: "unknown format", query: "format=xml", wantCode: http.StatusBadRequest},
+	}
+
+	srv := httptest.NewServer(admin.NewHandler(sample(t)))
+	defer srv.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			resp, err := http.Get(srv.URL + "/tickets?" + tt.query)
+			is.NoErr(err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			is.Equal(resp.StatusCode, tt.wantCode)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			is.Equal(resp.Header.Get("Content-Type"), tt.wantType)
+
+			var rows int
+			if tt.wantType == "text/csv" {
+				recs, err := csv.NewReader(resp.Body).ReadAll()
+				is.NoErr(err)
+				rows = len(recs) - 1 // header
+			} else {
+				var recs []map[string]any
+				is.NoErr(json.NewDecoder(resp.Body).Decode(&recs))
+				rows = len(recs)
+			}
+			is.Equal(rows, tt.wantRows)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package speed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxMessageSize is the largest client message: IAmDispatcher with 255 roads.
+const maxMessageSize = 1 + 1 + 255*2
+
+// Decoder errors
+var (
+	ErrUnknownType   = errors.New("unknown message type")
+	ErrTruncated     = errors.New("message truncated by EOF")
+	ErrStringTooLong = errors.New("string too long")
+	ErrTooManyRoads  = errors.New("too many roads")
+)
+
+// ProtocolError is a malformed client message. The connection can't be read any further.
+type ProtocolError struct {
+	Type uint8
+	Err  error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("Invalid message 0x%02x: %s", e.Type, e.Err.Error())
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// WantHeartbeat is the WantHeartbeat message payload.
+type WantHeartbeat struct {
+	Interval uint32 // deciseconds
+}
+
+// Limits are the maximum sizes of the client messages. The zero fields are the protocol maxima.
+type Limits struct {
+	MaxPlateLength int // bytes
+	MaxRoads       int // of a dispatcher
+}
+
+// Decoder reads the client messages from a buffered reader.
+type Decoder struct {
+	r      *bufio.Reader
+	limits Limits
+}
+
+// NewDecoder creates a decoder of the client messages.
+func NewDecoder(r io.Reader, limits Limits) *Decoder {
+	if limits.MaxPlateLength <= 0 || limits.MaxPlateLength > 255 {
+		limits.MaxPlateLength = 255
+	}
+	if limits.MaxRoads <= 0 || limits.MaxRoads > 255 {
+		limits.MaxRoads = 255
+	}
+
+	return &Decoder{r: bufio.NewReaderSize(r, maxMessageSize), limits: limits}
+}
+
+// Next reads the next message: *Plate, *WantHeartbeat, *Camera or *Dispatcher.
+//
+// It returns io.EOF if the client disconnects between the messages and a *ProtocolError if the
+// message is invalid or the client disconnects in the middle of it. Other errors are the errors
+// of the underlying reader.
+func (d *Decoder) Next() (any, error) {
+	kind, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg any
+	switch kind {
+	case TypePlate:
+		msg, err = d.plate()
+
+	case TypeWantHeartbeat:
+		msg, err = d.wantHeartbeat()
+
+	case TypeIAMCamera:
+		msg, err = d.camera()
+
+	case TypeIAMDispatcher:
+		msg, err = d.dispatcher()
+
+	default:
+		err = ErrUnknownType
+	}
+
+	switch {
+	case err == nil:
+		return msg, nil
+
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, &ProtocolError{Type: kind, Err: ErrTruncated}
+
+	case errors.Is(err, ErrUnknownType) || errors.Is(err, ErrStringTooLong) || errors.Is(err, ErrTooManyRoads):
+		return nil, &ProtocolError{Type: kind, Err: err}
+	}
+
+	return nil, err
+}
+
+func (d *Decoder) plate() (*Plate, error) {
+	plate, err := readString(d.r, d.limits.MaxPlateLength)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Plate{Plate: plate}
+	if err := binary.Read(d.r, binary.BigEndian, &p.Timestamp); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (d *Decoder) wantHeartbeat() (*WantHeartbeat, error) {
+	var hb WantHeartbeat
+	if err := binary.Read(d.r, binary.BigEndian, &hb); err != nil {
+		return nil, err
+	}
+
+	return &hb, nil
+}
+
+func (d *Decoder) camera() (*Camera, error) {
+	var c Camera
+	if err := binary.Read(d.r, binary.BigEndian, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (d *Decoder) dispatcher() (*Dispatcher, error) {
+	roads, err := readRoads(d.r, d.limits.MaxRoads)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Dispatcher{NumRoads: uint8(len(roads)), Roads: roads}, nil
+}
+
+// readString reads a length prefixed string of at most limit bytes. EOF before its end is an
+// io.ErrUnexpectedEOF.
+func readString(r io.Reader, limit int) (string, error) {
+	var sz [1]byte
+	if _, err := io.ReadFull(r, sz[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	if int(sz[0]) > limit {
+		return "", fmt.Errorf("%w: %d bytes", ErrStringTooLong, sz[0])
+	}
+
+	buf := make([]byte, sz[0])
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	return string(buf), nil
+}
+
+// readRoads reads the count prefixed list of at most limit roads.
+func readRoads(r io.Reader, limit int) ([]uint16, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if int(n[0]) > limit {
+		return nil, fmt.Errorf("%w: %d", ErrTooManyRoads, n[0])
+	}
+
+	roads := make([]uint16, n[0])
+	if err := binary.Read(r, binary.BigEndian, roads); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return roads, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,277 @@
+package speed_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task06/pkg/speed"
+)
+
+type decodeTest struct {
+	name    string
+	limits  speed.Limits
+	input   []byte
+	want    []any // decoded before the error
+	wantErr error // io.EOF for a clean disconnect
+}
+
+var errBroken = errors.New("connection reset")
+
+// testDecoder runs the tests with the input delivered at once, byte at a time and in halves.
+func testDecoder(t *testing.T, tests []decodeTest) {
+	t.Helper()
+
+	readers := []struct {
+		name string
+		wrap func(io.Reader) io.Reader
+	}{
+		{name: "whole", wrap: func(r io.Reader) io.Reader { return r }},
+		{name: "byte at a time", wrap: iotest.OneByteReader},
+		{name: "halves", wrap: iotest.HalfReader},
+	}
+
+	for _, tt := range tests {
+		for _, rd := range readers {
+			t.Run(tt.name+"/"+rd.name, func(t *testing.T) {
+				is := is.New(t)
+
+				var r io.Reader = bytes.NewReader(tt.input)
+				if errors.Is(tt.wantErr, errBroken) {
+					// the I/O error after the input
+					r = io.MultiReader(r, iotest.ErrReader(errBroken))
+				}
+
+				dec := speed.NewDecoder(rd.wrap(r), tt.limits)
+
+				var got []any
+				var err error
+				for {
+					var msg any
+					if msg, err = dec.Next(); err != nil {
+						break
+					}
+					got = append(got, msg)
+				}
+
+				is.Equal(got, tt.want)
+				is.True(errors.Is(err, tt.wantErr)) // the final error
+
+				// only the malformed messages are protocol errors
+				var perr *speed.ProtocolError
+				is.Equal(errors.As(err, &perr), !errors.Is(err, io.EOF) && !errors.Is(err, errBroken))
+			})
+		}
+	}
+}
+
+func TestDecoder_Plate(t *testing.T) {
+	testDecoder(t, []decodeTest{
+		{
+			name:    "plate",
+			input:   []byte{0x20, 0x04, 'U', 'N', '1', 'X', 0x00, 0x00, 0x03, 0xe8},
+			want:    []any{&speed.Plate{Plate: "UN1X", Timestamp: 1000}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "empty plate",
+			input:   []byte{0x20, 0x00, 0x00, 0x00, 0x00, 0x01},
+			want:    []any{&speed.Plate{Plate: "", Timestamp: 1}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "longest plate",
+			input:   append(append([]byte{0x20, 0xff}, bytes.Repeat([]byte{'A'}, 255)...), 0xff, 0xff, 0xff, 0xff),
+			want:    []any{&speed.Plate{Plate: string(bytes.Repeat([]byte{'A'}, 255)), Timestamp: 0xffffffff}},
+			wantErr: io.EOF,
+		},
+		{name: "eof before length", input: []byte{0x20}, wantErr: speed.ErrTruncated},
+		{name: "eof in plate", input: []byte{0x20, 0x04, 'U', 'N'}, wantErr: speed.ErrTruncated},
+		{name: "eof before timestamp", input: []byte{0x20, 0x04, 'U', 'N', '1', 'X'}, wantErr: speed.ErrTruncated},
+		{name: "eof in timestamp", input: []byte{0x20, 0x04, 'U', 'N', '1', 'X', 0x00, 0x00}, wantErr: speed.ErrTruncated},
+		{
+			name:    "plate too long",
+			limits:  speed.Limits{MaxPlateLength: 3},
+			input:   []byte{0x20, 0x04, 'U', 'N', '1', 'X', 0x00, 0x00, 0x03, 0xe8},
+			wantErr: speed.ErrStringTooLong,
+		},
+		{name: "broken in plate", input: []byte{0x20, 0x04, 'U', 'N'}, wantErr: errBroken},
+	})
+}
+
+func TestDecoder_WantHeartbeat(t *testing.T) {
+	testDecoder(t, []decodeTest{
+		{
+			name:    "interval",
+			input:   []byte{0x40, 0x00, 0x00, 0x00, 0x0a},
+			want:    []any{&speed.WantHeartbeat{Interval: 10}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "disabled",
+			input:   []byte{0x40, 0x00, 0x00, 0x00, 0x00},
+			want:    []any{&speed.WantHeartbeat{Interval: 0}},
+			wantErr: io.EOF,
+		},
+		{name: "eof before interval", input: []byte{0x40}, wantErr: speed.ErrTruncated},
+		{name: "eof in interval", input: []byte{0x40, 0x00, 0x00, 0x00}, wantErr: speed.ErrTruncated},
+		{name: "broken in interval", input: []byte{0x40, 0x00}, wantErr: errBroken},
+	})
+}
+
+func TestDecoder_Camera(t *testing.T) {
+	testDecoder(t, []decodeTest{
+		{
+			name:    "camera",
+			input:   []byte{0x80, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c},
+			want:    []any{&speed.Camera{Road: 66, Mile: 100, Limit: 60}},
+			wantErr: io.EOF,
+		},
+		{name: "eof before road", input: []byte{0x80}, wantErr: speed.ErrTruncated},
+		{name: "eof in mile", input: []byte{0x80, 0x00, 0x42, 0x00}, wantErr: speed.ErrTruncated},
+		{name: "eof before limit", input: []byte{0x80, 0x00, 0x42, 0x00, 0x64}, wantErr: speed.ErrTruncated},
+		{name: "broken in limit", input: []byte{0x80, 0x00, 0x42, 0x00, 0x64, 0x00}, wantErr: errBroken},
+	})
+}
+
+func TestDecoder_Dispatcher(t *testing.T) {
+	roads := make([]byte, 0, 255*2)
+	for i := 0; i < 255; i++ {
+		roads = append(roads, 0x00, byte(i))
+	}
+	all := make([]uint16, 255)
+	for i := range all {
+		all[i] = uint16(i)
+	}
+
+	testDecoder(t, []decodeTest{
+		{
+			name:    "roads",
+			input:   []byte{0x81, 0x03, 0x00, 0x42, 0x01, 0x70, 0x13, 0x88},
+			want:    []any{&speed.Dispatcher{NumRoads: 3, Roads: []uint16{66, 368, 5000}}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "no roads",
+			input:   []byte{0x81, 0x00},
+			want:    []any{&speed.Dispatcher{NumRoads: 0, Roads: []uint16{}}},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "most roads",
+			input:   append([]byte{0x81, 0xff}, roads...),
+			want:    []any{&speed.Dispatcher{NumRoads: 255, Roads: all}},
+			wantErr: io.EOF,
+		},
+		{name: "eof before count", input: []byte{0x81}, wantErr: speed.ErrTruncated},
+		{name: "eof in roads", input: []byte{0x81, 0x03, 0x00, 0x42, 0x01}, wantErr: speed.ErrTruncated},
+		{
+			name:    "too many roads",
+			limits:  speed.Limits{MaxRoads: 2},
+			input:   []byte{0x81, 0x03, 0x00, 0x42, 0x01, 0x70, 0x13, 0x88},
+			wantErr: speed.ErrTooManyRoads,
+		},
+		{name: "broken in roads", input: []byte{0x81, 0x03, 0x00, 0x42, 0x01}, wantErr: errBroken},
+	})
+}
+
+func TestDecoder_Stream(t *testing.T) {
+	testDecoder(t, []decodeTest{
+		{name: "no messages", input: nil, wantErr: io.EOF},
+		{
+			name: "several messages",
+			input: []byte{
+				0x80, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c,
+				0x40, 0x00, 0x00, 0x00, 0x0a,
+				0x20, 0x04, 'U', 'N', '1', 'X', 0x00, 0x00, 0x03, 0xe8,
+				0x20, 0x04, 'U', 'N', '1', 'X', 0x00, 0x00, 0x03, 0xe9,
+			},
+			want: []any{
+				&speed.Camera{Road: 66, Mile: 100, Limit: 60},
+				&speed.WantHeartbeat{Interval: 10},
+				&speed.Plate{Plate: "UN1X", Timestamp: 1000},
+				&speed.Plate{Plate: "UN1X", Timestamp: 1001},
+			},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "unknown type",
+			input:   []byte{0x40, 0x00, 0x00, 0x00, 0x00, 0x21, 0x04, 'U', 'N', '1', 'X'},
+			want:    []any{&speed.WantHeartbeat{}},
+			wantErr: speed.ErrUnknownType,
+		},
+		{
+			name:    "truncated after a message",
+			input:   []byte{0x40, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00},
+			want:    []any{&speed.WantHeartbeat{}},
+			wantErr: speed.ErrTruncated,
+		},
+		{name: "broken between messages", input: []byte{0x40, 0x00, 0x00, 0x00, 0x00}, want: []any{&speed.WantHeartbeat{}}, wantErr: errBroken},
+	})
+}
+
+func TestSpeed_ProtocolError(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "unknown type", input: []byte{0xff}},
+		{name: "server message", input: []byte{0x21, 0x04, 'U', 'N', '1', 'X'}},
+		{name: "plate too long", input: []byte{0x20, 0x10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			log.SetOutput(io.Discard)
+			t.Cleanup(func() {
+				log.SetOutput(os.Stderr)
+			})
+
+			sd, err := speed.Open(context.Background(), speed.Options{Limits: speed.Limits{MaxPlateLength: 8}})
+			is.NoErr(err)
+
+			client, server := net.Pipe()
+			defer func() {
+				_ = client.Close()
+			}()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				sd.Handle(context.Background(), server, &net.TCPAddr{})
+			}()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			go func() {
+				_, _ = client.Write(tt.input)
+			}()
+
+			// an error message and the session is over
+			kind := make([]byte, 1)
+			_, err = io.ReadFull(client, kind)
+			is.NoErr(err)
+			is.Equal(kind[0], speed.TypeError)
+
+			msg, err := speed.ReadString(client)
+			is.NoErr(err)
+			is.True(msg != "")
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("session not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package speed
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// LedgerEntry is an issued ticket and its delivery.
+type LedgerEntry struct {
+	ID         uint64
+	Ticket     Ticket
+	Issued     time.Time
+	Dispatcher string    // address of the dispatcher the ticket was delivered to (empty if pending)
+	Delivered  time.Time // zero if pending
+}
+
+// Pending reports whether the ticket has not been delivered yet.
+func (e LedgerEntry) Pending() bool {
+	return e.Delivered.IsZero()
+}
+
+// TicketFilter selects the ledger entries. The nil fields match any ticket.
+type TicketFilter struct {
+	Plate   string // any if empty
+	Road    *uint16
+	FromDay *uint32 // the tickets covering a day in the range (inclusive)
+	ToDay   *uint32
+}
+
+func (f TicketFilter) match(t *Ticket) bool {
+	if f.Plate != "" && t.Plate != f.Plate {
+		return false
+	}
+
+	if f.Road != nil && t.Info.Road != *f.Road {
+		return false
+	}
+
+	day1, day2 := ticketDays(t)
+	if f.FromDay != nil && day2 < *f.FromDay {
+		return false
+	}
+
+	if f.ToDay != nil && day1 > *f.ToDay {
+		return false
+	}
+
+	return true
+}
+
+// ledger records the issued tickets in the issue order. The compaction prunes it to the pending
+// tickets and the ones covering a day within the retention. It's guarded by the outbox lock.
+type ledger struct {
+	entries []*LedgerEntry
+	byID    map[uint64]*LedgerEntry
+}
+
+func newLedger() ledger {
+	return ledger{byID: make(map[uint64]*LedgerEntry)}
+}
+
+func (l *ledger) issued(id uint64, t *Ticket, at time.Time) {
+	e := &LedgerEntry{ID: id, Ticket: *t, Issued: at}
+	l.entries = append(l.entries, e)
+	l.byID[id] = e
+}
+
+// delivered records the delivery. A ticket redelivered after a restart keeps the first one.
+func (l *ledger) delivered(id uint64, dispatcher string, at time.Time) {
+	e, ok := l.byID[id]
+	if !ok || !e.Pending() {
+		return
+	}
+
+	e.Dispatcher = dispatcher
+	e.Delivered = at
+}
+
+// prune drops the delivered tickets covering only the days before cutoffDay.
+func (l *ledger) prune(cutoffDay uint32) {
+	l.entries = slices.DeleteFunc(l.entries, func(e *LedgerEntry) bool {
+		if retained(e, cutoffDay) {
+			return false
+		}
+
+		delete(l.byID, e.ID)
+		return true
+	})
+}
+
+func (l *ledger) query(f TicketFilter) []LedgerEntry {
+	var res []LedgerEntry
+	for _, e := range l.entries {
+		if f.match(&e.Ticket) {
+			res = append(res, *e)
+		}
+	}
+
+	return res
+}
+
+// Tickets returns the issued tickets matching the filter, in the issue order.
+func (s *Speed) Tickets(f TicketFilter) []LedgerEntry {
+	return s.outbox.tickets(f)
+}
+
+// ledgerRecord is the exported form of a ledger entry. The speed is in mph (not 100x mph as in
+// the protocol).
+type ledgerRecord struct {
+	ID         uint64  `json:"id"`
+	Plate      string  `json:"plate"`
+	Road       uint16  `json:"road"`
+	Mile1      uint16  `json:"mile1"`
+	Timestamp1 uint32  `json:"timestamp1"`
+	Mile2      uint16  `json:"mile2"`
+	Timestamp2 uint32  `json:"timestamp2"`
+	Speed      float64 `json:"speed"`
+	Issued     string  `json:"issued"`
+	Dispatcher string  `json:"dispatcher"`
+	Delivered  string  `json:"delivered"` // empty if pending
+}
+
+var ledgerHeader = []string{
+	"id", "plate", "road", "mile1", "timestamp1", "mile2", "timestamp2", "speed", "issued", "dispatcher", "delivered",
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (e LedgerEntry) record() ledgerRecord {
+	info := e.Ticket.Info
+
+	return ledgerRecord{
+		ID:         e.ID,
+		Plate:      e.Ticket.Plate,
+		Road:       info.Road,
+		Mile1:      info.Reading1.Mile,
+		Timestamp1: info.Reading1.Timestamp,
+		Mile2:      info.Reading2.Mile,
+		Timestamp2: info.Reading2.Timestamp,
+		Speed:      float64(info.Speed) / 100,
+		Issued:     formatTime(e.Issued),
+		Dispatcher: e.Dispatcher,
+		Delivered:  formatTime(e.Delivered),
+	}
+}
+
+// WriteJSON exports the ledger entries as a JSON array.
+func WriteJSON(w io.Writer, entries []LedgerEntry) error {
+	recs := make([]ledgerRecord, 0, len(entries))
+	for _, e := range entries {
+		recs = append(recs, e.record())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(recs)
+}
+
+// WriteCSV exports the ledger entries as CSV with a header.
+func WriteCSV(w io.Writer, entries []LedgerEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(ledgerHeader); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		r := e.record()
+
+		err := cw.Write([]string{
+			strconv.FormatUint(r.ID, 10),
+			r.Plate,
+			strconv.Itoa(int(r.Road)),
+			strconv.Itoa(int(r.Mile1)),
+			strconv.FormatUint(uint64(r.Timestamp1), 10),
+			strconv.Itoa(int(r.Mile2)),
+			strconv.FormatUint(uint64(r.Timestamp2), 10),
+			fmt.Sprintf("%.2f", r.Speed),
+			r.Issued,
+			r.Dispatcher,
+			r.Delivered,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
@@ -0,0 +1,213 @@
+package speed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestLedger_Query(t *testing.T) {
+	s := New(context.Background())
+	for _, ticket := range []*Ticket{
+		testTicket("UN1X", 1, 1000),
+		testTicket("UN1X", 2, 86400+1000),
+		testTicket("RE05BKG", 1, 2*86400+1000),
+		testTicket("RE05BKG", 2, 4*86400-10), // the 3rd and the 4th day
+	} {
+		_, err := s.outbox.issue(ticket)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter TicketFilter
+		want   []uint64
+	}{
+		{name: "all", want: []uint64{1, 2, 3, 4}},
+		{name: "plate", filter: TicketFilter{Plate: "UN1X"}, want: []uint64{1, 2}},
+		{name: "road", filter: TicketFilter{Road: ptr(uint16(1))}, want: []uint64{1, 3}},
+		{name: "from day", filter: TicketFilter{FromDay: ptr(uint32(2))}, want: []uint64{3, 4}},
+		{name: "to day", filter: TicketFilter{ToDay: ptr(uint32(1))}, want: []uint64{1, 2}},
+		{name: "day spanning ticket", filter: TicketFilter{FromDay: ptr(uint32(4)), ToDay: ptr(uint32(4))}, want: []uint64{4}},
+		{name: "combined", filter: TicketFilter{Plate: "RE05BKG", Road: ptr(uint16(2))}, want: []uint64{4}},
+		{name: "none", filter: TicketFilter{Plate: "NONE"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			var got []uint64
+			for _, e := range s.Tickets(tt.filter) {
+				got = append(got, e.ID)
+			}
+			is.Equal(got, tt.want)
+		})
+	}
+}
+
+func TestLedger_Delivery(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := Open(ctx, Options{Dir: dir})
+	is.NoErr(err)
+
+	delivered := testTicket("UN1X", 1, 1000)
+	_, err = s.outbox.issue(delivered)
+	is.NoErr(err)
+	_, err = s.outbox.issue(testTicket("RE05BKG", 2, 1000))
+	is.NoErr(err)
+
+	var buf syncBuffer
+	go s.subscribeForRoad(ctx, &buf, 1, "10.0.0.1:5000")
+	dispatched(t, &buf, delivered)
+	acked(t, dir, 1)
+	is.NoErr(s.Close())
+
+	// the deliveries survive the restart
+	s, err = Open(ctx, Options{Dir: dir})
+	is.NoErr(err)
+	defer func() {
+		_ = s.Close()
+	}()
+
+	entries := s.Tickets(TicketFilter{})
+	is.Equal(len(entries), 2)
+	is.Equal(entries[0].Ticket, *delivered)
+	is.Equal(entries[0].Dispatcher, "10.0.0.1:5000")
+	is.True(!entries[0].Pending())
+	is.True(!entries[0].Delivered.Before(entries[0].Issued))
+	is.True(entries[1].Pending())
+	is.Equal(entries[1].Dispatcher, "")
+}
+
+func TestLedger_Export(t *testing.T) {
+	is := is.New(t)
+
+	entries := []LedgerEntry{
+		{
+			ID:         1,
+			Ticket:     *testTicket("UN1X", 1, 1000),
+			Issued:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			Dispatcher: "10.0.0.1:5000",
+			Delivered:  time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC),
+		},
+		{
+			ID:     2,
+			Ticket: *testTicket("RE05BKG", 2, 86400),
+			Issued: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC),
+		},
+	}
+
+	var buf bytes.Buffer
+	is.NoErr(WriteCSV(&buf, entries))
+	is.Equal(buf.String(), strings.Join([]string{
+		"id,plate,road,mile1,timestamp1,mile2,timestamp2,speed,issued,dispatcher,delivered",
+		"1,UN1X,1,8,1000,9,1045,80.00,2024-05-01T12:00:00Z,10.0.0.1:5000,2024-05-01T12:00:01Z",
+		"2,RE05BKG,2,8,86400,9,86445,80.00,2024-05-01T13:00:00Z,,",
+		"",
+	}, "\n"))
+
+	buf.Reset()
+	is.NoErr(WriteJSON(&buf, entries))
+
+	var got []map[string]any
+	is.NoErr(json.Unmarshal(buf.Bytes(), &got))
+	is.Equal(len(got), 2)
+	is.Equal(got[0]["plate"], "UN1X")
+	is.Equal(got[0]["speed"], 80.0)
+	is.Equal(got[0]["dispatcher"], "10.0.0.1:5000")
+	is.Equal(got[1]["delivered"], "")
+
+	// no entries is an empty array, not null
+	buf.Reset()
+	is.NoErr(WriteJSON(&buf, nil))
+	is.Equal(strings.TrimSpace(buf.String()), "[]")
+}
+
+func TestLedger_Retention(t *testing.T) {
+	// delivered on the 1st, pending on the 2nd, delivered on the 3rd and on the 4th-5th day
+	issue := func(t *testing.T, o *outbox) {
+		t.Helper()
+		ctx := context.Background()
+
+		for i, ts := range []uint32{1000, 86400 + 1000, 2*86400 + 1000, 4*86400 - 10} {
+			road := uint16(i + 1)
+			if _, err := o.issue(testTicket("UN1X", road, ts)); err != nil {
+				t.Fatal(err)
+			}
+
+			if road != 2 {
+				pt, err := o.next(ctx, road)
+				if err != nil {
+					t.Fatal(err)
+				}
+				o.ack(pt, "dispatcher")
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		cutoffDay uint32
+		want      []uint64
+	}{
+		{name: "all kept", cutoffDay: 0, want: []uint64{1, 2, 3, 4}},
+		{name: "old delivered dropped", cutoffDay: 2, want: []uint64{2, 3, 4}},
+		{name: "day spanning ticket kept", cutoffDay: 4, want: []uint64{2, 4}},
+		{name: "pending kept", cutoffDay: 5, want: []uint64{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			quiet(t)
+
+			o := newOutbox()
+			issue(t, o)
+			is.NoErr(o.compact(tt.cutoffDay))
+
+			var got []uint64
+			for _, e := range o.tickets(TicketFilter{}) {
+				got = append(got, e.ID)
+			}
+			is.Equal(got, tt.want)
+		})
+	}
+
+	t.Run("retention", func(t *testing.T) {
+		is := is.New(t)
+		quiet(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		s, err := Open(ctx, Options{Retention: 48 * time.Hour})
+		is.NoErr(err)
+		issue(t, s.outbox)
+
+		s.latest = 5*86400 + 1000 // the retention starts on the 4th day
+		s.compact()
+
+		var got []uint64
+		for _, e := range s.Tickets(TicketFilter{}) {
+			got = append(got, e.ID)
+		}
+		is.Equal(got, []uint64{2, 4})
+	})
+}
@@ -1,11 +1,12 @@
 package speed
 
 import (
+	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 )
 
 // Plate represetns a plate message payload.
@@ -24,10 +25,28 @@ func (p *Plate) ReadFrom(r io.Reader) (int64, error) {
 	}
 
 	if err := binary.Read(r, binary.BigEndian, &p.Timestamp); err != nil {
+		return -1, unexpectedEOF(err)
+	}
+
+	return 1 + int64(len(p.Plate)) + 4, nil
+}
+
+// WriteTo implements io.WriterTo interface
+func (p *Plate) WriteTo(w io.Writer) (int64, error) {
+	if _, err := w.Write([]byte{TypePlate}); err != nil {
 		return -1, err
 	}
 
-	return int64(len(p.Plate)) + 4, nil
+	if err := WriteString(w, p.Plate); err != nil {
+		return -1, err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, p.Timestamp); err != nil {
+		return -1, err
+	}
+
+	// type + strlen + string + timestamp
+	return 1 + 1 + int64(len(p.Plate)) + 4, nil
 }
 
 // Camera represents camera message payload
@@ -40,12 +59,25 @@ type Camera struct {
 // ReadFrom implements io.ReaderFrom interface
 func (imc *Camera) ReadFrom(r io.Reader) (int64, error) {
 	if err := binary.Read(r, binary.BigEndian, imc); err != nil {
-		return -1, err
+		return -1, unexpectedEOF(err)
 	}
 
 	return 6, nil
 }
 
+// WriteTo implements io.WriterTo interface
+func (imc *Camera) WriteTo(w io.Writer) (int64, error) {
+	if _, err := w.Write([]byte{TypeIAMCamera}); err != nil {
+		return -1, err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, imc); err != nil {
+		return -1, err
+	}
+
+	return 1 + 6, nil
+}
+
 // Dispatcher represents the Dispatcher message payload.
 type Dispatcher struct {
 	NumRoads uint8
@@ -54,24 +86,32 @@ type Dispatcher struct {
 
 // ReadFrom implements io.ReaderFrom interface
 func (d *Dispatcher) ReadFrom(r io.Reader) (int64, error) {
-	var err error
-	var byteBuf [1]byte
-
-	if _, err = r.Read(byteBuf[:]); err != nil {
+	roads, err := readRoads(r, math.MaxUint8)
+	if err != nil {
 		return -1, err
 	}
-	d.NumRoads = byteBuf[0]
 
-	for i := 0; i < int(d.NumRoads); i++ {
-		var value uint16
-		if err = binary.Read(r, binary.BigEndian, &value); err != nil {
-			return -1, err
-		}
+	d.NumRoads = uint8(len(roads))
+	d.Roads = roads
 
-		d.Roads = append(d.Roads, value)
+	return 1 + int64(d.NumRoads)*2, nil
+}
+
+// WriteTo implements io.WriterTo interface. NumRoads is taken from the Roads.
+func (d *Dispatcher) WriteTo(w io.Writer) (int64, error) {
+	if len(d.Roads) > math.MaxUint8 {
+		return -1, fmt.Errorf("too many roads: %d", len(d.Roads))
+	}
+
+	if _, err := w.Write([]byte{TypeIAMDispatcher, uint8(len(d.Roads))}); err != nil {
+		return -1, err
+	}
+
+	if err := binary.Write(w, binary.BigEndian, d.Roads); err != nil {
+		return -1, err
 	}
 
-	return int64(d.NumRoads) * 2, nil
+	return 1 + 1 + int64(len(d.Roads))*2, nil
 }
 
 // PlateReading is a Plate reading message payload
@@ -94,9 +134,25 @@ type Ticket struct {
 	Info  TicketInfo
 }
 
+// ReadFrom implements io.ReaderFrom interface
+func (t *Ticket) ReadFrom(r io.Reader) (int64, error) {
+	var err error
+
+	t.Plate, err = ReadString(r)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &t.Info); err != nil {
+		return -1, unexpectedEOF(err)
+	}
+
+	return 1 + int64(len(t.Plate)) + 16, nil
+}
+
 // WriteTo implements io.WriterTo interface
 func (t *Ticket) WriteTo(w io.Writer) (int64, error) {
-	if _, err := w.Write([]byte{typeTicket}); err != nil {
+	if _, err := w.Write([]byte{TypeTicket}); err != nil {
 		return -1, err
 	}
 
@@ -111,32 +167,28 @@ func (t *Ticket) WriteTo(w io.Writer) (int64, error) {
 }
 
 // === Generic functions ==========================================================
+
+// writeError writes the Error message at once. The message is cut to the longest string.
 func writeError(w io.Writer, err error) {
 	log.Print(err.Error())
 
-	if _, err := w.Write([]byte{typeError}); err != nil {
-		log.Printf("failed to write error msg: %s", err.Error())
+	msg := err.Error()
+	if len(msg) > math.MaxUint8 {
+		msg = msg[:math.MaxUint8]
 	}
 
-	if err := WriteString(w, err.Error()); err != nil {
+	buf := bytes.NewBuffer([]byte{TypeError})
+	_ = WriteString(buf, msg) // writes to the buffer don't fail
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
 		log.Printf("failed to write error msg: %s", err.Error())
 	}
 }
 
-// ReadString reads a decoded string from io.Reader
+// ReadString reads a decoded string from io.Reader. EOF before the end of the string is an
+// io.ErrUnexpectedEOF.
 func ReadString(r io.Reader) (string, error) {
-	var sz [1]byte
-	_, err := r.Read(sz[:])
-	if errors.Is(err, io.EOF) {
-		return "", nil
-	} else if err != nil {
-		return "", fmt.Errorf("failed to read string size: %w", err)
-	}
-
-	buf := make([]byte, sz[0])
-	_, err = io.ReadFull(r, buf)
-
-	return string(buf), err
+	return readString(r, math.MaxUint8)
 }
 
 // WriteString writes an encoded string into io.Writer
@@ -0,0 +1,167 @@
+package speed
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sort"
+	"time"
+)
+
+// DefaultPruneInterval is used if no prune interval is set.
+const DefaultPruneInterval = time.Minute
+
+// insert adds the reading, keeping the readings sorted by the timestamp. It is inserted after
+// the readings with the same timestamp.
+func (r readings) insert(reading PlateReading) readings {
+	i := sort.Search(len(r), func(i int) bool {
+		return r[i].Timestamp > reading.Timestamp
+	})
+
+	return slices.Insert(r, i, reading)
+}
+
+// find returns the index of the reading or -1.
+func (r readings) find(reading PlateReading) int {
+	i := sort.Search(len(r), func(i int) bool {
+		return r[i].Timestamp >= reading.Timestamp
+	})
+
+	for ; i < len(r) && r[i].Timestamp == reading.Timestamp; i++ {
+		if r[i] == reading {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// since removes the readings before the cutoff timestamp. The readings are moved rather than
+// resliced, so the backing array doesn't keep the removed ones.
+func (r readings) since(cutoff uint32) readings {
+	i := sort.Search(len(r), func(i int) bool {
+		return r[i].Timestamp >= cutoff
+	})
+
+	return slices.Delete(r, 0, i)
+}
+
+// cutoff returns the timestamp the readings are kept since. Retention is relative to the newest
+// observed timestamp (the camera clocks), not to the wall clock. s.mu must be locked.
+func (s *Speed) cutoff() uint32 {
+	retention := uint32(s.opts.Retention / time.Second)
+	if retention == 0 || s.latest < retention {
+		return 0
+	}
+
+	return s.latest - retention
+}
+
+// advance moves the newest observed timestamp forward. A single timestamp more than the retention
+// past it (eg. from a camera with a wrong clock) would push all the other readings out of the
+// retention, so such a jump is made only once another reading confirms it.
+// The caller must hold the lock.
+func (s *Speed) advance(timestamp uint32) {
+	retention := uint32(s.opts.Retention / time.Second)
+	if retention == 0 || timestamp <= s.latest || timestamp-s.latest <= retention {
+		s.latest = max(s.latest, timestamp)
+		return
+	}
+
+	if s.ahead != 0 && max(timestamp, s.ahead)-min(timestamp, s.ahead) <= retention {
+		s.latest = max(timestamp, s.ahead)
+		s.ahead = 0
+		return
+	}
+
+	s.ahead = timestamp
+}
+
+// pruneTicketed removes the readings of the plate on the ticketed days. Any pair of readings
+// including such one covers an already ticketed day, so it can't result in another ticket.
+func (s *Speed) pruneTicketed(ticket *Ticket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day1, day2 := ticketDays(ticket)
+
+	roads := s.plates[ticket.Plate]
+	for road, records := range roads {
+		records = slices.DeleteFunc(records, func(r PlateReading) bool {
+			day := r.Timestamp / 86400
+			return day >= day1 && day <= day2
+		})
+
+		if len(records) == 0 {
+			delete(roads, road)
+		} else {
+			roads[road] = records
+		}
+	}
+
+	if len(roads) == 0 {
+		delete(s.plates, ticket.Plate)
+	}
+}
+
+// prune removes the readings out of the retention window, including the plates not observed
+// anymore.
+func (s *Speed) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := s.cutoff()
+	if cutoff == 0 {
+		return
+	}
+
+	var removed int
+	for plate, roads := range s.plates {
+		for road, records := range roads {
+			n := len(records)
+			records = records.since(cutoff)
+			removed += n - len(records)
+
+			if len(records) == 0 {
+				delete(roads, road)
+			} else {
+				roads[road] = records
+			}
+		}
+
+		if len(roads) == 0 {
+			delete(s.plates, plate)
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("Pruned %d readings before %d, %d plates observed", removed, cutoff, len(s.plates))
+	}
+}
+
+// compact forgets the ticketed days out of the retention and compacts the ticket journal.
+func (s *Speed) compact() {
+	s.mu.Lock()
+	cutoff := s.cutoff()
+	s.mu.Unlock()
+
+	if err := s.outbox.compact(cutoff / 86400); err != nil {
+		log.Println("Error ticket journal compaction:", err.Error())
+	}
+}
+
+func (s *Speed) pruneLoop(ctx context.Context) {
+	tick := time.NewTicker(s.opts.PruneInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-tick.C:
+			s.prune()
+			s.compact()
+		}
+	}
+}
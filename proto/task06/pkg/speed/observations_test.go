@@ -0,0 +1,239 @@
+package speed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func camera(road, mile, limit uint16) *clientState {
+	return &clientState{camera: &Camera{Road: road, Mile: mile, Limit: limit}}
+}
+
+// observe registers the plate as the camera does.
+func observe(s *Speed, state *clientState, plate string, ts uint32) {
+	p := &Plate{Plate: plate, Timestamp: ts}
+	s.registerPlate(p, state)
+	s.issueTickets(p, state)
+}
+
+func quiet(tb testing.TB) {
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func TestReadings_Insert(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   []uint32
+		want []uint32
+	}{
+		{name: "in order", ts: []uint32{1, 2, 3}, want: []uint32{1, 2, 3}},
+		{name: "reversed", ts: []uint32{3, 2, 1}, want: []uint32{1, 2, 3}},
+		{name: "shuffled", ts: []uint32{20, 5, 30, 10, 1}, want: []uint32{1, 5, 10, 20, 30}},
+		{name: "same timestamp", ts: []uint32{2, 1, 2}, want: []uint32{1, 2, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			var r readings
+			for i, ts := range tt.ts {
+				r = r.insert(PlateReading{Mile: uint16(i), Timestamp: ts})
+			}
+
+			got := make([]uint32, 0, len(r))
+			for _, reading := range r {
+				got = append(got, reading.Timestamp)
+			}
+			is.Equal(got, tt.want)
+
+			for i, ts := range tt.ts {
+				j := r.find(PlateReading{Mile: uint16(i), Timestamp: ts})
+				is.True(j >= 0)
+				is.Equal(r[j].Mile, uint16(i))
+			}
+			is.Equal(r.find(PlateReading{Mile: 99, Timestamp: 1}), -1)
+		})
+	}
+}
+
+func TestSpeed_Neighbours(t *testing.T) {
+	type observation struct {
+		mile uint16
+		ts   uint32
+	}
+
+	tests := []struct {
+		name         string
+		observations []observation
+		want         []TicketInfo
+	}{
+		{
+			name:         "out of order",
+			observations: []observation{{mile: 100, ts: 3600}, {mile: 0, ts: 0}},
+			want: []TicketInfo{{
+				Road:     1,
+				Reading1: PlateReading{Mile: 0, Timestamp: 0},
+				Reading2: PlateReading{Mile: 100, Timestamp: 3600},
+				Speed:    10000,
+			}},
+		},
+		{
+			// 0-100 over two hours is within the limit, the readings in between aren't
+			name:         "inserted between",
+			observations: []observation{{mile: 0, ts: 0}, {mile: 100, ts: 7200}, {mile: 70, ts: 3600}},
+			want: []TicketInfo{{
+				Road:     1,
+				Reading1: PlateReading{Mile: 0, Timestamp: 0},
+				Reading2: PlateReading{Mile: 70, Timestamp: 3600},
+				Speed:    7000,
+			}},
+		},
+		{
+			name:         "within the limit",
+			observations: []observation{{mile: 0, ts: 0}, {mile: 60, ts: 3600}, {mile: 100, ts: 7200}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			quiet(t)
+			s := New(context.Background())
+			s.limits[1] = 60
+
+			for _, o := range tt.observations {
+				observe(s, camera(1, o.mile, 60), "UN1X", o.ts)
+			}
+
+			var got []TicketInfo
+			for _, ticket := range s.outbox.pending[1] {
+				got = append(got, ticket.Info)
+			}
+			is.Equal(got, tt.want)
+		})
+	}
+}
+
+func TestSpeed_PruneTicketed(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+	s := New(context.Background())
+	s.limits[1] = 60
+	s.limits[2] = 60
+
+	observe(s, camera(2, 0, 60), "UN1X", 100)
+	observe(s, camera(1, 0, 60), "UN1X", 86400+100)
+	observe(s, camera(1, 0, 60), "UN1X", 0)
+	observe(s, camera(1, 90, 60), "UN1X", 3600)
+	is.Equal(len(s.outbox.pending[1]), 1)
+
+	// the readings on the ticketed day are gone from all the roads
+	is.Equal(len(s.plates["UN1X"]), 1)
+	is.Equal(s.plates["UN1X"][1], readings{{Mile: 0, Timestamp: 86400 + 100}})
+
+	// and so are the new ones
+	observe(s, camera(2, 0, 60), "UN1X", 7200)
+	is.Equal(len(s.plates["UN1X"]), 1)
+}
+
+func TestSpeed_Retention(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+	s, err := Open(context.Background(), Options{Retention: time.Hour})
+	is.NoErr(err)
+	s.limits[1] = 60
+
+	observe(s, camera(1, 0, 60), "UN1X", 1000)
+	observe(s, camera(1, 0, 60), "RE05BKG", 2000)
+	observe(s, camera(1, 10, 60), "RE05BKG", 5000)
+
+	// the reading is pruned on the next insert for the plate and road
+	observe(s, camera(1, 20, 60), "RE05BKG", 6000)
+	is.Equal(s.plates["RE05BKG"][1], readings{{Mile: 10, Timestamp: 5000}, {Mile: 20, Timestamp: 6000}})
+
+	// older than the newest timestamp minus the retention
+	observe(s, camera(1, 0, 60), "UN1X", 2000)
+	is.Equal(s.plates["UN1X"][1], readings{{Mile: 0, Timestamp: 1000}})
+
+	// the plates not observed anymore are pruned by the sweep
+	s.prune()
+	_, ok := s.plates["UN1X"]
+	is.True(!ok)
+	is.Equal(len(s.plates["RE05BKG"][1]), 2)
+}
+
+func TestSpeed_RetentionOutlier(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+	s, err := Open(context.Background(), Options{Retention: time.Hour})
+	is.NoErr(err)
+	s.limits[1] = 60
+
+	observe(s, camera(1, 0, 60), "RE05BKG", 100_000)
+
+	// a camera with a wrong clock doesn't push the others out of the retention
+	observe(s, camera(1, 10, 60), "FUTUR3", 4_000_000_000)
+	observe(s, camera(1, 0, 60), "UN1X", 100_100)
+	observe(s, camera(1, 10, 60), "UN1X", 100_400) // 120 mph
+	is.Equal(len(s.outbox.pending[1]), 1)
+	is.Equal(s.outbox.pending[1][0].Plate, "UN1X")
+	is.Equal(s.cutoff(), uint32(100_400-3600))
+
+	// a jump confirmed by another reading moves the retention
+	observe(s, camera(1, 20, 60), "RE05BKG", 200_000)
+	is.Equal(s.cutoff(), uint32(100_400-3600))
+	observe(s, camera(1, 30, 60), "UN1X", 200_100)
+	is.Equal(s.cutoff(), uint32(200_100-3600))
+}
+
+func BenchmarkSpeed_Observe(b *testing.B) {
+	for _, plates := range []int{1_000_000, 4_000_000} {
+		b.Run(fmt.Sprintf("plates=%d", plates), func(b *testing.B) {
+			quiet(b)
+			s, err := Open(context.Background(), Options{Retention: 24 * time.Hour})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			const roads = 16
+			cameras := make([]*clientState, 0, roads*4)
+			for road := uint16(0); road < roads; road++ {
+				s.limits[road] = 60
+				for mile := uint16(0); mile < 4; mile++ {
+					cameras = append(cameras, camera(road, mile*10, 60))
+				}
+			}
+
+			names := make([]string, plates)
+			for i := range names {
+				names[i] = fmt.Sprintf("P%07d", i)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			// every plate passes the cameras of a road about every 10 minutes, most of them
+			// within the limit
+			for i := 0; i < b.N; i++ {
+				plate := i % plates
+				pass := i / plates
+				state := cameras[(plate%roads)*4+pass%4]
+				observe(s, state, names[plate], uint32(pass*600+plate%600))
+			}
+
+			b.StopTimer()
+			s.prune()
+		})
+	}
+}
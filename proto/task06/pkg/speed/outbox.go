@@ -0,0 +1,417 @@
+package speed
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalName is the outbox journal file within the data directory.
+const journalName = "tickets.log"
+
+// Journal operations
+const (
+	opIssue   = "issue"   // the ticket was issued and queued for the dispatch (delivered if compacted)
+	opAck     = "ack"     // the ticket was written to a dispatcher
+	opCompact = "compact" // the journal was compacted - ID is the last issued one
+)
+
+// journalRecord is a single JSON line of the journal.
+type journalRecord struct {
+	Op         string     `json:"op"`
+	ID         uint64     `json:"id"`
+	Time       time.Time  `json:"time"`
+	Ticket     *Ticket    `json:"ticket,omitempty"`
+	Dispatcher string     `json:"dispatcher,omitempty"` // address the ticket was delivered to
+	Delivered  *time.Time `json:"delivered,omitempty"`  // issue and ack merged by the compaction
+}
+
+// pendingTicket is a ticket waiting for a dispatcher of its road.
+type pendingTicket struct {
+	id uint64
+	*Ticket
+}
+
+// outbox keeps the issued tickets until they are delivered to a dispatcher of their road.
+//
+// Delivery is at-least-once: a ticket is journaled (and synced) before it is queued, and it is
+// acknowledged only once it was written to a dispatcher. A ticket whose write fails is put back
+// in front of the queue for another dispatcher, and the tickets not acknowledged before a
+// restart are queued again. The days a plate was ticketed on are restored from the journal, so
+// no second ticket is issued for the same day after a restart.
+//
+// The journal is compacted into a snapshot of the tickets still needed: the pending ones and the
+// ones covering a day within the retention. The older days are forgotten - no reading of them is
+// accepted anymore, so they can't be ticketed again.
+type outbox struct {
+	mu      sync.Mutex
+	journal *os.File // nil for the in-memory outbox
+	records int      // in the journal
+	nextID  uint64
+	days    map[string]map[uint32]struct{} // ticketed days per plate
+	pending map[uint16][]pendingTicket     // per road
+	notify  map[uint16]chan struct{}       // closed when a ticket is queued for the road
+	ledger  ledger                         // the issued tickets retained by the compaction
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		nextID:  1,
+		days:    make(map[string]map[uint32]struct{}),
+		pending: make(map[uint16][]pendingTicket),
+		notify:  make(map[uint16]chan struct{}),
+		ledger:  newLedger(),
+	}
+}
+
+// openOutbox restores the outbox from the journal in the data directory (creating it if needed).
+// A partially written record at the tail of the journal (eg. after a crash) is discarded.
+func openOutbox(dir string) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ticket journal: %w", err)
+	}
+
+	o := newOutbox()
+	if err := o.replay(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	o.journal = f
+
+	var n int
+	for _, q := range o.pending {
+		n += len(q)
+	}
+	log.Printf("Restored the ticket journal: %d plates ticketed, %d tickets pending", len(o.days), n)
+
+	return o, nil
+}
+
+func (o *outbox) replay(f *os.File) error {
+	acked := make(map[uint64]bool)
+
+	var issued []pendingTicket
+	var valid int64
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Discarding the torn tail of the ticket journal (%d bytes)", len(line))
+			}
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read ticket journal: %w", err)
+		}
+
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Printf("Discarding the ticket journal after %d bytes: %s", valid, err.Error())
+			break
+		}
+		valid += int64(len(line))
+		o.records++
+
+		switch rec.Op {
+		case opIssue:
+			if rec.Ticket != nil {
+				o.markDays(rec.Ticket)
+				o.ledger.issued(rec.ID, rec.Ticket, rec.Time)
+				issued = append(issued, pendingTicket{id: rec.ID, Ticket: rec.Ticket})
+			}
+
+			if rec.Delivered != nil {
+				acked[rec.ID] = true
+				o.ledger.delivered(rec.ID, rec.Dispatcher, *rec.Delivered)
+			}
+		case opAck:
+			acked[rec.ID] = true
+			o.ledger.delivered(rec.ID, rec.Dispatcher, rec.Time)
+		}
+
+		o.nextID = max(o.nextID, rec.ID+1)
+	}
+
+	for _, t := range issued {
+		if !acked[t.id] {
+			o.pending[t.Info.Road] = append(o.pending[t.Info.Road], t)
+		}
+	}
+
+	if err := f.Truncate(valid); err != nil {
+		return fmt.Errorf("failed to truncate ticket journal: %w", err)
+	}
+
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek ticket journal: %w", err)
+	}
+
+	return nil
+}
+
+// ticketDays returns the first and the last day covered by the ticket.
+func ticketDays(t *Ticket) (uint32, uint32) {
+	return t.Info.Reading1.Timestamp / 86400, t.Info.Reading2.Timestamp / 86400
+}
+
+func (o *outbox) markDays(t *Ticket) {
+	days, ok := o.days[t.Plate]
+	if !ok {
+		days = make(map[uint32]struct{})
+		o.days[t.Plate] = days
+	}
+
+	day1, day2 := ticketDays(t)
+	for i := day1; i <= day2; i++ {
+		days[i] = struct{}{}
+	}
+}
+
+// ticketed reports whether the plate has been ticketed on the day.
+func (o *outbox) ticketed(plate string, day uint32) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, ok := o.days[plate][day]
+	return ok
+}
+
+// issue queues the ticket for the dispatch unless the plate has already been ticketed on any of
+// its days. The ticket is journaled first - it is not issued if that fails.
+func (o *outbox) issue(t *Ticket) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	day1, day2 := ticketDays(t)
+	for i := day1; i <= day2; i++ {
+		if _, ok := o.days[t.Plate][i]; ok {
+			log.Printf("%s has already been ticketed on the %d day", t.Plate, i)
+			return false, nil
+		}
+	}
+
+	id, now := o.nextID, time.Now()
+	if err := o.write(journalRecord{Op: opIssue, ID: id, Time: now, Ticket: t}, true); err != nil {
+		return false, err
+	}
+	o.nextID++
+
+	o.markDays(t)
+	o.ledger.issued(id, t, now)
+	o.push(pendingTicket{id: id, Ticket: t}, false)
+
+	return true, nil
+}
+
+// push queues the ticket (in front if it's being redelivered) and wakes the road dispatchers.
+// The outbox must be locked.
+func (o *outbox) push(t pendingTicket, front bool) {
+	road := t.Info.Road
+	if front {
+		o.pending[road] = append([]pendingTicket{t}, o.pending[road]...)
+	} else {
+		o.pending[road] = append(o.pending[road], t)
+	}
+
+	if ch, ok := o.notify[road]; ok {
+		close(ch)
+		delete(o.notify, road)
+	}
+}
+
+// next waits for a ticket for the road. The ticket must be either acked or requeued.
+func (o *outbox) next(ctx context.Context, road uint16) (pendingTicket, error) {
+	for {
+		o.mu.Lock()
+		if q := o.pending[road]; len(q) > 0 {
+			t := q[0]
+			o.pending[road] = q[1:]
+			o.mu.Unlock()
+
+			return t, nil
+		}
+
+		ch, ok := o.notify[road]
+		if !ok {
+			ch = make(chan struct{})
+			o.notify[road] = ch
+		}
+		o.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return pendingTicket{}, ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+// ack records the delivery of the ticket to the dispatcher. A lost ack only means a redelivery
+// after a restart, so it is not synced.
+func (o *outbox) ack(t pendingTicket, dispatcher string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	o.ledger.delivered(t.id, dispatcher, now)
+
+	if err := o.write(journalRecord{Op: opAck, ID: t.id, Time: now, Dispatcher: dispatcher}, false); err != nil {
+		log.Println("Error ticket ack:", err.Error())
+	}
+}
+
+// tickets returns the ledger entries matching the filter.
+func (o *outbox) tickets(f TicketFilter) []LedgerEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.ledger.query(f)
+}
+
+// requeue puts back the ticket whose delivery failed.
+func (o *outbox) requeue(t pendingTicket) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.push(t, true)
+}
+
+// write appends the record to the journal (if any). The outbox must be locked.
+func (o *outbox) write(rec journalRecord, sync bool) error {
+	if o.journal == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := o.journal.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write ticket journal: %w", err)
+	}
+	o.records++
+
+	if sync {
+		return o.journal.Sync()
+	}
+
+	return nil
+}
+
+// retained reports whether the ledger entry is still needed with the days before cutoffDay
+// forgotten.
+func retained(e *LedgerEntry, cutoffDay uint32) bool {
+	_, day2 := ticketDays(&e.Ticket)
+	return e.Pending() || day2 >= cutoffDay
+}
+
+// compact forgets the ticketed days and the ledger entries before cutoffDay (0 keeps all of them)
+// and rewrites the journal with the retained tickets once it has grown twice as big as the
+// snapshot.
+func (o *outbox) compact(cutoffDay uint32) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for plate, days := range o.days {
+		for day := range days {
+			if day < cutoffDay {
+				delete(days, day)
+			}
+		}
+
+		if len(days) == 0 {
+			delete(o.days, plate)
+		}
+	}
+
+	o.ledger.prune(cutoffDay)
+
+	if o.journal == nil || o.records <= 2*(len(o.ledger.entries)+1) {
+		return nil
+	}
+
+	return o.rewrite(o.ledger.entries)
+}
+
+// rewrite replaces the journal with the snapshot of the ledger entries. The outbox must be
+// locked.
+func (o *outbox) rewrite(snapshot []*LedgerEntry) error {
+	path := o.journal.Name()
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600) // #nosec G304 -- the data directory
+	if err != nil {
+		return fmt.Errorf("failed to create compacted ticket journal: %w", err)
+	}
+
+	recs := make([]journalRecord, 0, len(snapshot)+1)
+	recs = append(recs, journalRecord{Op: opCompact, ID: o.nextID - 1, Time: time.Now()})
+	for _, e := range snapshot {
+		rec := journalRecord{Op: opIssue, ID: e.ID, Time: e.Issued, Ticket: &e.Ticket}
+		if !e.Pending() {
+			rec.Dispatcher, rec.Delivered = e.Dispatcher, &e.Delivered
+		}
+		recs = append(recs, rec)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("failed to write compacted ticket journal: %w", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write compacted ticket journal: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to sync compacted ticket journal: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to replace ticket journal: %w", err)
+	}
+
+	_ = o.journal.Close()
+
+	// the renamed file is still open and positioned at its end - keep appending to it
+	o.journal, o.records = f, len(recs)
+	log.Printf("Compacted the ticket journal: %d tickets", len(snapshot))
+
+	return nil
+}
+
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.journal == nil {
+		return nil
+	}
+
+	err := o.journal.Close()
+	o.journal = nil
+
+	return err
+}
@@ -0,0 +1,308 @@
+package speed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func testTicket(plate string, road uint16, ts uint32) *Ticket {
+	return &Ticket{
+		Plate: plate,
+		Info: TicketInfo{
+			Road:     road,
+			Reading1: PlateReading{Mile: 8, Timestamp: ts},
+			Reading2: PlateReading{Mile: 9, Timestamp: ts + 45},
+			Speed:    8000,
+		},
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// syncBuffer is a buffer the dispatcher can write to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// dispatched waits until the tickets are written to the buffer and compares their encoding.
+func dispatched(t *testing.T, buf *syncBuffer, tickets ...*Ticket) {
+	t.Helper()
+
+	var want bytes.Buffer
+	for _, ticket := range tickets {
+		if _, err := ticket.WriteTo(&want); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(buf.Bytes()) >= want.Len() {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := buf.Bytes(); !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("dispatched %x, want %x", got, want.Bytes())
+	}
+}
+
+// acked waits until the delivery of the ticket is journaled.
+func acked(t *testing.T, dir string, id int) {
+	t.Helper()
+
+	ack := fmt.Sprintf(`{"op":"ack","id":%d,`, id)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(filepath.Join(dir, journalName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(ack)) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("ticket %d not acked", id)
+}
+
+func TestOutbox_Days(t *testing.T) {
+	tests := []struct {
+		name   string
+		issued []*Ticket
+		want   []bool
+	}{
+		{
+			name:   "same day",
+			issued: []*Ticket{testTicket("UN1X", 1, 1000), testTicket("UN1X", 1, 2000)},
+			want:   []bool{true, false},
+		},
+		{
+			name:   "other road same day",
+			issued: []*Ticket{testTicket("UN1X", 1, 1000), testTicket("UN1X", 2, 2000)},
+			want:   []bool{true, false},
+		},
+		{
+			name:   "next day",
+			issued: []*Ticket{testTicket("UN1X", 1, 1000), testTicket("UN1X", 1, 86400+1000)},
+			want:   []bool{true, true},
+		},
+		{
+			name:   "spanning an already ticketed day",
+			issued: []*Ticket{testTicket("UN1X", 1, 86400+10), testTicket("UN1X", 1, 86400-10)},
+			want:   []bool{true, false},
+		},
+		{
+			name:   "other plate",
+			issued: []*Ticket{testTicket("UN1X", 1, 1000), testTicket("RE05BKG", 1, 1000)},
+			want:   []bool{true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			o := newOutbox()
+
+			for i, ticket := range tt.issued {
+				ok, err := o.issue(ticket)
+				is.NoErr(err)
+				is.Equal(ok, tt.want[i])
+			}
+		})
+	}
+}
+
+func TestOutbox_Redelivery(t *testing.T) {
+	is := is.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := New(ctx)
+
+	ticket := testTicket("UN1X", 42, 1000)
+	ok, err := s.outbox.issue(ticket)
+	is.NoErr(err)
+	is.True(ok)
+
+	// the broken dispatcher gives up the ticket
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.subscribeForRoad(ctx, failingWriter{}, 42, "dispatcher")
+	}()
+	<-done
+
+	var buf syncBuffer
+	go s.subscribeForRoad(ctx, &buf, 42, "dispatcher")
+
+	dispatched(t, &buf, ticket)
+}
+
+func TestOutbox_Restart(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := Open(ctx, Options{Dir: dir})
+	is.NoErr(err)
+
+	// delivered before the restart
+	delivered := testTicket("UN1X", 1, 1000)
+	ok, err := s.outbox.issue(delivered)
+	is.NoErr(err)
+	is.True(ok)
+
+	var buf syncBuffer
+	subCtx, subCancel := context.WithCancel(ctx)
+	go s.subscribeForRoad(subCtx, &buf, 1, "dispatcher")
+	dispatched(t, &buf, delivered)
+	acked(t, dir, 1)
+	subCancel()
+
+	// pending at the restart
+	pending := testTicket("RE05BKG", 2, 1000)
+	ok, err = s.outbox.issue(pending)
+	is.NoErr(err)
+	is.True(ok)
+	is.NoErr(s.Close())
+
+	// a torn record of the crash
+	f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_WRONLY|os.O_APPEND, 0o600)
+	is.NoErr(err)
+	_, err = f.WriteString(`{"op":"issue","id":3,"tic`)
+	is.NoErr(err)
+	is.NoErr(f.Close())
+
+	s, err = Open(ctx, Options{Dir: dir})
+	is.NoErr(err)
+	defer func() {
+		_ = s.Close()
+	}()
+
+	// no second ticket for the same days
+	ok, err = s.outbox.issue(testTicket("UN1X", 1, 2000))
+	is.NoErr(err)
+	is.True(!ok)
+
+	ok, err = s.outbox.issue(testTicket("RE05BKG", 2, 3000))
+	is.NoErr(err)
+	is.True(!ok)
+
+	// only the pending ticket is dispatched again
+	is.Equal(len(s.outbox.pending[1]), 0)
+	is.Equal(len(s.outbox.pending[2]), 1)
+
+	var redelivered syncBuffer
+	go s.subscribeForRoad(ctx, &redelivered, 2, "dispatcher")
+	dispatched(t, &redelivered, pending)
+
+	// the journal keeps going after the torn record
+	ok, err = s.outbox.issue(testTicket("UN1X", 1, 86400+1000))
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(s.outbox.nextID, uint64(4))
+}
+
+func TestOutbox_Compact(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := openOutbox(dir)
+	is.NoErr(err)
+
+	// delivered on the 1st and the 5th day, pending from the 1st day
+	var tickets []*Ticket
+	for i := 0; i < 4; i++ {
+		tickets = append(tickets, testTicket(fmt.Sprintf("OLD%d", i), 1, 86400+1000))
+	}
+	tickets = append(tickets, testTicket("RECENT", 2, 5*86400+1000), testTicket("PENDING", 3, 86400+1000))
+
+	for _, ticket := range tickets {
+		ok, err := o.issue(ticket)
+		is.NoErr(err)
+		is.True(ok)
+	}
+
+	for _, road := range []uint16{1, 1, 1, 1, 2} {
+		pt, err := o.next(ctx, road)
+		is.NoErr(err)
+		o.ack(pt, "dispatcher")
+	}
+
+	// the days before the 3rd are forgotten, the pending and the recent tickets are kept
+	is.NoErr(o.compact(3))
+	is.True(!o.ticketed("OLD0", 1))
+	is.True(!o.ticketed("PENDING", 1))
+	is.True(o.ticketed("RECENT", 5))
+
+	data, err := os.ReadFile(filepath.Join(dir, journalName))
+	is.NoErr(err)
+	is.Equal(bytes.Count(data, []byte("\n")), 3) // the header and 2 tickets
+
+	// compacted again only once it doubles
+	is.NoErr(o.compact(3))
+	is.Equal(o.records, 3)
+
+	// and it keeps going after the compaction
+	ok, err := o.issue(testTicket("NEW", 4, 6*86400))
+	is.NoErr(err)
+	is.True(ok)
+	is.NoErr(o.close())
+
+	o, err = openOutbox(dir)
+	is.NoErr(err)
+	defer func() {
+		_ = o.close()
+	}()
+
+	is.Equal(o.nextID, uint64(8))
+	is.True(o.ticketed("RECENT", 5))
+	is.True(!o.ticketed("OLD0", 1))
+	is.Equal(len(o.pending[2]), 0) // delivered before the compaction
+	is.Equal(len(o.pending[3]), 1)
+	is.Equal(len(o.pending[4]), 1)
+
+	entries := o.tickets(TicketFilter{})
+	is.Equal(len(entries), 3)
+	is.Equal(entries[0].Ticket.Plate, "RECENT")
+	is.Equal(entries[0].Dispatcher, "dispatcher")
+	is.True(!entries[0].Pending())
+	is.True(entries[1].Pending())
+}
@@ -0,0 +1,341 @@
+package sim
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"proto/task06/pkg/speed"
+)
+
+// Defaults used for the unset Options
+const (
+	DefaultTimeout = 30 * time.Second
+	DefaultSettle  = time.Second
+)
+
+// Options configures the simulation run.
+type Options struct {
+	Timeout time.Duration // how long the expected tickets are waited for
+	Settle  time.Duration // how long the duplicate tickets are waited for afterwards
+
+	// Dial connects to the speed daemon (a TCP connection if nil).
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Report is the outcome of the simulation.
+type Report struct {
+	Cameras      int
+	Dispatchers  int
+	Observations int
+	Expected     int // tickets
+	Received     int // tickets
+	Elapsed      time.Duration
+	Mismatches   []Mismatch
+}
+
+// OK reports whether the tickets received are exactly the expected ones.
+func (r *Report) OK() bool {
+	return len(r.Mismatches) == 0
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("%d cameras, %d dispatchers: %d observations sent, %d tickets expected, "+
+		"%d received in %s, %d mismatches", r.Cameras, r.Dispatchers, r.Observations, r.Expected,
+		r.Received, r.Elapsed.Round(time.Millisecond), len(r.Mismatches))
+}
+
+// run is the state of a single simulation.
+type run struct {
+	addr string
+	opts Options
+
+	stop    chan struct{} // closed once the tickets are not awaited anymore
+	tickets chan speed.Ticket
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	errors []Mismatch
+}
+
+// Run connects the cameras and the dispatchers of the plan to the speed daemon at the address,
+// sends the observations and verifies the tickets received.
+func Run(ctx context.Context, addr string, plan *Plan, opts Options) (*Report, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = DefaultSettle
+	}
+	if opts.Dial == nil {
+		opts.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+
+	r := &run{
+		addr:    addr,
+		opts:    opts,
+		stop:    make(chan struct{}),
+		tickets: make(chan speed.Ticket),
+	}
+	defer r.close()
+
+	start := time.Now()
+	report := &Report{Observations: len(plan.Observations), Expected: plan.Expected()}
+
+	dispatchers := plan.dispatchers()
+	for _, roads := range dispatchers {
+		if err := r.dispatcher(ctx, roads); err != nil {
+			return nil, err
+		}
+	}
+	report.Dispatchers = len(dispatchers)
+
+	cameras, err := r.cameras(ctx, plan)
+	if err != nil {
+		return nil, err
+	}
+	report.Cameras = cameras
+
+	var received []speed.Ticket
+	collect := func(deadline <-chan time.Time, until func() bool) error {
+		for !until() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-deadline:
+				return nil
+			case t := <-r.tickets:
+				received = append(received, t)
+			}
+		}
+		return nil
+	}
+
+	if err := collect(time.After(opts.Timeout), func() bool { return len(received) >= report.Expected }); err != nil {
+		return nil, err
+	}
+	if err := collect(time.After(opts.Settle), func() bool { return false }); err != nil {
+		return nil, err
+	}
+
+	report.Received = len(received)
+	report.Elapsed = time.Since(start)
+
+	r.close()
+	report.Mismatches = append(r.errors, plan.Verify(received)...)
+
+	return report, nil
+}
+
+// dispatchers splits the roads among the dispatchers. Every road has at least one.
+func (p *Plan) dispatchers() [][]uint16 {
+	ids := make([]uint16, 0, len(p.Roads))
+	for id := range p.Roads {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	n := p.scenario.Dispatchers
+	res := make([][]uint16, n)
+	for i := 0; i < max(n, len(ids)); i++ {
+		res[i%n] = append(res[i%n], ids[i%len(ids)])
+	}
+
+	return res
+}
+
+func (r *run) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := r.opts.Dial(ctx, r.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns = append(r.conns, conn)
+
+	return conn, nil
+}
+
+func (r *run) dispatcher(ctx context.Context, roads []uint16) error {
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := (&speed.Dispatcher{Roads: roads}).WriteTo(conn); err != nil {
+		return fmt.Errorf("failed to register dispatcher: %w", err)
+	}
+
+	r.wg.Add(1)
+	go r.read(conn, fmt.Sprintf("dispatcher %v", roads))
+
+	return nil
+}
+
+// cameras connects a camera per road and mile and sends the observations in the plan order.
+// It returns the number of the cameras.
+func (r *run) cameras(ctx context.Context, plan *Plan) (int, error) {
+	type camera struct {
+		w     *bufio.Writer
+		queue chan speed.Plate
+	}
+
+	cameras := make(map[speed.Camera]*camera)
+	for _, o := range plan.Observations {
+		if _, ok := cameras[o.Camera]; ok {
+			continue
+		}
+
+		conn, err := r.dial(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := o.Camera.WriteTo(conn); err != nil {
+			return 0, fmt.Errorf("failed to register camera: %w", err)
+		}
+
+		r.wg.Add(1)
+		go r.read(conn, fmt.Sprintf("camera %d/%d", o.Camera.Road, o.Camera.Mile))
+
+		cameras[o.Camera] = &camera{w: bufio.NewWriter(conn), queue: make(chan speed.Plate, 64)}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(cameras))
+	for _, c := range cameras {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// the queue is drained after an error, so the observations don't block
+			var err error
+			for plate := range c.queue {
+				if err != nil {
+					continue
+				}
+
+				if _, err = plate.WriteTo(c.w); err == nil && len(c.queue) == 0 {
+					// flush when there's nothing more to send right away
+					err = c.w.Flush()
+				}
+
+				if err != nil {
+					errs <- fmt.Errorf("failed to send plate: %w", err)
+				}
+			}
+		}()
+	}
+
+	for _, o := range plan.Observations {
+		cameras[o.Camera].queue <- o.Plate
+	}
+	for _, c := range cameras {
+		close(c.queue)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return 0, err
+	default:
+		return len(cameras), nil
+	}
+}
+
+// read receives the messages of the server until the connection is closed.
+func (r *run) read(conn net.Conn, client string) {
+	defer r.wg.Done()
+
+	rd := bufio.NewReader(conn)
+	for {
+		kind, err := rd.ReadByte()
+		if err != nil {
+			r.failed(client, err)
+			return
+		}
+
+		switch kind {
+		case speed.TypeTicket:
+			var t speed.Ticket
+			if _, err := t.ReadFrom(rd); err != nil {
+				r.failed(client, err)
+				return
+			}
+
+			select {
+			case r.tickets <- t:
+			case <-r.stop:
+				return
+			}
+
+		case speed.TypeError:
+			msg, err := speed.ReadString(rd)
+			if err != nil {
+				r.failed(client, err)
+				return
+			}
+			r.error(fmt.Sprintf("%s: server error: %s", client, msg))
+
+		case speed.TypeHeartbeat:
+			// not requested, but harmless
+
+		default:
+			r.error(fmt.Sprintf("%s: unexpected message type 0x%02x", client, kind))
+			return
+		}
+	}
+}
+
+// failed records the connection error, unless the run is over.
+func (r *run) failed(client string, err error) {
+	select {
+	case <-r.stop:
+		return
+	default:
+	}
+
+	if errors.Is(err, io.EOF) {
+		r.error(client + ": disconnected by the server")
+		return
+	}
+
+	r.error(fmt.Sprintf("%s: %s", client, err.Error()))
+}
+
+func (r *run) error(detail string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errors = append(r.errors, Mismatch{Kind: KindError, Detail: detail})
+}
+
+// close disconnects all the clients and waits for their readers.
+func (r *run) close() {
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+		r.mu.Unlock()
+		return
+	default:
+		close(r.stop)
+	}
+
+	for _, conn := range r.conns {
+		_ = conn.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
@@ -0,0 +1,446 @@
+// Package sim drives simulated traffic through the speed daemon: cameras report the cars passing
+// them and dispatchers verify that every expected ticket is received exactly once per plate and
+// day.
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sort"
+
+	"proto/task06/pkg/speed"
+)
+
+// Profile is the speed profile of a car trip.
+type Profile string
+
+// Profiles
+const (
+	Steady   Profile = "steady"   // every segment within the limit
+	Burst    Profile = "burst"    // a single segment over the limit
+	Speeding Profile = "speeding" // every segment over the limit
+)
+
+// Road is a road with the cameras.
+type Road struct {
+	ID    uint16   `json:"id"`
+	Limit uint16   `json:"limit"` // mph
+	Miles []uint16 `json:"miles"` // camera positions
+}
+
+// Scenario describes the simulated traffic.
+//
+// Every car makes Trips trips on random roads, each on another day, passing all the cameras of
+// the road in either direction. The trips of a car are two days apart, so that a pair of
+// readings of different trips is never over the limit.
+type Scenario struct {
+	Roads       []Road          `json:"roads"`
+	Cars        int             `json:"cars"`
+	Trips       int             `json:"trips"`       // per car
+	Profiles    map[Profile]int `json:"profiles"`    // relative weights of the trip profiles
+	Dispatchers int             `json:"dispatchers"` // the roads are split among them
+	Shuffle     bool            `json:"shuffle"`     // send the plates in a random order, not by time
+	Seed        uint64          `json:"seed"`
+}
+
+// DefaultScenario returns a small scenario with three roads.
+func DefaultScenario() Scenario {
+	return Scenario{
+		Roads: []Road{
+			{ID: 1, Limit: 60, Miles: []uint16{0, 10, 25, 40}},
+			{ID: 2, Limit: 30, Miles: []uint16{100, 102, 105}},
+			{ID: 3, Limit: 100, Miles: []uint16{500, 600, 800, 900, 1000}},
+		},
+		Cars:        500,
+		Trips:       3,
+		Profiles:    map[Profile]int{Steady: 6, Burst: 3, Speeding: 1},
+		Dispatchers: 2,
+		Seed:        1,
+	}
+}
+
+// Load reads the JSON scenario.
+func Load(path string) (Scenario, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- the path is the given scenario file
+	if err != nil {
+		return Scenario{}, err
+	}
+
+	var sc Scenario
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return Scenario{}, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+
+	return sc, nil
+}
+
+// validate checks the scenario and the constraints the expectations rely on.
+func (sc Scenario) validate() error {
+	if len(sc.Roads) == 0 {
+		return errors.New("no roads")
+	}
+
+	if sc.Cars <= 0 || sc.Trips <= 0 {
+		return errors.New("no cars or trips")
+	}
+
+	if sc.Dispatchers <= 0 {
+		return errors.New("no dispatchers")
+	}
+
+	var weight int
+	for p, w := range sc.Profiles {
+		switch p {
+		case Steady, Burst, Speeding:
+		default:
+			return fmt.Errorf("unknown profile: %s", p)
+		}
+		weight += w
+	}
+	if weight <= 0 {
+		return errors.New("no profiles")
+	}
+
+	ids := make(map[uint16]bool)
+	for _, road := range sc.Roads {
+		if ids[road.ID] {
+			return fmt.Errorf("road %d: duplicate", road.ID)
+		}
+		ids[road.ID] = true
+
+		if road.Limit < 10 {
+			return fmt.Errorf("road %d: limit below 10mph", road.ID)
+		}
+
+		if len(road.Miles) < 2 {
+			return fmt.Errorf("road %d: less than two cameras", road.ID)
+		}
+
+		miles := make(map[uint16]bool)
+		for _, mile := range road.Miles {
+			if miles[mile] {
+				return fmt.Errorf("road %d: two cameras at mile %d", road.ID, mile)
+			}
+			miles[mile] = true
+		}
+
+		// the slowest trip must fit in a day and the readings of the trips of a car (at least
+		// a day apart) must be within the limit
+		distance := float64(span(road.Miles))
+		if distance/minSpeed(road.Limit)*3600 >= 86400/2 || distance/24 >= float64(road.Limit)-1 {
+			return fmt.Errorf("road %d: too long for the limit", road.ID)
+		}
+	}
+
+	return nil
+}
+
+// span returns the distance between the first and the last camera.
+func span(miles []uint16) uint16 {
+	lo, hi := miles[0], miles[0]
+	for _, mile := range miles {
+		lo, hi = min(lo, mile), max(hi, mile)
+	}
+
+	return hi - lo
+}
+
+// Speeds within the limit are at least 5mph below it and the ones over the limit at least 5mph
+// above it, so that the rounding of the timestamps doesn't make them ambiguous.
+func minSpeed(limit uint16) float64 { return math.Max(float64(limit)/2, 5) }
+func maxSpeed(limit uint16) float64 { return float64(limit) - 5 }
+func minOver(limit uint16) float64  { return float64(limit) + 5 }
+func maxOver(limit uint16) float64  { return float64(limit)*1.5 + 5 }
+
+// Observation is a plate reported by a camera.
+type Observation struct {
+	Camera speed.Camera
+	Plate  speed.Plate
+}
+
+// Plan is the traffic generated from a scenario with the tickets expected.
+type Plan struct {
+	Observations []Observation
+	Roads        map[uint16]Road
+
+	scenario Scenario
+	expected map[string]map[uint32]bool                 // plate -> day -> speeding
+	readings map[string]map[uint16][]speed.PlateReading // plate -> road -> readings
+}
+
+// Expected returns the number of the tickets expected.
+func (p *Plan) Expected() int {
+	var n int
+	for _, days := range p.expected {
+		n += len(days)
+	}
+
+	return n
+}
+
+// NewPlan generates the traffic of the scenario.
+func NewPlan(sc Scenario) (*Plan, error) {
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+
+	rnd := rand.New(rand.NewPCG(sc.Seed, sc.Seed)) // #nosec G404 -- reproducible traffic
+
+	p := &Plan{
+		Roads:    make(map[uint16]Road),
+		scenario: sc,
+		expected: make(map[string]map[uint32]bool),
+		readings: make(map[string]map[uint16][]speed.PlateReading),
+	}
+	for _, road := range sc.Roads {
+		p.Roads[road.ID] = road
+	}
+
+	profiles := make([]Profile, 0, len(sc.Profiles))
+	for profile := range sc.Profiles {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i] < profiles[j] })
+
+	var weight int
+	for _, profile := range profiles {
+		weight += sc.Profiles[profile]
+	}
+
+	pick := func() Profile {
+		n := rnd.IntN(weight)
+		for _, profile := range profiles {
+			if n -= sc.Profiles[profile]; n < 0 {
+				return profile
+			}
+		}
+		return profiles[len(profiles)-1]
+	}
+
+	for car := 0; car < sc.Cars; car++ {
+		plate := fmt.Sprintf("SIM%05d", car)
+		for trip := 0; trip < sc.Trips; trip++ {
+			road := sc.Roads[rnd.IntN(len(sc.Roads))]
+			p.trip(rnd, plate, road, uint32(1+2*trip), pick())
+		}
+	}
+
+	if sc.Shuffle {
+		rnd.Shuffle(len(p.Observations), func(i, j int) {
+			p.Observations[i], p.Observations[j] = p.Observations[j], p.Observations[i]
+		})
+	} else {
+		sort.SliceStable(p.Observations, func(i, j int) bool {
+			return p.Observations[i].Plate.Timestamp < p.Observations[j].Plate.Timestamp
+		})
+	}
+
+	return p, nil
+}
+
+// trip drives the car along the road on the day.
+func (p *Plan) trip(rnd *rand.Rand, plate string, road Road, day uint32, profile Profile) {
+	miles := append([]uint16(nil), road.Miles...)
+	sort.Slice(miles, func(i, j int) bool { return miles[i] < miles[j] })
+	if rnd.IntN(2) == 0 {
+		for i, j := 0, len(miles)-1; i < j; i, j = i+1, j-1 {
+			miles[i], miles[j] = miles[j], miles[i]
+		}
+	}
+
+	burst := rnd.IntN(len(miles) - 1)
+
+	// the segment durations in seconds
+	var total uint32
+	durations := make([]uint32, len(miles)-1)
+	for i := range durations {
+		over := profile == Speeding || (profile == Burst && i == burst)
+		durations[i] = duration(rnd, segment(miles[i], miles[i+1]), road.Limit, over)
+		total += durations[i]
+	}
+
+	ts := day*86400 + rnd.Uint32N(86400-total)
+
+	speeding := false
+	for i, mile := range miles {
+		if i > 0 {
+			ts += durations[i-1]
+			speeding = speeding || profile == Speeding || (profile == Burst && i-1 == burst)
+		}
+
+		p.Observations = append(p.Observations, Observation{
+			Camera: speed.Camera{Road: road.ID, Mile: mile, Limit: road.Limit},
+			Plate:  speed.Plate{Plate: plate, Timestamp: ts},
+		})
+
+		roads, ok := p.readings[plate]
+		if !ok {
+			roads = make(map[uint16][]speed.PlateReading)
+			p.readings[plate] = roads
+		}
+		roads[road.ID] = append(roads[road.ID], speed.PlateReading{Mile: mile, Timestamp: ts})
+	}
+
+	if speeding {
+		days, ok := p.expected[plate]
+		if !ok {
+			days = make(map[uint32]bool)
+			p.expected[plate] = days
+		}
+		days[day] = true
+	}
+}
+
+func segment(m1, m2 uint16) float64 {
+	return math.Abs(float64(m2) - float64(m1))
+}
+
+// duration returns the seconds the segment takes at a random speed within or over the limit.
+// The rounding to the whole seconds is compensated, so the average speed stays on its side of
+// the limit.
+func duration(rnd *rand.Rand, distance float64, limit uint16, over bool) uint32 {
+	lo, hi := minSpeed(limit), maxSpeed(limit)
+	if over {
+		lo, hi = minOver(limit), maxOver(limit)
+	}
+
+	mph := lo + rnd.Float64()*(hi-lo)
+	secs := max(uint32(math.Round(distance/mph*3600)), 1)
+
+	for over && secs > 1 && average(distance, secs) < minOver(limit)-4 {
+		secs--
+	}
+
+	for !over && average(distance, secs) > maxSpeed(limit)+4 {
+		secs++
+	}
+
+	return secs
+}
+
+func average(distance float64, secs uint32) float64 {
+	return distance / float64(secs) * 3600
+}
+
+// Mismatch kinds
+const (
+	KindMissing    = "missing"    // an expected ticket was not received
+	KindDuplicate  = "duplicate"  // more than one ticket for the plate and day
+	KindUnexpected = "unexpected" // a ticket for a plate and day within the limit
+	KindInvalid    = "invalid"    // the ticket doesn't match the readings
+	KindError      = "error"      // the server sent an error
+)
+
+// Mismatch is a difference between the expected and the received tickets.
+type Mismatch struct {
+	Kind   string
+	Plate  string
+	Day    uint32
+	Detail string
+}
+
+func (m Mismatch) String() string {
+	if m.Plate == "" {
+		return fmt.Sprintf("%s: %s", m.Kind, m.Detail)
+	}
+
+	return fmt.Sprintf("%s: %s on day %d: %s", m.Kind, m.Plate, m.Day, m.Detail)
+}
+
+// Verify compares the received tickets with the expected ones. A ticket is valid if both its
+// readings were observed on its road and the average speed between them is over the limit,
+// they don't have to be the neighbouring readings.
+func (p *Plan) Verify(tickets []speed.Ticket) []Mismatch {
+	var res []Mismatch
+
+	received := make(map[string]map[uint32]int)
+	for _, t := range tickets {
+		day1 := t.Info.Reading1.Timestamp / 86400
+		day2 := t.Info.Reading2.Timestamp / 86400
+
+		if detail := p.invalid(t); detail != "" {
+			res = append(res, Mismatch{Kind: KindInvalid, Plate: t.Plate, Day: day1, Detail: detail})
+			continue
+		}
+
+		days, ok := received[t.Plate]
+		if !ok {
+			days = make(map[uint32]int)
+			received[t.Plate] = days
+		}
+
+		for day := day1; day <= day2; day++ {
+			days[day]++
+
+			switch {
+			case !p.expected[t.Plate][day]:
+				res = append(res, Mismatch{Kind: KindUnexpected, Plate: t.Plate, Day: day, Detail: ticketString(t)})
+			case days[day] == 2:
+				res = append(res, Mismatch{Kind: KindDuplicate, Plate: t.Plate, Day: day, Detail: ticketString(t)})
+			}
+		}
+	}
+
+	for plate, days := range p.expected {
+		for day := range days {
+			if received[plate][day] == 0 {
+				res = append(res, Mismatch{Kind: KindMissing, Plate: plate, Day: day, Detail: "no ticket"})
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Plate != res[j].Plate {
+			return res[i].Plate < res[j].Plate
+		}
+		return res[i].Day < res[j].Day
+	})
+
+	return res
+}
+
+// invalid describes why the ticket doesn't match the readings (empty if it does).
+func (p *Plan) invalid(t speed.Ticket) string {
+	road, ok := p.Roads[t.Info.Road]
+	if !ok {
+		return fmt.Sprintf("unknown road %d", t.Info.Road)
+	}
+
+	observed := func(r speed.PlateReading) bool {
+		for _, reading := range p.readings[t.Plate][road.ID] {
+			if reading == r {
+				return true
+			}
+		}
+		return false
+	}
+
+	r1, r2 := t.Info.Reading1, t.Info.Reading2
+	if !observed(r1) || !observed(r2) {
+		return "readings not observed: " + ticketString(t)
+	}
+
+	if r1.Timestamp >= r2.Timestamp {
+		return "readings out of order: " + ticketString(t)
+	}
+
+	mph := average(segment(r1.Mile, r2.Mile), r2.Timestamp-r1.Timestamp)
+	if mph <= float64(road.Limit) {
+		return fmt.Sprintf("%.2fmph within the limit %d: %s", mph, road.Limit, ticketString(t))
+	}
+
+	if math.Abs(mph*100-float64(t.Info.Speed)) > 100 {
+		return fmt.Sprintf("speed %d, expected %.0f: %s", t.Info.Speed, mph*100, ticketString(t))
+	}
+
+	return ""
+}
+
+func ticketString(t speed.Ticket) string {
+	return fmt.Sprintf("road %d mile %d at %d - mile %d at %d, speed %d", t.Info.Road,
+		t.Info.Reading1.Mile, t.Info.Reading1.Timestamp, t.Info.Reading2.Mile, t.Info.Reading2.Timestamp, t.Info.Speed)
+}
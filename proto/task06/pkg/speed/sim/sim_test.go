@@ -0,0 +1,194 @@
+package sim_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+
+	"proto/task06/pkg/speed"
+	"proto/task06/pkg/speed/sim"
+)
+
+// serve runs the speed daemon on a random local port and returns its address.
+func serve(t *testing.T) string {
+	t.Helper()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	sd := speed.New(ctx)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				ctx, cancel := context.WithCancel(ctx)
+				defer cancel()
+
+				sd.Handle(ctx, conn, conn.RemoteAddr())
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		shuffle bool
+	}{
+		{name: "in order"},
+		{name: "shuffled", shuffle: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			addr := serve(t)
+
+			sc := sim.DefaultScenario()
+			sc.Cars = 100
+			sc.Shuffle = tt.shuffle
+
+			plan, err := sim.NewPlan(sc)
+			is.NoErr(err)
+			is.True(plan.Expected() > 0)
+
+			report, err := sim.Run(context.Background(), addr, plan, sim.Options{
+				Timeout: 10 * time.Second,
+				Settle:  100 * time.Millisecond,
+			})
+			is.NoErr(err)
+			is.Equal(report.Mismatches, nil)
+			is.Equal(report.Received, plan.Expected())
+			is.Equal(report.Cameras, 12)
+			is.Equal(report.Dispatchers, 2)
+		})
+	}
+}
+
+func TestNewPlan_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(sc *sim.Scenario)
+	}{
+		{name: "no roads", modify: func(sc *sim.Scenario) { sc.Roads = nil }},
+		{name: "no cars", modify: func(sc *sim.Scenario) { sc.Cars = 0 }},
+		{name: "no dispatchers", modify: func(sc *sim.Scenario) { sc.Dispatchers = 0 }},
+		{name: "unknown profile", modify: func(sc *sim.Scenario) { sc.Profiles = map[sim.Profile]int{"reckless": 1} }},
+		{name: "single camera", modify: func(sc *sim.Scenario) { sc.Roads[0].Miles = []uint16{1} }},
+		{name: "duplicate camera", modify: func(sc *sim.Scenario) { sc.Roads[0].Miles = []uint16{1, 1} }},
+		{name: "road too long", modify: func(sc *sim.Scenario) { sc.Roads[0].Miles = []uint16{0, 5000} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			sc := sim.DefaultScenario()
+			tt.modify(&sc)
+
+			_, err := sim.NewPlan(sc)
+			is.True(err != nil)
+		})
+	}
+}
+
+func TestPlan_Verify(t *testing.T) {
+	is := is.New(t)
+
+	plan, err := sim.NewPlan(sim.Scenario{
+		Roads:       []sim.Road{{ID: 7, Limit: 60, Miles: []uint16{0, 10, 20}}},
+		Cars:        1,
+		Trips:       2,
+		Profiles:    map[sim.Profile]int{sim.Speeding: 1},
+		Dispatchers: 1,
+	})
+	is.NoErr(err)
+	is.Equal(plan.Expected(), 2)
+	is.Equal(len(plan.Observations), 6)
+
+	ticket := func(i, j int) speed.Ticket {
+		o1, o2 := plan.Observations[i], plan.Observations[j]
+		r1 := speed.PlateReading{Mile: o1.Camera.Mile, Timestamp: o1.Plate.Timestamp}
+		r2 := speed.PlateReading{Mile: o2.Camera.Mile, Timestamp: o2.Plate.Timestamp}
+		mph := float64(10) / float64(r2.Timestamp-r1.Timestamp) * 3600
+
+		return speed.Ticket{Plate: o1.Plate.Plate, Info: speed.TicketInfo{
+			Road: 7, Reading1: r1, Reading2: r2, Speed: uint16(mph * 100),
+		}}
+	}
+
+	kinds := func(mismatches []sim.Mismatch) []string {
+		var res []string
+		for _, m := range mismatches {
+			res = append(res, m.Kind)
+		}
+		return res
+	}
+
+	wrongSpeed := ticket(0, 1)
+	wrongSpeed.Info.Speed += 500
+
+	wrongRoad := ticket(0, 1)
+	wrongRoad.Info.Road = 8
+
+	tests := []struct {
+		name    string
+		tickets []speed.Ticket
+		want    []string
+	}{
+		{name: "exact", tickets: []speed.Ticket{ticket(0, 1), ticket(4, 5)}},
+		{name: "other pair", tickets: []speed.Ticket{ticket(1, 2), ticket(3, 4)}},
+		{name: "missing", tickets: []speed.Ticket{ticket(0, 1)}, want: []string{sim.KindMissing}},
+		{
+			name:    "duplicate",
+			tickets: []speed.Ticket{ticket(0, 1), ticket(1, 2), ticket(4, 5)},
+			want:    []string{sim.KindDuplicate},
+		},
+		{
+			name:    "wrong speed",
+			tickets: []speed.Ticket{wrongSpeed, ticket(4, 5)},
+			want:    []string{sim.KindInvalid, sim.KindMissing},
+		},
+		{
+			name:    "wrong road",
+			tickets: []speed.Ticket{wrongRoad, ticket(4, 5)},
+			want:    []string{sim.KindInvalid, sim.KindMissing},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(kinds(plan.Verify(tt.tickets)), tt.want)
+		})
+	}
+}
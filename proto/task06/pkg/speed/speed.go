@@ -2,142 +2,195 @@ package speed
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"math"
 	"net"
-	"sort"
 	"sync"
 	"time"
 )
 
+// Message types
 const (
-	typeError         uint8 = 0x10
-	typePlate         uint8 = 0x20
-	typeTicket        uint8 = 0x21
-	typeWantHeartbeat uint8 = 0x40
-	typeHeartbeat     uint8 = 0x41
-	typeIAMCamera     uint8 = 0x80
-	typeIAMDispatcher uint8 = 0x81
+	TypeError         uint8 = 0x10
+	TypePlate         uint8 = 0x20
+	TypeTicket        uint8 = 0x21
+	TypeWantHeartbeat uint8 = 0x40
+	TypeHeartbeat     uint8 = 0x41
+	TypeIAMCamera     uint8 = 0x80
+	TypeIAMDispatcher uint8 = 0x81
 )
 
 type readings []PlateReading
 
 // Speed is a speed camera managing solution
 type Speed struct {
-	mu         sync.Mutex
-	limits     map[uint16]uint16              // speed limits per road
-	plates     map[string]map[uint16]readings // plate,road -> mile, time record.
-	ticketDays map[string]map[uint32]struct{}
+	opts   Options
+	mu     sync.Mutex
+	limits map[uint16]uint16              // speed limits per road
+	plates map[string]map[uint16]readings // plate,road -> mile, time record sorted by time.
+	latest uint32                         // the newest observed timestamp
+	ahead  uint32                         // unconfirmed timestamp too far past the latest one
+	outbox *outbox                        // issued tickets waiting for the dispatch
+}
+
+// Options configures the Speed instance.
+type Options struct {
+	Dir string // data directory of the ticket outbox (in-memory if empty)
+
+	// Retention is how long the readings are kept, relative to the newest observed timestamp
+	// (forever if zero). Older readings are ignored. A timestamp further than the retention past
+	// the newest one counts only once another reading confirms it.
+	Retention     time.Duration
+	PruneInterval time.Duration // how often the readings out of the retention are removed and the journal compacted
 
-	issuedTicketsCh map[uint16]chan *Ticket // tickets per road
-	trackTicketsCh  chan *Ticket            // tickets to create
+	Limits Limits // of the client messages
 }
 
 type clientState struct {
-	addr       net.Addr
-	haInterval time.Duration
-	camera     *Camera
-	dispatcher *Dispatcher
+	addr          net.Addr
+	wantHeartbeat bool // the spec allows a single WantHeartbeat, even if it disables them
+	haInterval    time.Duration
+	camera        *Camera
+	dispatcher    *Dispatcher
 }
 
-// New creates a new Speed instance
+// New creates a new in-memory Speed instance
 func New(ctx context.Context) *Speed {
-	speed := &Speed{
-		limits:          make(map[uint16]uint16),
-		plates:          make(map[string]map[uint16]readings),
-		ticketDays:      make(map[string]map[uint32]struct{}),
-		issuedTicketsCh: make(map[uint16]chan *Ticket),
-		trackTicketsCh:  make(chan *Ticket),
+	return newSpeed(ctx, newOutbox(), Options{})
+}
+
+// Open creates a new Speed instance with the ticket outbox persisted in the data directory. The
+// tickets not delivered before the restart are dispatched again and no plate is ticketed twice
+// for the same day.
+func Open(ctx context.Context, opts Options) (*Speed, error) {
+	if opts.Dir == "" {
+		return newSpeed(ctx, newOutbox(), opts), nil
 	}
 
-	go func(ctx context.Context) {
-		for ticket := range speed.trackTicketsCh {
-			speed.trackTicket(ticket)
-		}
-	}(ctx)
+	o, err := openOutbox(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSpeed(ctx, o, opts), nil
+}
+
+func newSpeed(ctx context.Context, o *outbox, opts Options) *Speed {
+	if opts.PruneInterval <= 0 {
+		opts.PruneInterval = DefaultPruneInterval
+	}
 
-	return speed
+	s := &Speed{
+		opts:   opts,
+		limits: make(map[uint16]uint16),
+		plates: make(map[string]map[uint16]readings),
+		outbox: o,
+	}
+
+	if opts.Retention > 0 || o.journal != nil {
+		go s.pruneLoop(ctx)
+	}
+
+	return s
+}
+
+// Close closes the ticket outbox.
+func (s *Speed) Close() error {
+	return s.outbox.close()
 }
 
-// Handle handles the tcp connection
+// Handle handles the tcp connection. All the messages to the client go through a single
+// writer; the connection is closed once a write fails or after an error message.
 func (s *Speed) Handle(ctx context.Context, rw io.ReadWriter, addr net.Addr) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	state := &clientState{addr: addr}
+	dec := NewDecoder(rw, s.opts.Limits)
+	w := newWriter(rw)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-w.Failed():
+			log.Printf("closing %s: the client can't be written to", addr)
+		}
+
+		// unblocks the read and stops the heartbeat and the dispatch of the connection
+		if c, ok := rw.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}()
 
 	for {
-		var kind [1]byte
-		_, err := rw.Read(kind[:])
+		msg, err := dec.Next()
 		if errors.Is(err, io.EOF) {
 			return
+		}
+
+		var perr *ProtocolError
+		if errors.As(err, &perr) {
+			// the rest of the stream can't be framed anymore
+			writeError(w, perr)
+			return
 		} else if err != nil {
-			log.Printf("failed to read msg kind: %s", err.Error())
-			writeError(rw, fmt.Errorf("Failed to read msg kind: %w", err))
+			log.Printf("failed to read msg from %s: %s", addr, err.Error())
 			return
 		}
 
-		switch kind[0] {
-		case typePlate:
-			err = s.handlePlate(ctx, rw, state)
-
-		case typeWantHeartbeat:
-			err = s.handleHeartbeat(ctx, rw, state)
+		switch msg := msg.(type) {
+		case *Plate:
+			err = s.handlePlate(ctx, w, state, msg)
 
-		case typeIAMCamera:
-			err = s.handleCamera(ctx, rw, state)
+		case *WantHeartbeat:
+			err = s.handleHeartbeat(ctx, w, state, msg)
 
-		case typeIAMDispatcher:
-			err = s.handleDispatcher(ctx, rw, state)
+		case *Camera:
+			err = s.handleCamera(ctx, w, state, msg)
 
-		default:
-			writeError(rw, errors.New("Unexpected message type"))
+		case *Dispatcher:
+			err = s.handleDispatcher(ctx, w, state, msg)
 		}
 
 		if err != nil {
-			writeError(rw, err)
+			// the spec requires to disconnect the client after an error
+			writeError(w, err)
+			return
 		}
 	}
 }
 
 // ==== Message handlers ==========================================================
 
-func (s *Speed) handlePlate(ctx context.Context, rw io.ReadWriter, state *clientState) error {
+func (s *Speed) handlePlate(ctx context.Context, w io.Writer, state *clientState, plate *Plate) error {
 	log.Printf("handling plate message from %s", state.addr.String())
 	if state.camera == nil {
 		return errors.New("The client has not identified itself as camera yet")
 	}
 
-	plate := &Plate{}
-	if _, err := plate.ReadFrom(rw); err != nil {
-		return fmt.Errorf("Failed to parse plate message: %w", err)
-	}
-
 	s.registerPlate(plate, state)
 	s.issueTickets(plate, state)
 
 	return nil
 }
 
-func (s *Speed) handleHeartbeat(ctx context.Context, rw io.ReadWriter, state *clientState) error {
-	if state.haInterval != 0 {
-		return errors.New("heartbeat has already been activated for the client.")
+func (s *Speed) handleHeartbeat(ctx context.Context, w io.Writer, state *clientState, hb *WantHeartbeat) error {
+	if state.wantHeartbeat {
+		return errors.New("heartbeat has already been requested by the client.")
 	}
+	state.wantHeartbeat = true
 
 	log.Printf("handling wantHeartBeat message from %s", state.addr.String())
-	var interval uint32
-	if err := binary.Read(rw, binary.BigEndian, &interval); err != nil {
-		return fmt.Errorf("Failed to parse WantHeartBeat message")
-	}
-
-	if interval == 0 {
+	if hb.Interval == 0 {
 		return nil // no heartbeat
 	}
 
-	state.haInterval = time.Duration(interval) * 100 * time.Millisecond
+	state.haInterval = time.Duration(hb.Interval) * 100 * time.Millisecond
 	log.Printf("starting heartbeat with interval %s\n", state.haInterval)
 
+	// stops with the connection or on the first write error
 	go func() {
 		// interval in deciseconds. eg. 25 means 2.5seconds.
 		// Converting to milliseconds for convenience by multiplying by 100.
@@ -152,7 +205,10 @@ func (s *Speed) handleHeartbeat(ctx context.Context, rw io.ReadWriter, state *cl
 				return
 
 			case <-tick.C:
-				_, _ = rw.Write([]byte{typeHeartbeat})
+				if _, err := w.Write([]byte{TypeHeartbeat}); err != nil {
+					log.Printf("heartbeat stopped: %s", err.Error())
+					return
+				}
 			}
 		}
 	}()
@@ -160,26 +216,29 @@ func (s *Speed) handleHeartbeat(ctx context.Context, rw io.ReadWriter, state *cl
 	return nil
 }
 
-func (s *Speed) handleCamera(ctx context.Context, rw io.ReadWriter, state *clientState) error {
+func (s *Speed) handleCamera(ctx context.Context, w io.Writer, state *clientState, camera *Camera) error {
 	log.Printf("handling IAMCamera message from %s", state.addr.String())
 	if state.camera != nil {
 		return errors.New("The camera has already been identified")
 	}
 
-	state.camera = &Camera{}
-	if _, err := state.camera.ReadFrom(rw); err != nil {
-		return fmt.Errorf("Failed to parse IAMCamera message: %w", err)
+	if state.dispatcher != nil {
+		return errors.New("The client has already been identified as a dispatcher")
 	}
 
+	state.camera = camera
+
 	log.Printf("registering camera at road %d [mile: %d, limit: %d]",
 		state.camera.Road, state.camera.Mile, state.camera.Limit)
 
+	s.mu.Lock()
 	s.limits[state.camera.Road] = state.camera.Limit
+	s.mu.Unlock()
 
 	return nil
 }
 
-func (s *Speed) handleDispatcher(ctx context.Context, rw io.ReadWriter, state *clientState) error {
+func (s *Speed) handleDispatcher(ctx context.Context, w io.Writer, state *clientState, dispatcher *Dispatcher) error {
 	log.Printf("handling IAMDispatcher message from %s", state.addr.String())
 
 	if state.camera != nil {
@@ -190,15 +249,12 @@ func (s *Speed) handleDispatcher(ctx context.Context, rw io.ReadWriter, state *c
 		return errors.New("The client has already been identified as a dispatcher")
 	}
 
-	state.dispatcher = &Dispatcher{}
-	if _, err := state.dispatcher.ReadFrom(rw); err != nil {
-		return fmt.Errorf("Failed to parse IAMDispatcher message")
-	}
+	state.dispatcher = dispatcher
 
 	log.Printf("New dispatcher: %v", state.dispatcher)
 
 	for _, road := range state.dispatcher.Roads {
-		go s.subscribeForRoad(ctx, rw, road)
+		go s.subscribeForRoad(ctx, w, road, state.addr.String())
 	}
 
 	return nil
@@ -206,41 +262,53 @@ func (s *Speed) handleDispatcher(ctx context.Context, rw io.ReadWriter, state *c
 
 // ================================================================================
 
-func (s *Speed) subscribeForRoad(ctx context.Context, w io.Writer, road uint16) {
-	var ticket *Ticket
-
-	ch := s.issuedTicketsChannel(road)
+// subscribeForRoad dispatches the road tickets to the dispatcher until its write fails. Each
+// ticket is written at once. The ticket that failed is left for another dispatcher of the road.
+func (s *Speed) subscribeForRoad(ctx context.Context, w io.Writer, road uint16, dispatcher string) {
 	for {
-		select {
-		case <-ctx.Done():
+		ticket, err := s.outbox.next(ctx, road)
+		if err != nil {
 			return
+		}
 
-		case ticket = <-ch:
-			log.Printf("Dispatching ticket %v for road: %d", ticket, road)
+		log.Printf("Dispatching ticket %v for road: %d", ticket.Ticket, road)
 
-			if _, err := ticket.WriteTo(w); err != nil {
-				log.Printf("error could not send ticket: %s", err.Error())
-			}
+		if err := send(w, ticket.Ticket); err != nil {
+			log.Printf("error could not send ticket: %s", err.Error())
+			s.outbox.requeue(ticket)
+			return
 		}
+
+		s.outbox.ack(ticket, dispatcher)
 	}
 }
 
+// registerPlate stores the reading, unless it's out of the retention or the plate has already
+// been ticketed on its day - such reading can't result in a ticket.
 func (s *Speed) registerPlate(plate *Plate, state *clientState) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.advance(plate.Timestamp)
+
+	cutoff := s.cutoff()
+	if plate.Timestamp < cutoff {
+		log.Printf("Ignoring plate %s for road %d: %d is out of the retention", plate.Plate, state.camera.Road, plate.Timestamp)
+		return
+	}
+
+	if s.outbox.ticketed(plate.Plate, plate.Timestamp/86400) {
+		log.Printf("Ignoring plate %s for road %d: already ticketed on the %d day", plate.Plate, state.camera.Road, plate.Timestamp/86400)
+		return
+	}
+
 	roads, ok := s.plates[plate.Plate]
 	if !ok {
 		roads = make(map[uint16]readings)
 		s.plates[plate.Plate] = roads
 	}
 
-	records, ok := roads[state.camera.Road]
-	if !ok {
-		records = make([]PlateReading, 0)
-	}
-
-	roads[state.camera.Road] = append(records, PlateReading{
+	roads[state.camera.Road] = roads[state.camera.Road].since(cutoff).insert(PlateReading{
 		Mile:      state.camera.Mile,
 		Timestamp: plate.Timestamp,
 	})
@@ -249,35 +317,33 @@ func (s *Speed) registerPlate(plate *Plate, state *clientState) {
 		plate.Plate, state.camera.Road, state.camera.Mile, plate.Timestamp)
 }
 
+// issueTickets checks the speed between the registered reading and its neighbours - the pairs
+// of the other readings have been checked when they were registered.
 func (s *Speed) issueTickets(plate *Plate, state *clientState) {
-	s.mu.Lock()
+	road := state.camera.Road
 
-	roads, ok := s.plates[plate.Plate]
-	if !ok {
-		roads = make(map[uint16]readings)
-		s.plates[plate.Plate] = roads
-	}
+	s.mu.Lock()
+	limit, ok := s.limits[road]
 
-	records, ok := roads[state.camera.Road]
-	if !ok {
-		records = make([]PlateReading, 0)
-	} else {
-		// sort records
-		sort.Slice(records, func(i, j int) bool {
-			return records[i].Timestamp < records[j].Timestamp
-		})
+	var pairs [][2]PlateReading
+	records := s.plates[plate.Plate][road]
+	if i := records.find(PlateReading{Mile: state.camera.Mile, Timestamp: plate.Timestamp}); i >= 0 {
+		if i > 0 {
+			pairs = append(pairs, [2]PlateReading{records[i-1], records[i]})
+		}
+		if i+1 < len(records) {
+			pairs = append(pairs, [2]PlateReading{records[i], records[i+1]})
+		}
 	}
 	s.mu.Unlock()
 
-	limit, ok := s.limits[state.camera.Road]
 	if !ok {
 		// paranoia - no limits for the road yet
 		return
 	}
 
-	for i := 1; i < len(records); i++ {
-		r1, r2 := records[i-1], records[i]
-		log.Printf("r1: %v, r2: %v", r1, r2)
+	for _, pair := range pairs {
+		r1, r2 := pair[0], pair[1]
 
 		distance := math.Abs(float64(r2.Mile) - float64(r1.Mile))
 		delta := float64(r2.Timestamp) - float64(r1.Timestamp)
@@ -285,66 +351,41 @@ func (s *Speed) issueTickets(plate *Plate, state *clientState) {
 		if delta == 0 {
 			continue
 		}
-		log.Printf("distance: %v, delta: %v", distance, delta)
 
 		speed := distance / delta * 3600
-		log.Printf("calculated speed: %d", uint16(speed))
-		log.Printf("limit: %d", limit)
 
 		// the error is 0.5 but to avoid corner cases we can half the error since it's acceptable
 		// by the spec.
 		if speed > float64(limit)+0.3 {
-			log.Printf("speeding detected: %s - speed: %d", plate.Plate, uint16(speed))
-			s.trackTicket(&Ticket{
+			log.Printf("speeding detected: %s - speed: %d, limit: %d", plate.Plate, uint16(speed), limit)
+			ticket := &Ticket{
 				Plate: plate.Plate,
 				Info: TicketInfo{
 					Reading1: r1,
 					Reading2: r2,
-					Road:     state.camera.Road,
+					Road:     road,
 					Speed:    uint16(speed * 100),
 				},
-			})
-		}
-	}
-}
-
-func (s *Speed) trackTicket(ticket *Ticket) {
-	ticketDates, ok := s.ticketDays[ticket.Plate]
-	if !ok {
-		ticketDates = make(map[uint32]struct{})
-		s.ticketDays[ticket.Plate] = ticketDates
-	}
-
-	day1 := ticket.Info.Reading1.Timestamp / 86400
-	day2 := ticket.Info.Reading2.Timestamp / 86400
+			}
 
-	for i := day1; i <= day2; i++ {
-		if _, ok := ticketDates[i]; ok {
-			log.Printf("%s has already been ticketed on the %d day", ticket.Plate, i)
-			return // already ticketed
+			if s.trackTicket(ticket) {
+				s.pruneTicketed(ticket)
+			}
 		}
 	}
-
-	// register ticket
-	for i := day1; i <= day2; i++ {
-		ticketDates[i] = struct{}{}
-	}
-
-	log.Printf("add pending ticket: %v", ticket)
-	ch := s.issuedTicketsChannel(ticket.Info.Road)
-	ch <- ticket
 }
 
-func (s *Speed) issuedTicketsChannel(road uint16) chan *Ticket {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// trackTicket issues the ticket. It reports whether it was issued.
+func (s *Speed) trackTicket(ticket *Ticket) bool {
+	ok, err := s.outbox.issue(ticket)
+	if err != nil {
+		log.Printf("error could not issue ticket %v: %s", ticket, err.Error())
+		return false
+	}
 
-	// append tickets to the pending tickets
-	ch, ok := s.issuedTicketsCh[road]
-	if !ok {
-		ch = make(chan *Ticket, 1000)
-		s.issuedTicketsCh[road] = ch
+	if ok {
+		log.Printf("add pending ticket: %v", ticket)
 	}
 
-	return ch
+	return ok
 }
@@ -37,8 +37,8 @@ func TestSpeed_logic(t *testing.T) {
 
 	s.limits[42] = 100
 	var buf bytes.Buffer
-	go s.subscribeForRoad(ctx, &buf, 42)
-	go s.subscribeForRoad(ctx, &buf, 42)
+	go s.subscribeForRoad(ctx, &buf, 42, "dispatcher")
+	go s.subscribeForRoad(ctx, &buf, 42, "dispatcher")
 
 	s.registerPlate(plate1, camState1)
 	s.registerPlate(plate2, camState2)
@@ -0,0 +1,56 @@
+package speed
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// writer serializes the messages sent to a client: the heartbeats, the tickets of all the
+// dispatched roads and the errors. Every message is written by a single Write, so they never
+// interleave. The first write error is returned by all the following writes.
+type writer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	err    error
+	failed chan struct{} // closed on the first write error
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: w, failed: make(chan struct{})}
+}
+
+// Write writes a whole message.
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+		close(w.failed)
+	}
+
+	return n, err
+}
+
+// Failed is closed once a write fails - the client can't be written to anymore.
+func (w *writer) Failed() <-chan struct{} {
+	return w.failed
+}
+
+// send encodes the message and writes it at once.
+func send(w io.Writer, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
@@ -0,0 +1,188 @@
+package speed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// countingWriter counts the writes and fails all of them.
+type countingWriter struct {
+	writes atomic.Int32
+}
+
+func (w *countingWriter) Write([]byte) (int, error) {
+	w.writes.Add(1)
+	return 0, errors.New("broken pipe")
+}
+
+// session runs Handle over a pipe and returns the client end. done is closed when Handle returns.
+func session(t *testing.T, s *Speed) (client net.Conn, done <-chan struct{}) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		s.Handle(context.Background(), server, &net.TCPAddr{})
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return client, ch
+}
+
+func TestSpeed_SerializedWrites(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+
+	s := New(context.Background())
+	client, _ := session(t, s)
+
+	go func() {
+		_, _ = client.Write([]byte{
+			TypeWantHeartbeat, 0x00, 0x00, 0x00, 0x01, // every 0.1s
+			TypeIAMDispatcher, 0x01, 0x00, 0x01,
+		})
+	}()
+
+	const n = 300
+	go func() {
+		for i := 0; i < n; i++ {
+			ticket := testTicket(fmt.Sprintf("P%03d", i), 1, uint32(i)*86400)
+			_, _ = s.outbox.issue(ticket)
+			if i%50 == 0 {
+				time.Sleep(150 * time.Millisecond) // let some heartbeats in
+			}
+		}
+	}()
+
+	// every message is whole
+	var heartbeats, tickets int
+	for tickets < n {
+		kind := make([]byte, 1)
+		_, err := io.ReadFull(client, kind)
+		is.NoErr(err)
+
+		switch kind[0] {
+		case TypeHeartbeat:
+			heartbeats++
+
+		case TypeTicket:
+			var got Ticket
+			_, err := got.ReadFrom(client)
+			is.NoErr(err)
+			is.Equal(got.Info.Road, uint16(1))
+			is.Equal(got.Info.Speed, uint16(8000))
+			tickets++
+
+		default:
+			t.Fatalf("unexpected message type 0x%02x", kind[0])
+		}
+	}
+
+	is.True(heartbeats > 0)
+}
+
+func TestSpeed_HeartbeatStops(t *testing.T) {
+	is := is.New(t)
+	quiet(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(ctx)
+	cw := &countingWriter{}
+	w := newWriter(cw)
+
+	err := s.handleHeartbeat(ctx, w, &clientState{addr: &net.TCPAddr{}}, &WantHeartbeat{Interval: 1})
+	is.NoErr(err)
+
+	select {
+	case <-w.Failed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat")
+	}
+
+	// no more writes after the failure
+	time.Sleep(350 * time.Millisecond)
+	is.Equal(cw.writes.Load(), int32(1))
+
+	_, err = w.Write([]byte{TypeHeartbeat})
+	is.True(err != nil) // the first error sticks
+	is.Equal(cw.writes.Load(), int32(1))
+}
+
+func TestSpeed_ErrorDisconnects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{
+			name:  "plate before camera",
+			input: []byte{TypePlate, 0x04, 'U', 'N', '1', 'X', 0x00, 0x00, 0x03, 0xe8},
+		},
+		{
+			name:  "heartbeat twice",
+			input: []byte{TypeWantHeartbeat, 0x00, 0x00, 0x00, 0x0a, TypeWantHeartbeat, 0x00, 0x00, 0x00, 0x0a},
+		},
+		{
+			name:  "heartbeat twice, the first disabled",
+			input: []byte{TypeWantHeartbeat, 0x00, 0x00, 0x00, 0x00, TypeWantHeartbeat, 0x00, 0x00, 0x00, 0x0a},
+		},
+		{
+			name:  "camera twice",
+			input: []byte{TypeIAMCamera, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c, TypeIAMCamera, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c},
+		},
+		{
+			name:  "dispatcher after camera",
+			input: []byte{TypeIAMCamera, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c, TypeIAMDispatcher, 0x01, 0x00, 0x42},
+		},
+		{
+			name:  "camera after dispatcher",
+			input: []byte{TypeIAMDispatcher, 0x01, 0x00, 0x42, TypeIAMCamera, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			quiet(t)
+
+			client, done := session(t, New(context.Background()))
+
+			go func() {
+				_, _ = client.Write(tt.input)
+			}()
+
+			kind := make([]byte, 1)
+			_, err := io.ReadFull(client, kind)
+			is.NoErr(err)
+			is.Equal(kind[0], TypeError)
+
+			msg, err := ReadString(client)
+			is.NoErr(err)
+			is.True(msg != "")
+
+			// the server closes the connection
+			_, err = client.Read(kind)
+			is.Equal(err, io.EOF)
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("session not closed")
+			}
+		})
+	}
+}